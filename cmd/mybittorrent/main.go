@@ -3,17 +3,30 @@ package main
 import (
 	// Uncomment this line to pass the first stage
 
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/conn"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/dht"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/httpserve"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/ratelimit"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/services"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/session"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/tracker/server"
 	// bencode "github.com/jackpal/bencode-go" // Available if you need it!
 )
 
@@ -22,19 +35,77 @@ func main() {
 	logger := log.NewLogger(log.NORMAL)
 	services.Logger = logger
 
+	// the generated peer id can be overridden, either fully or by prefix
+	if id := os.Getenv("BT_PEER_ID"); id != "" {
+		if err := torrent.SetLocalPeerID(id); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
 	command := os.Args[1]
 
 	switch command {
 	case "decode":
-		bencodedValue := os.Args[2]
+		decodeCmd := flag.NewFlagSet("decode", flag.ExitOnError)
+		inputPath := decodeCmd.String("f", "", "Reads the bencoded value from a file, - for stdin")
+		tree := decodeCmd.Bool("tree", false, "Prints the value as a tree instead of JSON")
+
+		decodeCmd.Parse(os.Args[2:])
+		data, err := readInput(*inputPath, decodeCmd.Args())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// files made by other tools don't always follow the canonical encoding
+		d := bencode.NewDecoder(bytes.NewReader(data))
+		d.SetMode(bencode.Lenient)
+		d.SetMaxStringLength(len(data))
+		var decoded interface{}
+		if err := d.Decode(&decoded); err != nil {
+			fmt.Println(err)
+			return
+		}
+
+		if *tree {
+			bencode.WriteTree(os.Stdout, decoded)
+			return
+		}
+		jsonOutput, err := json.Marshal(bencode.JSONValue(decoded))
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Println(string(jsonOutput))
+
+	case "encode":
+		encodeCmd := flag.NewFlagSet("encode", flag.ExitOnError)
+		inputPath := encodeCmd.String("f", "", "Reads the JSON value from a file, - for stdin")
+		savePath := encodeCmd.String("o", "", "Sets the output path, stdout if not given")
+
+		encodeCmd.Parse(os.Args[2:])
+		data, err := readInput(*inputPath, encodeCmd.Args())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
-		jsonOutput, err := bencode.DecodeBencodeToJSON(bencodedValue)
+		encoded, err := bencode.JSONToBencode(data)
 		if err != nil {
 			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		if *savePath == "" {
+			os.Stdout.Write(encoded)
 			return
 		}
+		if err := os.WriteFile(*savePath, encoded, 0644); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
-		fmt.Println(jsonOutput)
 	case "info":
 
 		torrentPath := os.Args[2]
@@ -77,6 +148,19 @@ func main() {
 			fmt.Printf("%x\n", pieceHash)
 		}
 
+		// files are numbered from 1, as selected with download -files
+		files, err := t.Files()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if len(files) > 1 || len(files[0].Path) > 1 {
+			fmt.Println("Files:")
+			for i, f := range files {
+				fmt.Printf("%d %s (%d bytes)\n", i+1, strings.Join(f.Path[1:], "/"), f.Length)
+			}
+		}
+
 	case "peers":
 
 		torrentPath := os.Args[2]
@@ -95,7 +179,7 @@ func main() {
 		}
 
 		for _, peer := range resp.Peers {
-			fmt.Printf("%s:%d\n", peer.AddrIPV4, peer.Port)
+			fmt.Println(peer.Addr())
 		}
 
 	case "handshake":
@@ -108,25 +192,23 @@ func main() {
 			os.Exit(1)
 		}
 
-		parts := strings.Split(os.Args[3], ":")
-		port, err := strconv.Atoi(parts[1])
+		// accepts both addr:port and [addr]:port for IPv6 peers
+		peer, err := torrent.ParsePeerAddr(os.Args[3])
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 
-		peer := &torrent.Peer{
-			AddrIPV4: parts[0],
-			Port:     uint16(port),
-		}
-
 		pc, err := conn.EstablishConnection(torrent.LocalPeerID, peer, t, logger)
-		defer pc.Close()
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
+		defer pc.Close()
 		fmt.Printf("Peer ID: %x\n", pc.RemotePeerID())
+		if client, ok := torrent.ParsePeerID(pc.RemotePeerID()); ok {
+			fmt.Println("Client:", client)
+		}
 
 	case "download_piece":
 		dowCmd := flag.NewFlagSet("download_piece", flag.ExitOnError)
@@ -155,6 +237,17 @@ func main() {
 	case "download":
 		fileCmd := flag.NewFlagSet("download", flag.ExitOnError)
 		savePath := fileCmd.String("o", "", "Sets the output path for the downloaded file")
+		useMmap := fileCmd.Bool("mmap", false, "Writes the files through memory maps")
+		cacheSize := fileCmd.Int("cache", 0, "Sets the size of the write cache in MiB, 0 disables it")
+		flushPolicy := fileCmd.String("flush", "complete", "Sets when cached pieces are written: complete or full")
+		var only, exclude, high, low stringsFlag
+		fileCmd.Var(&only, "only", "Downloads only the files matching the glob, can be repeated")
+		fileCmd.Var(&exclude, "exclude", "Skips the files matching the glob, can be repeated")
+		fileCmd.Var(&high, "high", "Downloads the files matching the glob first, can be repeated")
+		fileCmd.Var(&low, "low", "Downloads the files matching the glob last, can be repeated")
+		fileIndexes := fileCmd.String("files", "", "Downloads only the files with the given indexes, e.g. 1,3-5")
+		rates := newRateFlags(fileCmd)
+		banFile := fileCmd.String("ban-file", "", "Keeps the peers banned for sending bad data in the file")
 
 		fileCmd.Parse(os.Args[2:])
 		if len(fileCmd.Args()) != 1 {
@@ -163,7 +256,67 @@ func main() {
 		}
 		torrentFilePath := fileCmd.Arg(0)
 
-		downloadService := services.NewDownloadFileService()
+		var indexes []int
+		if *fileIndexes != "" {
+			// indexes are checked against the files of the torrent
+			t, err := torrent.NewSingleTorrentFromFile(torrentFilePath)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			files, err := t.Files()
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			indexes, err = torrent.ParseFileIndexes(*fileIndexes, len(files))
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		limits, schedule, err := rates.parse()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		bans, err := loadBanList(*banFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts := services.DownloadOptions{
+			Bans: bans,
+			Limits: services.RateLimits{
+				Download:     ratelimit.NewLimiter(limits[0]),
+				Upload:       ratelimit.NewLimiter(limits[1]),
+				PeerDownload: ratelimit.NewLimiter(limits[2]),
+				PeerUpload:   ratelimit.NewLimiter(limits[3]),
+			},
+			Mmap:      *useMmap,
+			CacheSize: int64(*cacheSize) << 20,
+			Files: torrent.FileSelection{
+				Only:    only,
+				Indexes: indexes,
+				Exclude: exclude,
+				High:    high,
+				Low:     low,
+			},
+		}
+		if schedule != nil {
+			opts.Limits.Download.SetSchedule(schedule)
+			opts.Limits.Upload.SetSchedule(schedule)
+		}
+		switch *flushPolicy {
+		case "complete":
+			opts.FlushPolicy = torrent.FlushOnComplete
+		case "full":
+			opts.FlushPolicy = torrent.FlushWhenFull
+		default:
+			fmt.Println("Invalid flush policy:", *flushPolicy)
+			os.Exit(1)
+		}
+		downloadService := services.NewDownloadFileServiceWithOptions(opts)
 
 		if err := downloadService.DownloadFile(torrentFilePath, *savePath); err != nil {
 			fmt.Println(err)
@@ -171,9 +324,465 @@ func main() {
 		}
 		logger.Printf("Downloaded %s to %s\n", torrentFilePath, *savePath)
 
+	case "session":
+		sessionCmd := flag.NewFlagSet("session", flag.ExitOnError)
+		savePath := sessionCmd.String("o", ".", "Sets the directory the torrents are downloaded to")
+		maxActive := sessionCmd.Int("active", 3, "Sets the number of torrents downloading at once")
+		maxConns := sessionCmd.Int("conns", 50, "Sets the number of peer connections across torrents")
+		rates := newRateFlags(sessionCmd)
+		banFile := sessionCmd.String("ban-file", "", "Keeps the peers banned for sending bad data in the file")
+		listenAddr := sessionCmd.String("listen", ":6881", "Sets the address peers connect to, empty to not accept connections")
+		dhtAddr := sessionCmd.String("dht", ":6881", "Sets the UDP address of the DHT node, empty to not use the DHT")
+		sessionCmd.Parse(os.Args[2:])
+		if len(sessionCmd.Args()) == 0 {
+			fmt.Println("Usage: session [-o dir] [-active n] [-conns n] [-listen addr] [-dht addr] <torrent...>")
+			os.Exit(1)
+		}
+		limits, schedule, err := rates.parse()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		bans, err := loadBanList(*banFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		var listener net.Listener
+		if *listenAddr != "" {
+			listener, err = net.Listen("tcp", *listenAddr)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+		var node *dht.DHT
+		if *dhtAddr != "" {
+			node, err = dht.New(dht.Options{Addr: *dhtAddr})
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		s := session.New(session.Options{
+			Storage:          torrent.FileStorageOpener(*savePath),
+			MaxActive:        *maxActive,
+			MaxConns:         *maxConns,
+			DownloadRate:     limits[0],
+			UploadRate:       limits[1],
+			PeerDownloadRate: limits[2],
+			PeerUploadRate:   limits[3],
+			RateSchedule:     schedule,
+			Bans:             bans,
+			Listener:         listener,
+			DHT:              node,
+		})
+		defer s.Close()
+		for _, arg := range sessionCmd.Args() {
+			t, err := torrent.NewSingleTorrentFromFile(arg)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			if _, err := s.Add(t); err != nil {
+				fmt.Println(arg+":", err)
+				os.Exit(1)
+			}
+		}
+
+		done := make(chan struct{})
+		go func() {
+			s.Wait()
+			close(done)
+		}()
+
+		// states are printed as they change
+		printed := make(map[string]session.State)
+		printStates := func() bool {
+			failed := false
+			for _, status := range s.Torrents() {
+				failed = failed || status.State == session.Failed
+				if state, ok := printed[status.InfoHash]; ok && state == status.State {
+					continue
+				}
+				printed[status.InfoHash] = status.State
+				if status.Err != nil {
+					logger.Printf("%s: %s (%v)\n", status.Name, status.State, status.Err)
+				} else {
+					logger.Printf("%s: %s (%d/%d pieces)\n", status.Name, status.State, status.Completed, status.Pieces)
+				}
+			}
+			return failed
+		}
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for waiting := true; waiting; {
+			select {
+			case <-ticker.C:
+				printStates()
+			case <-done:
+				waiting = false
+			}
+		}
+		if printStates() {
+			s.Close()
+			os.Exit(1)
+		}
+
+	case "stream":
+		streamCmd := flag.NewFlagSet("stream", flag.ExitOnError)
+		savePath := streamCmd.String("o", "", "Sets the output path for the downloaded files")
+		fileIdx := streamCmd.Int("file", 1, "Sets the index of the file written to stdout, as listed by info")
+
+		streamCmd.Parse(os.Args[2:])
+		if len(streamCmd.Args()) != 1 || *savePath == "" {
+			fmt.Println("Usage: stream -o <path> [-file <index>] <torrent>")
+			os.Exit(1)
+		}
+
+		// the file is written to stdout while the torrent downloads to the output path
+		downloadService := services.NewDownloadFileService()
+		if err := downloadService.StreamFile(streamCmd.Arg(0), *savePath, *fileIdx-1, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+	case "scrape":
+		scrapeCmd := flag.NewFlagSet("scrape", flag.ExitOnError)
+		jsonOutput := scrapeCmd.Bool("json", false, "Prints the results as JSON")
+
+		scrapeCmd.Parse(os.Args[2:])
+		if len(scrapeCmd.Args()) == 0 {
+			fmt.Println("Missing arguments")
+			os.Exit(1)
+		}
+
+		results := services.NewScrapeService().Scrape(scrapeCmd.Args())
+
+		if *jsonOutput {
+			out, err := json.MarshalIndent(results, "", "  ")
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Println(string(out))
+			return
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tINFOHASH\tSEEDERS\tLEECHERS\tCOMPLETED")
+		var failed []*services.ScrapeResult
+		for _, r := range results {
+			if r.Error != "" {
+				failed = append(failed, r)
+				continue
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\n", r.Name, r.InfoHash, r.Seeders, r.Leechers, r.Completed)
+		}
+		w.Flush()
+
+		// errors are listed after the table to keep it readable
+		for _, r := range failed {
+			fmt.Printf("%s: %s\n", r.Path, r.Error)
+		}
+
+	case "tracker":
+		if len(os.Args) < 3 || os.Args[2] != "serve" {
+			fmt.Println("Usage: tracker serve [-listen addr] [-interval duration] [-allowlist file]")
+			os.Exit(1)
+		}
+
+		serveCmd := flag.NewFlagSet("tracker serve", flag.ExitOnError)
+		listenAddr := serveCmd.String("listen", ":6969", "Sets the address the tracker listens on")
+		interval := serveCmd.Duration("interval", 30*time.Minute, "Sets the announce interval sent to clients")
+		minInterval := serveCmd.Duration("min-interval", 0, "Sets the min announce interval sent to clients")
+		allowlistPath := serveCmd.String("allowlist", "", "File with the hex infohashes allowed, one per line")
+		serveCmd.Parse(os.Args[3:])
+
+		opts := server.Options{
+			Interval:    *interval,
+			MinInterval: *minInterval,
+		}
+		if *allowlistPath != "" {
+			content, err := os.ReadFile(*allowlistPath)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			for _, line := range strings.Fields(string(content)) {
+				ih, err := hex.DecodeString(line)
+				if err != nil || len(ih) != 20 {
+					fmt.Println("Invalid infohash in allowlist:", line)
+					os.Exit(1)
+				}
+				opts.Allowlist = append(opts.Allowlist, ih)
+			}
+		}
+
+		logger.Printf("Tracker listening on %s\n", *listenAddr)
+		if err := http.ListenAndServe(*listenAddr, server.New(opts)); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+	case "serve":
+		serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
+		listenAddr := serveCmd.String("listen", ":8080", "Sets the address the server listens on")
+		savePath := serveCmd.String("o", ".", "Sets the directory the torrents are downloaded to")
+		idleTimeout := serveCmd.Duration("idle", 5*time.Minute, "Stops torrents without requests for this long")
+		serveCmd.Parse(os.Args[2:])
+		if len(serveCmd.Args()) == 0 {
+			fmt.Println("Usage: serve [-listen addr] [-o dir] [-idle duration] <torrent file...>")
+			os.Exit(1)
+		}
+
+		srv := httpserve.New(httpserve.Options{
+			Storage:     torrent.FileStorageOpener(*savePath),
+			IdleTimeout: *idleTimeout,
+		})
+		for _, arg := range serveCmd.Args() {
+			// the metadata of magnet links would have to be fetched from peers
+			// (BEP 9), which isn't supported
+			if strings.HasPrefix(arg, "magnet:") {
+				fmt.Println("Magnet links are not supported, serve takes torrent files only:", arg)
+				os.Exit(1)
+			}
+			t, err := torrent.NewSingleTorrentFromFile(arg)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			id, err := srv.Add(t)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			logger.Printf("Serving %s at /%s/\n", arg, id)
+		}
+
+		logger.Printf("Listening on %s\n", *listenAddr)
+		if err := http.ListenAndServe(*listenAddr, srv); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+	case "edit":
+		editCmd := flag.NewFlagSet("edit", flag.ExitOnError)
+		savePath := editCmd.String("o", "", "Sets the output path, the torrent is changed in place if not given")
+		announce := editCmd.String("announce", "", "Sets the announce URL")
+		var addTrackers, removeTrackers, addWebSeeds, removeWebSeeds stringsFlag
+		editCmd.Var(&addTrackers, "add-tracker", "Adds a tracker, can be repeated")
+		editCmd.Var(&removeTrackers, "remove-tracker", "Removes a tracker, can be repeated")
+		editCmd.Var(&addWebSeeds, "add-webseed", "Adds a web seed URL, can be repeated")
+		editCmd.Var(&removeWebSeeds, "remove-webseed", "Removes a web seed URL, can be repeated")
+		comment := editCmd.String("comment", "", "Sets the comment, an empty one removes it")
+		createdBy := editCmd.String("created-by", "", "Sets the created by key, an empty one removes it")
+		private := editCmd.String("private", "", "Sets (true) or clears (false) the private flag, changes the infohash")
+		allowInfoChange := editCmd.Bool("allow-infohash-change", false, "Allows changes to the info dictionary")
+
+		editCmd.Parse(os.Args[2:])
+		if len(editCmd.Args()) != 1 {
+			fmt.Println("Usage: edit [flags] <torrent>")
+			os.Exit(1)
+		}
+		torrentPath := editCmd.Arg(0)
+		given := make(map[string]bool)
+		editCmd.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+		f, err := os.Open(torrentPath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		editor, err := torrent.NewEditor(f)
+		f.Close()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		before := editor.InfoHash()
+		fmt.Printf("Info Hash before: %x\n", before)
+
+		// top level keys are set to the flag value, or removed when it's empty
+		setOrDelete := func(key, value string) error {
+			if value == "" {
+				return editor.Delete(key)
+			}
+			return editor.Set(key, value)
+		}
+
+		var errs []error
+		if given["announce"] {
+			errs = append(errs, setOrDelete("announce", *announce))
+		}
+		for _, url := range addTrackers {
+			errs = append(errs, editor.AddTracker(url))
+		}
+		for _, url := range removeTrackers {
+			errs = append(errs, editor.RemoveTracker(url))
+		}
+		if len(addWebSeeds) > 0 || len(removeWebSeeds) > 0 {
+			var webSeeds []string
+			for _, url := range append(editor.WebSeeds(), addWebSeeds...) {
+				if !containsString(removeWebSeeds, url) && !containsString(webSeeds, url) {
+					webSeeds = append(webSeeds, url)
+				}
+			}
+			errs = append(errs, editor.SetWebSeeds(webSeeds))
+		}
+		if given["comment"] {
+			errs = append(errs, setOrDelete("comment", *comment))
+		}
+		if given["created-by"] {
+			errs = append(errs, setOrDelete("created by", *createdBy))
+		}
+		if given["private"] {
+			if !*allowInfoChange {
+				fmt.Println("The private flag is part of the info dictionary, changing it requires -allow-infohash-change")
+				os.Exit(1)
+			}
+			isPrivate, err := strconv.ParseBool(*private)
+			if err != nil {
+				fmt.Println("private must be true or false")
+				os.Exit(1)
+			}
+			if isPrivate {
+				errs = append(errs, editor.SetInfo("private", 1))
+			} else {
+				errs = append(errs, editor.SetInfo("private", nil))
+			}
+		}
+		for _, err := range errs {
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		}
+
+		after := editor.InfoHash()
+		fmt.Printf("Info Hash after:  %x\n", after)
+		if !bytes.Equal(before, after) && !*allowInfoChange {
+			fmt.Println("The infohash changed, not saving without -allow-infohash-change")
+			os.Exit(1)
+		}
+
+		if *savePath == "" {
+			*savePath = torrentPath
+		}
+		out := new(bytes.Buffer)
+		if _, err := editor.WriteTo(out); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := os.WriteFile(*savePath, out.Bytes(), 0644); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+	case "bencode":
+		if len(os.Args) < 4 || os.Args[2] != "validate" {
+			fmt.Println("Usage: bencode validate <file|->")
+			os.Exit(1)
+		}
+
+		data, err := readInput(os.Args[3], nil)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		violations := bencode.Validate(data)
+		for _, v := range violations {
+			fmt.Printf("offset %d: %s\n", v.Offset, v.Msg)
+		}
+		if len(violations) > 0 {
+			fmt.Printf("%d violations found\n", len(violations))
+			os.Exit(1)
+		}
+		fmt.Println("valid")
+
 	default:
 		fmt.Println("Unknown command:", command)
 		os.Exit(1)
 	}
 
 }
+
+// readInput returns the contents of the file at path, or of stdin if path is "-".
+// Without a path, the single argument given is the input.
+func readInput(path string, args []string) ([]byte, error) {
+	switch path {
+	case "":
+		if len(args) != 1 {
+			return nil, fmt.Errorf("expected a value or -f <file|->")
+		}
+		return []byte(args[0]), nil
+	case "-":
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+// rateFlags are the rate limiting flags of the download commands
+type rateFlags struct {
+	down, up, peerDown, peerUp, schedule *string
+}
+
+func newRateFlags(fs *flag.FlagSet) *rateFlags {
+	return &rateFlags{
+		down:     fs.String("max-down", "0", "Limits the download rate in bytes per second, e.g. 500K or 2M, 0 for unlimited"),
+		up:       fs.String("max-up", "0", "Limits the upload rate in bytes per second, 0 for unlimited"),
+		peerDown: fs.String("max-peer-down", "0", "Limits the download rate of each peer, 0 for unlimited"),
+		peerUp:   fs.String("max-peer-up", "0", "Limits the upload rate of each peer, 0 for unlimited"),
+		schedule: fs.String("rate-schedule", "", "Overrides -max-down and -max-up at times of day, e.g. 22:00-07:00=0,12:00-13:00=1M"),
+	}
+}
+
+// parse returns the download, upload, peer download and peer upload rates,
+// and the schedule of the overall rates
+func (rf *rateFlags) parse() ([4]int64, ratelimit.Schedule, error) {
+	var rates [4]int64
+	for i, value := range []*string{rf.down, rf.up, rf.peerDown, rf.peerUp} {
+		rate, err := ratelimit.ParseRate(*value)
+		if err != nil {
+			return rates, nil, err
+		}
+		rates[i] = rate
+	}
+	if *rf.schedule == "" {
+		return rates, nil, nil
+	}
+	schedule, err := ratelimit.ParseSchedule(*rf.schedule)
+	return rates, schedule, err
+}
+
+// loadBanList returns the ban list saved at path, or an in-memory one if path
+// is empty
+func loadBanList(path string) (*services.BanList, error) {
+	if path == "" {
+		return services.NewBanList(), nil
+	}
+	return services.LoadBanList(path)
+}
+
+// stringsFlag collects the values of a flag given more than once
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, elem := range list {
+		if elem == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,695 @@
+package bencode
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+const (
+	// DefaultMaxDepth is the default limit on nested lists and dictionaries
+	DefaultMaxDepth = 64
+	// DefaultMaxStringLength is the default limit on the length of a single string
+	DefaultMaxStringLength = 32 << 20
+
+	// integers longer than this can't fit in 64 bits anyway
+	maxIntLength = 32
+	// strings up to this size are read in one go, larger ones grow as data arrives
+	// so that a bogus length can't make us allocate more than was actually sent
+	stringChunkSize = 64 << 10
+)
+
+// Mode selects how strictly the decoder follows the bencode rules
+type Mode int
+
+const (
+	// Strict rejects anything but the canonical encoding: dictionary keys sorted
+	// and unique, integers without leading zeros or negative zero, and no data
+	// after the value.
+	Strict Mode = iota
+	// Lenient accepts the common quirks of trackers and torrent makers that break
+	// the rules above. For duplicate keys the last value wins.
+	Lenient
+)
+
+// Decoder reads bencoded values from an input stream. Errors report the byte
+// offset in the stream where they happened. The nesting depth and the string
+// lengths are limited, so that hostile payloads can't exhaust memory.
+type Decoder struct {
+	r   *bufio.Reader
+	off int64
+
+	mode         Mode
+	maxDepth     int
+	maxStringLen int
+	depth        int
+
+	// when set, the rules broken in lenient mode are collected here
+	violations *[]*SyntaxError
+
+	// the bytes read are kept while recording, to hand whole values to Unmarshalers
+	recording int
+	rec       []byte
+}
+
+// NewDecoder returns a decoder reading from r. The decoder may read data past
+// the value decoded, which is available through Buffered.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Decoder{
+		r:            br,
+		maxDepth:     DefaultMaxDepth,
+		maxStringLen: DefaultMaxStringLength,
+	}
+}
+
+// SetMode sets how strictly the input is checked, Strict by default
+func (d *Decoder) SetMode(mode Mode) {
+	d.mode = mode
+}
+
+// SetMaxDepth limits the nesting of lists and dictionaries
+func (d *Decoder) SetMaxDepth(n int) {
+	d.maxDepth = n
+}
+
+// SetMaxStringLength limits the length of a single string
+func (d *Decoder) SetMaxStringLength(n int) {
+	d.maxStringLen = n
+}
+
+// InputOffset returns the number of bytes consumed so far
+func (d *Decoder) InputOffset() int64 {
+	return d.off
+}
+
+// Buffered returns the data read from the input but not consumed yet
+func (d *Decoder) Buffered() io.Reader {
+	b, _ := d.r.Peek(d.r.Buffered())
+	return bytes.NewReader(b)
+}
+
+// Decode reads the next value from the input and stores it in the value pointed
+// to by v, following the rules of Unmarshal.
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("bencode: Decode requires a non-nil pointer")
+	}
+	d.depth = 0
+	return d.value(rv.Elem())
+}
+
+// atEOF reports whether the input is fully consumed
+func (d *Decoder) atEOF() bool {
+	_, err := d.r.Peek(1)
+	return err == io.EOF
+}
+
+func (d *Decoder) syntaxError(msg string) error {
+	return &SyntaxError{Offset: d.off, Msg: msg}
+}
+
+// violation handles input breaking a rule of the strict mode, which is
+// an error unless the decoder is lenient
+func (d *Decoder) violation(offset int64, msg string) error {
+	err := &SyntaxError{Offset: offset, Msg: msg}
+	if d.mode == Strict {
+		return err
+	}
+	if d.violations != nil {
+		*d.violations = append(*d.violations, err)
+	}
+	return nil
+}
+
+// finish checks that nothing follows the value decoded
+func (d *Decoder) finish() error {
+	if d.atEOF() {
+		return nil
+	}
+	return d.violation(d.off, "trailing data after value")
+}
+
+// checkKey checks that the dictionary key at offset comes after the previous one
+func (d *Decoder) checkKey(prev, key []byte, offset int64) error {
+	if prev == nil {
+		return nil
+	}
+	switch cmp := bytes.Compare(prev, key); {
+	case cmp == 0:
+		return d.violation(offset, fmt.Sprintf("duplicate key %q", key))
+	case cmp > 0:
+		return d.violation(offset, fmt.Sprintf("key %q not sorted", key))
+	}
+	return nil
+}
+
+func (d *Decoder) readError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return d.syntaxError("unexpected end of input")
+	}
+	return err
+}
+
+func (d *Decoder) peek() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err != nil {
+		return 0, d.readError(err)
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return 0, d.readError(err)
+	}
+	d.off++
+	if d.recording > 0 {
+		d.rec = append(d.rec, c)
+	}
+	return c, nil
+}
+
+func (d *Decoder) readN(n int) ([]byte, error) {
+	var res []byte
+	if n <= stringChunkSize {
+		res = make([]byte, n)
+		read, err := io.ReadFull(d.r, res)
+		d.off += int64(read)
+		if err != nil {
+			return nil, d.readError(err)
+		}
+	} else {
+		buf := new(bytes.Buffer)
+		read, err := io.CopyN(buf, d.r, int64(n))
+		d.off += read
+		if err != nil {
+			return nil, d.readError(err)
+		}
+		res = buf.Bytes()
+	}
+	if d.recording > 0 {
+		d.rec = append(d.rec, res...)
+	}
+	return res, nil
+}
+
+// enter and leave track the nesting of lists and dictionaries
+func (d *Decoder) enter() error {
+	d.depth++
+	if d.maxDepth > 0 && d.depth > d.maxDepth {
+		return d.syntaxError("maximum nesting depth exceeded")
+	}
+	return nil
+}
+
+func (d *Decoder) leave() {
+	d.depth--
+}
+
+// capture reads the next value and returns its raw bytes
+func (d *Decoder) capture() ([]byte, error) {
+	start := len(d.rec)
+	d.recording++
+	err := d.skip()
+	d.recording--
+
+	raw := append([]byte(nil), d.rec[start:]...)
+	if d.recording == 0 {
+		d.rec = d.rec[:0]
+	}
+	return raw, err
+}
+
+func (d *Decoder) typeError(v reflect.Value, c byte, start int64) error {
+	return &UnmarshalTypeError{Value: kindName(c), Type: v.Type(), Offset: start}
+}
+
+func kindName(c byte) string {
+	switch c {
+	case 'i':
+		return "integer"
+	case 'l':
+		return "list"
+	case 'd':
+		return "dictionary"
+	}
+	return "string"
+}
+
+// value decodes the next value into v
+func (d *Decoder) value(v reflect.Value) error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	start := d.off
+
+	// a type implementing Unmarshaler gets the raw value
+	if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+		v = v.Addr()
+	}
+	if v.Type().Implements(unmarshalerType) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		raw, err := d.capture()
+		if err != nil {
+			return err
+		}
+		return v.Interface().(Unmarshaler).UnmarshalBencode(raw)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem())
+
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return d.typeError(v, c, start)
+		}
+		res, err := d.generic()
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(res))
+		return nil
+	}
+
+	switch {
+	case c == 'i':
+		return d.intValue(v)
+	case c >= '0' && c <= '9':
+		return d.stringValue(v)
+	case c == 'l':
+		return d.listValue(v)
+	case c == 'd':
+		return d.dictValue(v)
+	}
+	return d.syntaxError(fmt.Sprintf("invalid character %q", c))
+}
+
+// readInt reads the digits of an integer up to the terminator given,
+// rejecting leading zeros and negative zero
+func (d *Decoder) readInt(terminator byte) (string, error) {
+	start := d.off
+	num := make([]byte, 0, 8)
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		if c == terminator {
+			break
+		}
+		if len(num) == maxIntLength {
+			return "", &SyntaxError{Offset: start, Msg: "integer too long"}
+		}
+		num = append(num, c)
+	}
+
+	digits := num
+	if len(digits) > 0 && digits[0] == '-' {
+		digits = digits[1:]
+		if string(digits) == "0" {
+			if err := d.violation(start, "negative zero not allowed"); err != nil {
+				return "", err
+			}
+		}
+	}
+	if len(digits) == 0 {
+		return "", &SyntaxError{Offset: start, Msg: "empty integer"}
+	}
+	for i, c := range digits {
+		if c < '0' || c > '9' {
+			return "", &SyntaxError{Offset: start + int64(len(num)-len(digits)+i), Msg: "invalid integer"}
+		}
+	}
+	if len(digits) > 1 && digits[0] == '0' {
+		if err := d.violation(start, "leading zeros are not allowed"); err != nil {
+			return "", err
+		}
+	}
+	return string(num), nil
+}
+
+func (d *Decoder) readString() ([]byte, error) {
+	start := d.off
+	lenStr, err := d.readInt(':')
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(lenStr)
+	if err != nil || length < 0 {
+		return nil, &SyntaxError{Offset: start, Msg: "invalid string length"}
+	}
+	if d.maxStringLen > 0 && length > d.maxStringLen {
+		return nil, &SyntaxError{Offset: start, Msg: "string too long"}
+	}
+	return d.readN(length)
+}
+
+func (d *Decoder) intValue(v reflect.Value) error {
+	start := d.off
+	d.readByte()
+	num, err := d.readInt('e')
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(num, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			return &UnmarshalTypeError{Value: "integer " + num, Type: v.Type(), Offset: start}
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(num, 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			return &UnmarshalTypeError{Value: "integer " + num, Type: v.Type(), Offset: start}
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		if num != "0" && num != "1" {
+			return &UnmarshalTypeError{Value: "integer " + num, Type: v.Type(), Offset: start}
+		}
+		v.SetBool(num == "1")
+	default:
+		return &UnmarshalTypeError{Value: "integer", Type: v.Type(), Offset: start}
+	}
+	return nil
+}
+
+func (d *Decoder) stringValue(v reflect.Value) error {
+	start := d.off
+	s, err := d.readString()
+	if err != nil {
+		return err
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(string(s))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return d.typeError(v, '0', start)
+		}
+		v.SetBytes(s)
+	case reflect.Array:
+		if v.Type().Elem().Kind() != reflect.Uint8 || v.Len() != len(s) {
+			return d.typeError(v, '0', start)
+		}
+		reflect.Copy(v, reflect.ValueOf(s))
+	default:
+		return d.typeError(v, '0', start)
+	}
+	return nil
+}
+
+func (d *Decoder) listValue(v reflect.Value) error {
+	start := d.off
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+	default:
+		return d.typeError(v, 'l', start)
+	}
+	d.readByte()
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	i := 0
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte()
+			break
+		}
+
+		if v.Kind() == reflect.Slice {
+			if i >= v.Len() {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+			if err := d.value(v.Index(i)); err != nil {
+				return err
+			}
+		} else if i < v.Len() {
+			if err := d.value(v.Index(i)); err != nil {
+				return err
+			}
+		} else if err := d.skip(); err != nil {
+			// extra elements of arrays are dropped
+			return err
+		}
+		i++
+	}
+
+	if v.Kind() == reflect.Slice {
+		if i == 0 {
+			v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		} else {
+			v.SetLen(i)
+		}
+	}
+	return nil
+}
+
+func (d *Decoder) dictValue(v reflect.Value) error {
+	start := d.off
+	var fields map[string]field
+
+	switch v.Kind() {
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return d.typeError(v, 'd', start)
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+	case reflect.Struct:
+		fields = make(map[string]field)
+		for _, f := range structFields(v.Type()) {
+			fields[f.name] = f
+		}
+	default:
+		return d.typeError(v, 'd', start)
+	}
+	d.readByte()
+	if err := d.enter(); err != nil {
+		return err
+	}
+	defer d.leave()
+
+	var prevKey []byte
+	for {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			d.readByte()
+			return nil
+		}
+		if c < '0' || c > '9' {
+			return d.syntaxError("invalid key type")
+		}
+		keyOff := d.off
+		key, err := d.readString()
+		if err != nil {
+			return err
+		}
+		if err := d.checkKey(prevKey, key, keyOff); err != nil {
+			return err
+		}
+		prevKey = key
+
+		if v.Kind() == reflect.Map {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := d.value(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(string(key)).Convert(v.Type().Key()), elem)
+			continue
+		}
+
+		f, ok := fields[string(key)]
+		if !ok {
+			if err := d.skip(); err != nil {
+				return err
+			}
+			continue
+		}
+		fv, _ := fieldByIndex(v, f.index, true)
+		if err := d.value(fv); err != nil {
+			return err
+		}
+	}
+}
+
+// generic decodes the next value into the types used by DecodeBencode
+func (d *Decoder) generic() (interface{}, error) {
+	c, err := d.peek()
+	if err != nil {
+		return nil, err
+	}
+	start := d.off
+
+	switch {
+	case c == 'i':
+		d.readByte()
+		num, err := d.readInt('e')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return nil, &SyntaxError{Offset: start, Msg: "integer out of range"}
+		}
+		return n, nil
+
+	case c >= '0' && c <= '9':
+		s, err := d.readString()
+		if err != nil {
+			return nil, err
+		}
+		return string(s), nil
+
+	case c == 'l':
+		d.readByte()
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+
+		res := make([]interface{}, 0)
+		for {
+			c, err := d.peek()
+			if err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.readByte()
+				return res, nil
+			}
+			elem, err := d.generic()
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, elem)
+		}
+
+	case c == 'd':
+		d.readByte()
+		if err := d.enter(); err != nil {
+			return nil, err
+		}
+		defer d.leave()
+
+		res := make(map[string]interface{})
+		var prevKey []byte
+		for {
+			c, err := d.peek()
+			if err != nil {
+				return nil, err
+			}
+			if c == 'e' {
+				d.readByte()
+				return res, nil
+			}
+			if c < '0' || c > '9' {
+				return nil, d.syntaxError("invalid key type")
+			}
+			keyOff := d.off
+			key, err := d.readString()
+			if err != nil {
+				return nil, err
+			}
+			if err := d.checkKey(prevKey, key, keyOff); err != nil {
+				return nil, err
+			}
+			prevKey = key
+			elem, err := d.generic()
+			if err != nil {
+				return nil, err
+			}
+			res[string(key)] = elem
+		}
+	}
+
+	return nil, d.syntaxError(fmt.Sprintf("invalid character %q", c))
+}
+
+// skip moves past the next value, checking its syntax. Unlike generic, integers
+// of any size are accepted, as bencode doesn't limit them.
+func (d *Decoder) skip() error {
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case c == 'i':
+		d.readByte()
+		_, err := d.readInt('e')
+		return err
+
+	case c >= '0' && c <= '9':
+		_, err := d.readString()
+		return err
+
+	case c == 'l' || c == 'd':
+		isDict := c == 'd'
+		d.readByte()
+		if err := d.enter(); err != nil {
+			return err
+		}
+		defer d.leave()
+
+		var prevKey []byte
+		for {
+			c, err := d.peek()
+			if err != nil {
+				return err
+			}
+			if c == 'e' {
+				d.readByte()
+				return nil
+			}
+			if isDict {
+				if c < '0' || c > '9' {
+					return d.syntaxError("invalid key type")
+				}
+				keyOff := d.off
+				key, err := d.readString()
+				if err != nil {
+					return err
+				}
+				if err := d.checkKey(prevKey, key, keyOff); err != nil {
+					return err
+				}
+				prevKey = key
+			}
+			if err := d.skip(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return d.syntaxError(fmt.Sprintf("invalid character %q", c))
+}
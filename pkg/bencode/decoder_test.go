@@ -0,0 +1,168 @@
+package bencode
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDecoderStream(t *testing.T) {
+	d := NewDecoder(strings.NewReader("i1e4:spamd1:ai2eeXYZ"))
+
+	var n int
+	if err := d.Decode(&n); err != nil || n != 1 {
+		t.Fatalf("expected 1, got %d (%v)", n, err)
+	}
+	var s string
+	if err := d.Decode(&s); err != nil || s != "spam" {
+		t.Fatalf("expected spam, got %q (%v)", s, err)
+	}
+	var m map[string]int
+	if err := d.Decode(&m); err != nil || m["a"] != 2 {
+		t.Fatalf("unexpected dict %v (%v)", m, err)
+	}
+	if d.InputOffset() != 17 {
+		t.Fatalf("expected offset 17, got %d", d.InputOffset())
+	}
+
+	rest, _ := io.ReadAll(d.Buffered())
+	if string(rest) != "XYZ" {
+		t.Fatalf("expected the rest to be buffered, got %q", rest)
+	}
+}
+
+func TestDecoderErrorOffsets(t *testing.T) {
+	tests := []struct {
+		input  string
+		offset int64
+	}{
+		{"", 0},
+		{"l1:ai01ee", 5},
+		{"d1:ai1e", 7},
+		{"d1:ai1ei2ee", 7},
+		{"l3:abc", 6},
+		{"li1ex", 4},
+	}
+	for _, test := range tests {
+		var v interface{}
+		err := NewDecoder(strings.NewReader(test.input)).Decode(&v)
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Fatalf("expected syntax error for %q, got %v", test.input, err)
+		}
+		if syntaxErr.Offset != test.offset {
+			t.Fatalf("expected offset %d for %q, got %d", test.offset, test.input, syntaxErr.Offset)
+		}
+	}
+}
+
+func TestDecoderLimits(t *testing.T) {
+	d := NewDecoder(strings.NewReader(strings.Repeat("l", 10) + strings.Repeat("e", 10)))
+	d.SetMaxDepth(5)
+	var v interface{}
+	if err := d.Decode(&v); err == nil {
+		t.Fatalf("expected depth limit error")
+	}
+
+	// the claimed length is checked before anything is allocated
+	d = NewDecoder(strings.NewReader("999999999999:abc"))
+	d.SetMaxStringLength(1 << 20)
+	if err := d.Decode(&v); err == nil || !strings.Contains(err.Error(), "string too long") {
+		t.Fatalf("expected string length error, got %v", err)
+	}
+
+	// a length within the limit but larger than the data fails without reading forever
+	d = NewDecoder(strings.NewReader("1000000:abc"))
+	if err := d.Decode(&v); err == nil {
+		t.Fatalf("expected error for truncated string")
+	}
+
+	if err := NewDecoder(strings.NewReader("i123456789012345678901234567890123e")).Decode(&v); err == nil {
+		t.Fatalf("expected error for long integer")
+	}
+}
+
+func TestDecodeBencode(t *testing.T) {
+	res, err := DecodeBencode("d3:fool1:ai-3eee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := res.(map[string]interface{})["foo"].([]interface{})
+	if list[0] != "a" || list[1] != -3 {
+		t.Fatalf("unexpected value %v", res)
+	}
+
+	for _, input := range []string{"", "i1ex", "x"} {
+		if _, err := DecodeBencode(input); err == nil {
+			t.Fatalf("expected error for %q", input)
+		}
+	}
+}
+
+func TestDecoderModes(t *testing.T) {
+	quirks := []string{
+		"d1:bi1e1:ai2ee",
+		"d1:ai1e1:ai2ee",
+		"i03e",
+		"i-0e",
+		"02:ab",
+		"i1e\n",
+	}
+	for _, input := range quirks {
+		var v interface{}
+		if err := Unmarshal([]byte(input), &v); err == nil {
+			t.Fatalf("expected strict mode to reject %q", input)
+		}
+
+		d := NewDecoder(strings.NewReader(input))
+		d.SetMode(Lenient)
+		if err := d.Decode(&v); err != nil {
+			t.Fatalf("expected lenient mode to accept %q, got %v", input, err)
+		}
+	}
+
+	// the last value wins for duplicate keys
+	d := NewDecoder(strings.NewReader("d1:ai1e1:ai2ee"))
+	d.SetMode(Lenient)
+	var m map[string]int
+	if err := d.Decode(&m); err != nil || m["a"] != 2 {
+		t.Fatalf("unexpected value %v (%v)", m, err)
+	}
+
+	// broken syntax is an error in both modes
+	d = NewDecoder(strings.NewReader("d1:ai1e"))
+	d.SetMode(Lenient)
+	var v interface{}
+	if err := d.Decode(&v); err == nil {
+		t.Fatalf("expected error for truncated input")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	if violations := Validate([]byte("d1:ai1e1:bli2eee")); len(violations) != 0 {
+		t.Fatalf("expected no violations, got %v", violations)
+	}
+
+	violations := Validate([]byte("d1:bi01e1:al2:xyi-0eee!"))
+	expected := []int64{5, 8, 17, 22}
+	if len(violations) != len(expected) {
+		t.Fatalf("expected %d violations, got %v", len(expected), violations)
+	}
+	for i, v := range violations {
+		if v.Offset != expected[i] {
+			t.Fatalf("expected violation %d at offset %d, got %v", i, expected[i], v)
+		}
+	}
+
+	// a syntax error ends the report
+	violations = Validate([]byte("d1:bi1e1:a5:ab"))
+	if len(violations) != 2 || violations[1].Msg != "unexpected end of input" {
+		t.Fatalf("unexpected violations %v", violations)
+	}
+
+	// integers are not limited to 64 bits
+	if violations := Validate([]byte("i123456789012345678901234567890e")); len(violations) != 0 {
+		t.Fatalf("expected no violations, got %v", violations)
+	}
+}
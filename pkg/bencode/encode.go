@@ -1,14 +1,187 @@
 package bencode
 
-// For the encoding operations, the ready-made library will be used
 import (
 	"bytes"
-
-	"github.com/jackpal/bencode-go"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
 )
 
+// Marshaler is implemented by types that encode themselves to bencode
+type Marshaler interface {
+	MarshalBencode() ([]byte, error)
+}
+
+// MarshalError is returned for values that can't be represented in bencode
+type MarshalError struct {
+	Type reflect.Type
+	Msg  string
+}
+
+func (e *MarshalError) Error() string {
+	if e.Type == nil {
+		return "bencode: cannot marshal " + e.Msg
+	}
+	return "bencode: cannot marshal " + e.Type.String() + ": " + e.Msg
+}
+
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
+// Marshal returns the bencoding of v.
+//
+// Integers of all sizes and bools (as 0 or 1) are encoded as integers, strings
+// and byte slices or arrays as byte strings, slices and arrays as lists, and maps
+// with string keys as dictionaries. Structs are encoded as dictionaries, with the
+// keys taken from the `bencode:"name,omitempty"` tags or the field names.
+// Dictionary keys are always sorted. Nil pointers and interfaces in struct
+// fields are left out, since bencode has no null value.
+func Marshal(v interface{}) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := encodeValue(buf, reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func EncodeBencodeToString(data interface{}) (string, error) {
-	buf := bytes.NewBuffer([]byte{})
-	err := bencode.Marshal(buf, data)
-	return buf.String(), err
+	res, err := Marshal(data)
+	return string(res), err
+}
+
+func encodeValue(buf *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return &MarshalError{Msg: "nil value"}
+	}
+
+	if v.Type().Implements(marshalerType) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return &MarshalError{Type: v.Type(), Msg: "nil pointer"}
+		}
+		res, err := v.Interface().(Marshaler).MarshalBencode()
+		if err != nil {
+			return err
+		}
+		buf.Write(res)
+		return nil
+	}
+	if v.Kind() != reflect.Ptr && v.CanAddr() && v.Addr().Type().Implements(marshalerType) {
+		return encodeValue(buf, v.Addr())
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return &MarshalError{Type: v.Type(), Msg: "nil value"}
+		}
+		return encodeValue(buf, v.Elem())
+
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteString("i1e")
+		} else {
+			buf.WriteString("i0e")
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatInt(v.Int(), 10))
+		buf.WriteByte('e')
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		buf.WriteByte('i')
+		buf.WriteString(strconv.FormatUint(v.Uint(), 10))
+		buf.WriteByte('e')
+
+	case reflect.String:
+		encodeString(buf, v.String())
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			encodeString(buf, string(v.Bytes()))
+			return nil
+		}
+		return encodeList(buf, v)
+
+	case reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			b := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(b), v)
+			encodeString(buf, string(b))
+			return nil
+		}
+		return encodeList(buf, v)
+
+	case reflect.Map:
+		return encodeMap(buf, v)
+
+	case reflect.Struct:
+		return encodeStruct(buf, v)
+
+	default:
+		return &MarshalError{Type: v.Type(), Msg: "unsupported type"}
+	}
+
+	return nil
+}
+
+func encodeString(buf *bytes.Buffer, s string) {
+	buf.WriteString(strconv.Itoa(len(s)))
+	buf.WriteByte(':')
+	buf.WriteString(s)
+}
+
+func encodeList(buf *bytes.Buffer, v reflect.Value) error {
+	buf.WriteByte('l')
+	for i := 0; i < v.Len(); i++ {
+		if err := encodeValue(buf, v.Index(i)); err != nil {
+			return err
+		}
+	}
+	buf.WriteByte('e')
+	return nil
+}
+
+func encodeMap(buf *bytes.Buffer, v reflect.Value) error {
+	if v.Type().Key().Kind() != reflect.String {
+		return &MarshalError{Type: v.Type(), Msg: "dictionary keys must be strings"}
+	}
+
+	keys := v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].String() < keys[j].String()
+	})
+
+	buf.WriteByte('d')
+	for _, k := range keys {
+		encodeString(buf, k.String())
+		if err := encodeValue(buf, v.MapIndex(k)); err != nil {
+			return fmt.Errorf("encoding key %q: %w", k.String(), err)
+		}
+	}
+	buf.WriteByte('e')
+	return nil
+}
+
+func encodeStruct(buf *bytes.Buffer, v reflect.Value) error {
+	buf.WriteByte('d')
+	for _, f := range structFields(v.Type()) {
+		fv, ok := fieldByIndex(v, f.index, false)
+		if !ok {
+			// field of a nil embedded struct
+			continue
+		}
+		if f.omitEmpty && isEmptyValue(fv) {
+			continue
+		}
+		if (fv.Kind() == reflect.Ptr || fv.Kind() == reflect.Interface) && fv.IsNil() {
+			continue
+		}
+		encodeString(buf, f.name)
+		if err := encodeValue(buf, fv); err != nil {
+			return fmt.Errorf("encoding field %s: %w", f.name, err)
+		}
+	}
+	buf.WriteByte('e')
+	return nil
 }
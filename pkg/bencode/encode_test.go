@@ -40,3 +40,56 @@ func TestEncodeBencodeToString(t *testing.T) {
 	}
 
 }
+
+type embeddedInfo struct {
+	Name string `bencode:"name"`
+}
+
+type testStruct struct {
+	embeddedInfo
+	Length   int64    `bencode:"length"`
+	Port     uint16   `bencode:"port"`
+	Private  bool     `bencode:"private,omitempty"`
+	Comment  string   `bencode:"comment,omitempty"`
+	URLList  []string `bencode:"url-list,omitempty"`
+	Pieces   []byte   `bencode:"pieces"`
+	Ignored  int      `bencode:"-"`
+	NoTag    int
+	internal int
+}
+
+func TestMarshalStruct(t *testing.T) {
+	v := testStruct{
+		embeddedInfo: embeddedInfo{Name: "a.txt"},
+		Length:       1 << 40,
+		Port:         6881,
+		Pieces:       []byte{0x00, 0xff},
+		Ignored:      3,
+		NoTag:        7,
+	}
+	res, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys are sorted, empty omitempty fields and ignored fields are skipped
+	expected := "d5:NoTagi7e6:lengthi1099511627776e4:name5:a.txt6:pieces2:\x00\xff4:porti6881ee"
+	if string(res) != expected {
+		t.Fatalf("expected %q, got %q", expected, res)
+	}
+}
+
+func TestMarshalMapKeysSorted(t *testing.T) {
+	res, err := Marshal(map[string]int{"b": 2, "a": 1, "ab": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != "d1:ai1e2:abi3e1:bi2ee" {
+		t.Fatalf("unexpected encoding %q", res)
+	}
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	if _, err := Marshal(1.5); err == nil {
+		t.Fatalf("expected error encoding float")
+	}
+}
@@ -0,0 +1,108 @@
+package bencode
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// JSONBinaryPrefix marks the JSON strings holding base64 encoded binary data.
+// Strings that aren't valid UTF-8, or that start with the prefix themselves,
+// are written this way so that the JSON converts back to the same bencode.
+const JSONBinaryPrefix = "base64:"
+
+// JSONValue converts a value returned by DecodeBencode to one that can be
+// marshaled to JSON without losing binary strings
+func JSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		if !utf8.ValidString(v) || strings.HasPrefix(v, JSONBinaryPrefix) {
+			return JSONBinaryPrefix + base64.StdEncoding.EncodeToString([]byte(v))
+		}
+		return v
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, elem := range v {
+			res[i] = JSONValue(elem)
+		}
+		return res
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			res[key] = JSONValue(elem)
+		}
+		return res
+	}
+	return v
+}
+
+// FromJSONValue reverses JSONValue for a value unmarshaled from JSON. Numbers
+// must be integers, decoding them as json.Number keeps them exact.
+func FromJSONValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		if strings.HasPrefix(v, JSONBinaryPrefix) {
+			b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(v, JSONBinaryPrefix))
+			if err != nil {
+				return nil, fmt.Errorf("invalid binary string: %w", err)
+			}
+			return string(b), nil
+		}
+		return v, nil
+	case json.Number:
+		n, err := v.Int64()
+		if err != nil {
+			return nil, fmt.Errorf("only integers can be bencoded, got %s", v)
+		}
+		return n, nil
+	case float64:
+		if v != float64(int64(v)) {
+			return nil, fmt.Errorf("only integers can be bencoded, got %v", v)
+		}
+		return int64(v), nil
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, elem := range v {
+			var err error
+			if res[i], err = FromJSONValue(elem); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			var err error
+			if res[key], err = FromJSONValue(elem); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case nil:
+		return nil, fmt.Errorf("null can't be bencoded")
+	}
+	return nil, fmt.Errorf("%T can't be bencoded", v)
+}
+
+// JSONToBencode encodes JSON, as produced from DecodeBencodeToJSON, back to bencode
+func JSONToBencode(data []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	if d.More() {
+		return nil, fmt.Errorf("trailing data after JSON value")
+	}
+
+	value, err := FromJSONValue(v)
+	if err != nil {
+		return nil, err
+	}
+	return Marshal(value)
+}
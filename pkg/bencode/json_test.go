@@ -0,0 +1,56 @@
+package bencode
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	inputs := []string{
+		"d8:announce3:url4:infod6:lengthi10e6:pieces4:\x00\xff\x10\x80ee",
+		"l7:base64:i-3ee",
+		"d1:ai9223372036854775807e1:bi-9223372036854775808ee",
+	}
+	for _, input := range inputs {
+		jsonOutput, err := DecodeBencodeToJSON(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := JSONToBencode([]byte(jsonOutput))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(res) != input {
+			t.Fatalf("expected %q after round trip through %s, got %q", input, jsonOutput, res)
+		}
+	}
+}
+
+func TestJSONToBencodeInvalid(t *testing.T) {
+	for _, input := range []string{`1.5`, `null`, `true`, `"base64:!!"`, `1 2`, `{"a":[null]}`} {
+		if _, err := JSONToBencode([]byte(input)); err == nil {
+			t.Fatalf("expected error for %s", input)
+		}
+	}
+}
+
+func TestWriteTree(t *testing.T) {
+	decoded, err := DecodeBencode("d4:infod6:pieces40:" + strings.Repeat("\xff", 40) + "e4:listl1:a2:\x00\x01ee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := new(strings.Builder)
+	if err := WriteTree(out, decoded); err != nil {
+		t.Fatal(err)
+	}
+	expected := `dict (2 keys)
+  "info": dict (1 keys)
+    "pieces": <2 piece hashes>
+  "list": list (2 items)
+    [0]: "a"
+    [1]: <2 bytes> 0001
+`
+	if out.String() != expected {
+		t.Fatalf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
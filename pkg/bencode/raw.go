@@ -0,0 +1,20 @@
+package bencode
+
+// RawMessage is a raw bencoded value. It can be used to delay decoding part of
+// a message, or to keep the exact bytes of a value, like the info dictionary
+// the infohash is computed over.
+type RawMessage []byte
+
+// MarshalBencode returns m as the bencoding of m
+func (m RawMessage) MarshalBencode() ([]byte, error) {
+	if len(m) == 0 {
+		return nil, &MarshalError{Msg: "empty RawMessage"}
+	}
+	return m, nil
+}
+
+// UnmarshalBencode sets *m to a copy of data
+func (m *RawMessage) UnmarshalBencode(data []byte) error {
+	*m = append((*m)[:0], data...)
+	return nil
+}
@@ -0,0 +1,92 @@
+package bencode
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// binary strings longer than this are truncated in the tree
+const maxTreeBinaryLength = 32
+
+// WriteTree writes a value returned by DecodeBencode as an indented tree, one
+// entry per line. Binary strings are shown in hex, truncated if long, and the
+// piece hashes are counted instead of listed.
+func WriteTree(w io.Writer, v interface{}) error {
+	return writeTree(w, v, "", "", 0)
+}
+
+// writeTree writes v after its label, with key being the dictionary key v
+// was found under
+func writeTree(w io.Writer, v interface{}, label, key string, depth int) error {
+	prefix := strings.Repeat("  ", depth)
+	if label != "" {
+		prefix += label + ": "
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if _, err := fmt.Fprintf(w, "%sdict (%d keys)\n", prefix, len(v)); err != nil {
+			return err
+		}
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if err := writeTree(w, v[k], fmt.Sprintf("%q", k), k, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case []interface{}:
+		if _, err := fmt.Fprintf(w, "%slist (%d items)\n", prefix, len(v)); err != nil {
+			return err
+		}
+		for i, elem := range v {
+			if err := writeTree(w, elem, fmt.Sprintf("[%d]", i), "", depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	_, err := fmt.Fprintf(w, "%s%s\n", prefix, treeScalar(v, key))
+	return err
+}
+
+func treeScalar(v interface{}, key string) string {
+	s, ok := v.(string)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+
+	if key == "pieces" && len(s)%20 == 0 {
+		return fmt.Sprintf("<%d piece hashes>", len(s)/20)
+	}
+	if isText(s) {
+		return fmt.Sprintf("%q", s)
+	}
+	if len(s) > maxTreeBinaryLength {
+		return fmt.Sprintf("<%d bytes> %x...", len(s), s[:maxTreeBinaryLength])
+	}
+	return fmt.Sprintf("<%d bytes> %x", len(s), s)
+}
+
+// isText reports whether s is UTF-8 without control characters other than whitespace
+func isText(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,51 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+// Unmarshaler is implemented by types that decode themselves from bencode.
+// UnmarshalBencode receives the raw bytes of one complete value.
+type Unmarshaler interface {
+	UnmarshalBencode([]byte) error
+}
+
+// SyntaxError is returned for malformed bencode, with the byte offset of the error
+type SyntaxError struct {
+	Offset int64
+	Msg    string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("bencode: %s at offset %d", e.Msg, e.Offset)
+}
+
+// UnmarshalTypeError is returned when a value can't be stored in the Go type given
+type UnmarshalTypeError struct {
+	// Value is the bencode type found: "integer", "string", "list" or "dictionary"
+	Value  string
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("bencode: cannot unmarshal %s into Go value of type %s at offset %d", e.Value, e.Type, e.Offset)
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// Unmarshal decodes the bencoded data into the value pointed to by v, following
+// the same type mapping as Marshal. Dictionary keys without a matching struct
+// field are ignored. Decoding into an empty interface results in the same values
+// as DecodeBencode.
+func Unmarshal(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	// no string can be longer than the data itself
+	d.SetMaxStringLength(len(data))
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	return d.finish()
+}
@@ -0,0 +1,163 @@
+package bencode
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUnmarshalStruct(t *testing.T) {
+	// unknown keys are skipped
+	data := "d5:extrad1:ai1ee6:lengthi1099511627776e4:name5:a.txt6:pieces2:\x00\xff4:porti6881e7:privatei1ee"
+
+	var v testStruct
+	if err := Unmarshal([]byte(data), &v); err != nil {
+		t.Fatal(err)
+	}
+	expected := testStruct{
+		embeddedInfo: embeddedInfo{Name: "a.txt"},
+		Length:       1 << 40,
+		Port:         6881,
+		Private:      true,
+		Pieces:       []byte{0x00, 0xff},
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, v)
+	}
+}
+
+func TestUnmarshalRoundTrip(t *testing.T) {
+	in := testStruct{
+		embeddedInfo: embeddedInfo{Name: "dir"},
+		Length:       -5,
+		Port:         1,
+		Comment:      "hi",
+		URLList:      []string{"http://a", "http://b"},
+		Pieces:       []byte("abc"),
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out testStruct
+	if err := Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("expected %+v, got %+v", in, out)
+	}
+}
+
+func TestUnmarshalGeneric(t *testing.T) {
+	var v interface{}
+	if err := Unmarshal([]byte("d1:ali1e1:be1:bi0ee"), &v); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]interface{}{
+		"a": []interface{}{1, "b"},
+		"b": 0,
+	}
+	if !reflect.DeepEqual(v, expected) {
+		t.Fatalf("expected %v, got %v", expected, v)
+	}
+}
+
+func TestUnmarshalPointersAndMaps(t *testing.T) {
+	var v struct {
+		Reason *string          `bencode:"failure reason"`
+		Files  map[string]int   `bencode:"files"`
+		Hash   [2]byte          `bencode:"hash"`
+		Nested *struct{ A int } `bencode:"nested"`
+	}
+	if err := Unmarshal([]byte("d14:failure reason3:bad5:filesd1:xi1ee4:hash2:ab6:nestedd1:Ai2eee"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if v.Reason == nil || *v.Reason != "bad" {
+		t.Fatalf("pointer field not set")
+	}
+	if v.Files["x"] != 1 || v.Hash != [2]byte{'a', 'b'} || v.Nested == nil || v.Nested.A != 2 {
+		t.Fatalf("unexpected value %+v", v)
+	}
+}
+
+type upperString string
+
+func (u *upperString) UnmarshalBencode(data []byte) error {
+	var s string
+	if err := Unmarshal(data, &s); err != nil {
+		// accept integers too
+		var n int
+		if err := Unmarshal(data, &n); err != nil {
+			return err
+		}
+		*u = "INT"
+		return nil
+	}
+	*u = upperString("S:" + s)
+	return nil
+}
+
+func TestUnmarshaler(t *testing.T) {
+	var v []upperString
+	if err := Unmarshal([]byte("l1:ai3ee"), &v); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(v, []upperString{"S:a", "INT"}) {
+		t.Fatalf("unexpected value %v", v)
+	}
+}
+
+func TestUnmarshalErrors(t *testing.T) {
+	var small struct {
+		N int8 `bencode:"n"`
+	}
+	err := Unmarshal([]byte("d1:ni300ee"), &small)
+	var typeErr *UnmarshalTypeError
+	if !errors.As(err, &typeErr) || typeErr.Offset != 4 {
+		t.Fatalf("expected overflow type error at offset 4, got %v", err)
+	}
+
+	var s string
+	if err := Unmarshal([]byte("i1e"), &s); !errors.As(err, &typeErr) {
+		t.Fatalf("expected type error, got %v", err)
+	}
+
+	syntaxTests := []string{"", "i01e", "i-0e", "5:abc", "l1:a", "d1:ai1e", "i1ei2e", "die"}
+	for _, input := range syntaxTests {
+		var v interface{}
+		var syntaxErr *SyntaxError
+		if err := Unmarshal([]byte(input), &v); !errors.As(err, &syntaxErr) {
+			t.Fatalf("expected syntax error for %q, got %v", input, err)
+		}
+	}
+
+	if err := Unmarshal([]byte("i1e"), s); err == nil {
+		t.Fatalf("expected error for non-pointer")
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	var v struct {
+		Info RawMessage `bencode:"info"`
+		Name string     `bencode:"name"`
+	}
+	// the unsorted keys are kept as they are
+	d := NewDecoder(strings.NewReader("d4:infod1:zi1e1:ai2ee4:name1:xe"))
+	d.SetMode(Lenient)
+	if err := d.Decode(&v); err != nil {
+		t.Fatal(err)
+	}
+	if string(v.Info) != "d1:zi1e1:ai2ee" || v.Name != "x" {
+		t.Fatalf("unexpected value %+v", v)
+	}
+
+	// the raw bytes are written back as they are
+	res, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != "d4:infod1:zi1e1:ai2ee4:name1:xe" {
+		t.Fatalf("unexpected encoding %q", res)
+	}
+}
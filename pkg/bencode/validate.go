@@ -0,0 +1,28 @@
+package bencode
+
+import "bytes"
+
+// Validate checks that data holds exactly one value in canonical bencode. It
+// returns every rule the data breaks, in the order found. Quirks accepted by the
+// Lenient mode don't stop the check, other errors end it and are reported last.
+func Validate(data []byte) []*SyntaxError {
+	var violations []*SyntaxError
+
+	d := NewDecoder(bytes.NewReader(data))
+	d.SetMode(Lenient)
+	d.SetMaxStringLength(len(data))
+	d.violations = &violations
+
+	err := d.skip()
+	if err == nil {
+		err = d.finish()
+	}
+	if err != nil {
+		if syntaxErr, ok := err.(*SyntaxError); ok {
+			violations = append(violations, syntaxErr)
+		} else {
+			violations = append(violations, &SyntaxError{Offset: d.off, Msg: err.Error()})
+		}
+	}
+	return violations
+}
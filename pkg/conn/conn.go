@@ -3,13 +3,15 @@ package conn
 import (
 	"bufio"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
-	"strconv"
 	"sync"
+	"sync/atomic"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/ratelimit"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/util/fsm"
 )
@@ -19,6 +21,11 @@ const (
 	pipelineRequestsLimit = 5
 )
 
+var ErrPieceNotAvailable = errors.New("peer does not have the requested piece")
+var ErrChoked = errors.New("choked by peer while requests were pending")
+var ErrRequestRejected = errors.New("peer rejected block requests")
+var ErrConnClosed = errors.New("connection closed")
+
 type PeerConn struct {
 	mu   sync.Mutex
 	conn net.Conn
@@ -26,6 +33,9 @@ type PeerConn struct {
 	localPeerID string
 	remotePeer  *torrent.Peer
 	infohash    string
+	// remotePeerID is the peer id received in the handshake, the one of remotePeer
+	// is only set when known beforehand
+	remotePeerID string
 
 	torrent torrent.Torrent
 
@@ -33,15 +43,73 @@ type PeerConn struct {
 
 	hasBitfield chan struct{}
 
+	// fastEnabled is set when both sides support the Fast Extension
+	fastEnabled bool
+	noOfPieces  int
+
 	currentPiece torrent.Piece
-	storage      io.Writer
+	storage      torrent.Storage
+
+	// state shared between the event handling routine and the piece handlers
+	stateMu     sync.Mutex
+	peerChoking bool
+	remoteHave  torrent.Bitfield
+	allowedFast map[int]bool
+	suggested   []int
+	pending     map[block]bool
+	outstanding int
+	rejected    int
+	// hashes of the blocks of the current piece received so far
+	blockHashes []BlockHash
+	// the upload side: whether we choke the peer, the pieces it may request
+	// while choked and the queued requests it cancelled
+	amChoking   bool
+	grantedFast map[int]bool
+	cancelled   map[block]bool
 
 	eventQueue chan *event
 	errChan    chan error
 
+	// closing is closed by Close to stop the routines of the connection, and
+	// loopDone once the event handling routine returned
+	closing   chan struct{}
+	loopDone  chan struct{}
+	closeOnce sync.Once
+	// handlers are the piece handlers and the upload routine running, which
+	// use storage
+	handlers sync.WaitGroup
+
+	limits Limits
+	stats  TransferStats
+
+	// serve holds the pieces served to the peer, nil if nothing is served
+	serve torrent.Storage
+	// uploads queues the blocks requested by the peer
+	uploads chan block
+
 	logger log.Logger
 }
 
+// Limits are the rate limiters the payload of a connection draws from, like the
+// global, torrent and peer ones
+type Limits struct {
+	Download, Upload ratelimit.Chain
+}
+
+// Options configures a connection
+type Options struct {
+	Limits Limits
+	// Storage holds the pieces served to the peer. Nothing is served if nil.
+	Storage torrent.Storage
+}
+
+// TransferStats counts the bytes sent and received on a connection. Payload is
+// the block data of piece messages, everything else is protocol overhead.
+type TransferStats struct {
+	PayloadDown, PayloadUp   int64
+	OverheadDown, OverheadUp int64
+}
+
 type event struct {
 	name    string
 	payload []byte
@@ -60,11 +128,47 @@ const (
 )
 
 func EstablishConnection(localPeerID string, rp *torrent.Peer, t torrent.Torrent, logger log.Logger) (*PeerConn, error) {
+	return EstablishConnectionWithLimits(localPeerID, rp, t, logger, Limits{})
+}
+
+// EstablishConnectionWithLimits establishes a connection whose block data is
+// rate limited by the given limiters
+func EstablishConnectionWithLimits(localPeerID string, rp *torrent.Peer, t torrent.Torrent, logger log.Logger, limits Limits) (*PeerConn, error) {
+	return EstablishConnectionWithOptions(localPeerID, rp, t, logger, Options{Limits: limits})
+}
+
+// EstablishConnectionWithOptions establishes a connection configured by opts
+func EstablishConnectionWithOptions(localPeerID string, rp *torrent.Peer, t torrent.Torrent, logger log.Logger, opts Options) (*PeerConn, error) {
+	pc, err := newPeerConn(localPeerID, rp, t, logger, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	rpid, conn, err := pc.performHandshake()
+	if err != nil {
+		return nil, err
+	}
+	pc.remotePeerID = rpid
+	if err := pc.start(conn); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+func newPeerConn(localPeerID string, rp *torrent.Peer, t torrent.Torrent, logger log.Logger, opts Options) (*PeerConn, error) {
 	pc := &PeerConn{
 		localPeerID: localPeerID,
 		remotePeer:  rp,
 		torrent:     t,
 		logger:      logger,
+		limits:      opts.Limits,
+		serve:       opts.Storage,
+		peerChoking: true,
+		amChoking:   true,
+		allowedFast: make(map[int]bool),
+		grantedFast: make(map[int]bool),
+		pending:     make(map[block]bool),
+		cancelled:   make(map[block]bool),
 	}
 	ih, err := t.InfoHash()
 	if err != nil {
@@ -72,14 +176,26 @@ func EstablishConnection(localPeerID string, rp *torrent.Peer, t torrent.Torrent
 	}
 	pc.infohash = string(ih)
 
-	rpid, conn, err := pc.performHandshake()
+	hashes, err := t.Pieces()
 	if err != nil {
 		return nil, err
 	}
-	pc.remotePeer.PeerID = rpid
+	pc.noOfPieces = len(hashes)
+	pc.remoteHave = torrent.NewBitfield(pc.noOfPieces)
+	return pc, nil
+}
+
+// start announces our pieces once the handshake is done and starts the
+// routines of the connection
+func (pc *PeerConn) start(conn net.Conn) error {
 	pc.conn = conn
 	pc.initFSM()
 
+	if err := pc.sendAvailability(); err != nil {
+		conn.Close()
+		return err
+	}
+
 	pc.hasBitfield = make(chan struct{})
 
 	// initialize msg queue
@@ -90,88 +206,135 @@ func EstablishConnection(localPeerID string, rp *torrent.Peer, t torrent.Torrent
 	// and the select can select the error channel in the next poll
 	pc.errChan = make(chan error, 5)
 
+	pc.closing = make(chan struct{})
+	pc.loopDone = make(chan struct{})
+
 	// start listening to incoming messages
 	go pc.listen()
 
 	// start handling events
 	go pc.handleEventQueue()
 
-	return pc, nil
+	// start serving the blocks requested
+	if pc.serve != nil {
+		pc.uploads = make(chan block, maxQueuedRequests)
+		pc.handlers.Add(1)
+		go func() {
+			defer pc.handlers.Done()
+			pc.upload()
+		}()
+	}
+
+	return nil
 }
 
 // AskForPiece will initiate a peer message exchange to download the piece specified by idx.
 // Since the response messages do not identify a piece uniquely, only one piece can be downloaded at a time.
-func (pc *PeerConn) AskForPiece(idx int, writer io.Writer) error {
+// The verified piece is written to storage.
+func (pc *PeerConn) AskForPiece(idx int, storage torrent.Storage) error {
 
 	pc.logger.Debug("Started AskForPiece routine")
 
 	// wait for bitfield message
 	// this is optional in the bittorrent protocol but required in the codecrafters outline
-	<-pc.hasBitfield
+	select {
+	case <-pc.hasBitfield:
+	case <-pc.closing:
+		return ErrConnClosed
+	}
 
 	// initialize the piece storage
 	// each call to AskForPiece will renew this as expected
-	pc.storage = writer
+	pc.storage = storage
 
 	pc.logger.Debug("Passed hasBitfield barrier in AskForPiece")
 
+	if !pc.peerHas(idx) {
+		return ErrPieceNotAvailable
+	}
+
 	// add an event that sends interested message
 	// if the FSM is at a state where a new transfer can begin, the current idx will be set
 	buf := make([]byte, 4)
 	binary.BigEndian.PutUint32(buf[0:4], uint32(idx))
 
-	s := make(chan error)
-	pc.eventQueue <- &event{
+	// buffered so that the event handling routine never blocks on it once we
+	// stopped waiting
+	s := make(chan error, 1)
+	select {
+	case pc.eventQueue <- &event{
 		name:    "initiated",
 		payload: buf,
 		signal:  s,
+	}:
+	case <-pc.closing:
+		return ErrConnClosed
 	}
 
 	pc.logger.Debug("Just placed initiated event")
 
 	// Wait for download to end and receive error
-	err, ok := <-s
-	// if channel closed, piece finished downloading
-	if !ok || err == nil {
-		pc.logger.Debug("AskPiece detected closing channel with err", err)
-		return nil
-	} else {
+	select {
+	case err, ok := <-s:
+		// if channel closed or nil received, piece finished downloading
+		if !ok || err == nil {
+			pc.logger.Debug("AskPiece detected closing channel with err", err)
+			return nil
+		}
 		return err
+	case <-pc.closing:
+		return ErrConnClosed
 	}
 }
 
-func (pc *PeerConn) performHandshake() (string, net.Conn, error) {
-	msg := &PeerHandshakeMsg{
-		protocolLen: 19,
-		protocol:    "BitTorrent protocol",
-		reserved:    make([]byte, 8),
+// handshakeMsg returns our handshake
+func (pc *PeerConn) handshakeMsg() *PeerHandshakeMsg {
+	reserved := make([]byte, 8)
+	reserved[7] |= fastExtensionBit
+
+	return &PeerHandshakeMsg{
+		protocolLen: byte(len(protocolName)),
+		protocol:    protocolName,
+		reserved:    reserved,
 		infohash:    []byte(pc.infohash),
 		peerId:      pc.localPeerID, // own peer id, not peer's
 	}
+}
 
-	conn, err := net.Dial("tcp", pc.remotePeer.AddrIPV4+":"+strconv.Itoa(int(pc.remotePeer.Port)))
+func (pc *PeerConn) performHandshake() (string, net.Conn, error) {
+	msg := pc.handshakeMsg()
+
+	conn, err := net.Dial("tcp", pc.remotePeer.Addr())
 	if err != nil {
-		return "", nil, fmt.Errorf("dialing: %v", err)
+		return "", nil, &HandshakeError{fmt.Errorf("dialing: %v", err)}
 	}
 
 	n, err := conn.Write(msg.serialize())
 	if n != len(msg.serialize()) || err != nil {
-		return "", nil, fmt.Errorf("error writing msg: %v", err)
+		conn.Close()
+		return "", nil, &HandshakeError{fmt.Errorf("error writing msg: %v", err)}
 	}
 
 	respData := make([]byte, 68)
 	_, err = io.ReadFull(conn, respData)
 	if err != nil {
-		return "", nil, fmt.Errorf("reading handshake response: %v", err)
+		conn.Close()
+		return "", nil, &HandshakeError{fmt.Errorf("reading handshake response: %v", err)}
 	}
 
 	hsResp, err := deserializePeerHandshakeMsg(respData)
 	if err != nil {
-		return "", nil, err
+		conn.Close()
+		return "", nil, &HandshakeError{err}
 	}
-	if !hsResp.validate() {
-		return "", nil, fmt.Errorf("invalid handshake response")
+	// the peer id is only known beforehand from non-compact tracker responses
+	if err := hsResp.validate([]byte(pc.infohash), pc.localPeerID, pc.remotePeer.PeerID); err != nil {
+		conn.Close()
+		return "", nil, &HandshakeError{err}
 	}
+	pc.fastEnabled = hsResp.supportsFast()
+	atomic.AddInt64(&pc.stats.OverheadUp, int64(len(msg.serialize())))
+	atomic.AddInt64(&pc.stats.OverheadDown, int64(len(respData)))
 
 	return hsResp.peerId, conn, nil
 }
@@ -199,13 +362,22 @@ func (pc *PeerConn) listen() error {
 		pc.logger.Debug("just locked read")
 
 		_, err = io.ReadFull(reader, msgBuf)
+		pc.mu.Unlock()
 		if err != nil {
 			return fmt.Errorf("reading message: %v", err)
 		}
 
-		pc.mu.Unlock()
 		pc.logger.Debug("just unlocked read")
 
+		// block data is limited, the rest is overhead
+		payload := 0
+		if msgLen > 9 && peerMsgType(msgBuf[0]) == piece {
+			payload = int(msgLen) - 9
+		}
+		atomic.AddInt64(&pc.stats.PayloadDown, int64(payload))
+		atomic.AddInt64(&pc.stats.OverheadDown, int64(4+int(msgLen)-payload))
+		pc.limits.Download.WaitN(payload)
+
 		if len(msgBuf) < 100 {
 			pc.logger.Debug("read full message:", msgBuf)
 		} else {
@@ -213,9 +385,19 @@ func (pc *PeerConn) listen() error {
 		}
 
 		if len(msgBuf) > 0 {
-			pc.eventQueue <- &event{
-				name:    msgTypeToString[peerMsgType(msgBuf[0])],
+			name, ok := msgTypeToString[peerMsgType(msgBuf[0])]
+			if !ok {
+				// unknown message types are ignored instead of being fed to the FSM
+				pc.logger.Debug("Ignoring message of unknown type", msgBuf[0])
+				continue
+			}
+			select {
+			case pc.eventQueue <- &event{
+				name:    name,
 				payload: msgBuf[1:msgLen],
+			}:
+			case <-pc.closing:
+				return ErrConnClosed
 			}
 			pc.logger.Debug("just placed event in queue")
 		}
@@ -224,22 +406,47 @@ func (pc *PeerConn) listen() error {
 }
 
 func (pc *PeerConn) handleEventQueue() error {
+	defer close(pc.loopDone)
+
 	var currentsig chan error
+	// signal passes the outcome of the piece exchange to AskForPiece. Errors of
+	// this routine go through it directly, since sending them to errChan, which
+	// only this routine reads, could block it.
+	signal := func(err error) {
+		if currentsig == nil {
+			// no piece exchange is waiting for the outcome
+			return
+		}
+		// a nil error signals the end of the piece download
+		currentsig <- err
+		currentsig = nil
+	}
 	for {
 		select {
-		case e, ok := <-pc.eventQueue:
+		case <-pc.closing:
+			return nil
 
-			if !ok {
-				// closed channel, means end the handling
-				pc.logger.Debug("Event queue channel closed")
-				return nil
-			}
+		case e := <-pc.eventQueue:
 
 			pc.logger.Debug("Handler just got event with name:", e.name, "and payload len:", len(e.payload))
 
-			fsmOutMsg, ok := pc.fsm.ApplyTransition(e.name)
+			// messages outside of the FSM (choking, availability, Fast Extension)
+			// update the connection state first
+			if err := pc.handleStateMsg(e); err != nil {
+				pc.logger.Debug("Handle state message error:", err)
+				signal(err)
+			}
+
+			inMsg := e.name
+			if inMsg == "allowedFast" && pc.currentPiece != nil && pc.isAllowedFast(pc.currentPiece.Index()) {
+				// the piece waiting for an unchoke can now be requested
+				inMsg = "requestAllowed"
+			}
+
+			fsmOutMsg, ok := pc.fsm.ApplyTransition(inMsg)
 			if !ok {
-				pc.logger.Debug("Ignoring msg: %v\n", e)
+				pc.logger.Debug("Ignoring msg:", e.name)
+				continue
 			}
 
 			pc.logger.Debug("FSM out message is:", fsmOutMsg)
@@ -247,7 +454,11 @@ func (pc *PeerConn) handleEventQueue() error {
 			switch fsmOutMsg {
 			case "have_bitfield":
 				// received bitfield, block until exchange is initiated
-				pc.hasBitfield <- struct{}{}
+				select {
+				case pc.hasBitfield <- struct{}{}:
+				case <-pc.closing:
+					return nil
+				}
 
 			case "interested":
 				pc.logger.Debug("in interested case")
@@ -256,27 +467,142 @@ func (pc *PeerConn) handleEventQueue() error {
 				err := pc.produceInterested(e)
 				if err != nil {
 					pc.logger.Debug("Handle interested error: ", err)
-					pc.errChan <- err
+					signal(err)
+					break
+				}
+
+				// no need to wait for an unchoke if the peer is already unchoking us
+				// or the piece is in the allowed fast set
+				if !pc.isChoking() || pc.isAllowedFast(pc.currentPiece.Index()) {
+					if _, ok := pc.fsm.ApplyTransition("requestAllowed"); ok {
+						go pc.produceRequest(e)
+					}
 				}
 
 			case "request":
 				go pc.produceRequest(e)
 
 			case "save_piece":
-				// when needed, the signal channel that AskPiece is
-				// waiting on will be passed to the handler
-				e.signal = currentsig
-				go pc.handlePiece(e)
+				// only this routine starts handlers, so Close can wait for
+				// them once it returned
+				pc.handlers.Add(1)
+				go func() {
+					defer pc.handlers.Done()
+					pc.handlePiece(e)
+				}()
 
 			}
 
 		case err := <-pc.errChan:
 			pc.logger.Debug("Got error in handler routine:", err)
-			currentsig <- err
+			signal(err)
 		}
 	}
 }
 
+// handleStateMsg keeps track of the state that does not affect the message
+// flow of the FSM, like the pieces the peer has and whether it is choking us.
+func (pc *PeerConn) handleStateMsg(e *event) error {
+	// the messages about what we serve write to the connection, so they are
+	// handled without holding stateMu
+	switch e.name {
+	case "interested", "notInterested", "request", "cancel":
+		return pc.handleUploadMsg(e)
+	}
+
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+
+	switch e.name {
+	case "bitfield":
+		copy(pc.remoteHave, e.payload)
+
+	case "have":
+		if len(e.payload) < 4 {
+			return fmt.Errorf("invalid have message")
+		}
+		pc.remoteHave.Set(int(binary.BigEndian.Uint32(e.payload[0:4])))
+
+	case "haveAll":
+		pc.remoteHave.SetAll(pc.noOfPieces)
+
+	case "haveNone":
+		// the bitfield is initialized empty
+
+	case "choke":
+		pc.peerChoking = true
+		// without the Fast Extension, a choke discards all pending requests
+		if !pc.fastEnabled && len(pc.pending) > 0 {
+			pc.pending = make(map[block]bool)
+			return ErrChoked
+		}
+
+	case "unchoke":
+		pc.peerChoking = false
+
+	case "rejectRequest":
+		if !pc.fastEnabled {
+			return nil
+		}
+		b, err := blockFromPayload(e.payload)
+		if err != nil {
+			return err
+		}
+		// only drop the request actually rejected, the rest may still arrive
+		if !pc.pending[*b] {
+			return nil
+		}
+		delete(pc.pending, *b)
+		pc.outstanding--
+		pc.rejected++
+		if pc.outstanding == 0 {
+			return ErrRequestRejected
+		}
+
+	case "allowedFast":
+		if !pc.fastEnabled || len(e.payload) < 4 {
+			return nil
+		}
+		pc.allowedFast[int(binary.BigEndian.Uint32(e.payload[0:4]))] = true
+
+	case "suggestPiece":
+		if len(e.payload) < 4 {
+			return nil
+		}
+		pc.suggested = append(pc.suggested, int(binary.BigEndian.Uint32(e.payload[0:4])))
+	}
+
+	return nil
+}
+
+func (pc *PeerConn) peerHas(idx int) bool {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+	return pc.remoteHave.Has(idx)
+}
+
+func (pc *PeerConn) isChoking() bool {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+	return pc.peerChoking
+}
+
+func (pc *PeerConn) isAllowedFast(idx int) bool {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+	return pc.allowedFast[idx]
+}
+
+// Suggestions returns the pieces the peer suggested downloading through
+// suggest_piece messages, in the order they were received.
+func (pc *PeerConn) Suggestions() []int {
+	pc.stateMu.Lock()
+	defer pc.stateMu.Unlock()
+	res := make([]int, len(pc.suggested))
+	copy(res, pc.suggested)
+	return res
+}
+
 // initFSM initializes the Finite State Machine that will keep track
 // of the state and the response for each event according to it. This is
 // a concise way to handle all different cases of receiving events asynchronously.
@@ -286,12 +612,23 @@ func (pc *PeerConn) initFSM() {
 	m[fsm.TransitionInput{OldState: waitingForBitfield, InMsg: "bitfield"}] =
 		fsm.TransitionOutput{NewState: haveBitfield, OutMsg: "have_bitfield"}
 
+	// with the Fast Extension, have_all and have_none replace the bitfield
+	m[fsm.TransitionInput{OldState: waitingForBitfield, InMsg: "haveAll"}] =
+		fsm.TransitionOutput{NewState: haveBitfield, OutMsg: "have_bitfield"}
+
+	m[fsm.TransitionInput{OldState: waitingForBitfield, InMsg: "haveNone"}] =
+		fsm.TransitionOutput{NewState: haveBitfield, OutMsg: "have_bitfield"}
+
 	m[fsm.TransitionInput{OldState: haveBitfield, InMsg: "initiated"}] =
 		fsm.TransitionOutput{NewState: sentInterested, OutMsg: "interested"}
 
 	m[fsm.TransitionInput{OldState: sentInterested, InMsg: "unchoke"}] =
 		fsm.TransitionOutput{NewState: receivedUnchoke, OutMsg: "request"}
 
+	// internal message used when requesting does not have to wait for an unchoke
+	m[fsm.TransitionInput{OldState: sentInterested, InMsg: "requestAllowed"}] =
+		fsm.TransitionOutput{NewState: receivedUnchoke, OutMsg: "request"}
+
 	m[fsm.TransitionInput{OldState: receivedUnchoke, InMsg: "piece"}] =
 		fsm.TransitionOutput{NewState: receivingPieces, OutMsg: "save_piece"}
 
@@ -306,6 +643,14 @@ func (pc *PeerConn) write(msg *peerMessage) error {
 
 	pc.logger.Debug("received to write msg:", msg)
 
+	payload := 0
+	if msg.msgType == piece && len(msg.payload) > 8 {
+		payload = len(msg.payload) - 8
+	}
+	pc.limits.Upload.WaitN(payload)
+	atomic.AddInt64(&pc.stats.PayloadUp, int64(payload))
+	atomic.AddInt64(&pc.stats.OverheadUp, int64(len(msg.payload)+5-payload))
+
 	// will hold msg length (4), message type (1) and payload (var)
 	buf := make([]byte, len(msg.payload)+5)
 	n := 0
@@ -315,6 +660,7 @@ func (pc *PeerConn) write(msg *peerMessage) error {
 
 	pc.logger.Debug("Writing msg of len: ", len(msg.payload)+1, "and lenbuf:", lenBuf)
 	pc.mu.Lock()
+	defer pc.mu.Unlock()
 	n, err := pc.conn.Write(lenBuf)
 	if err != nil || n != 4 {
 		return fmt.Errorf("writing msg len to conn: %v", err)
@@ -339,9 +685,7 @@ func (pc *PeerConn) write(msg *peerMessage) error {
 		n += t
 	}
 
-	err = writer.Flush()
-	pc.mu.Unlock()
-	if err != nil {
+	if err := writer.Flush(); err != nil {
 		return fmt.Errorf("flushing msg to conn: %v", err)
 	}
 
@@ -350,15 +694,38 @@ func (pc *PeerConn) write(msg *peerMessage) error {
 	return nil
 }
 
+// Close closes the connection and waits for the piece handlers still running,
+// so that nothing is written to storage once it returns
 func (pc *PeerConn) Close() error {
-	close(pc.hasBitfield)
-	close(pc.eventQueue)
-	// will stop handling routine
-	close(pc.errChan)
-	// will stop listening routine
-	return pc.conn.Close()
+	var err error
+	pc.closeOnce.Do(func() {
+		// will stop the handling and listening routines
+		close(pc.closing)
+		err = pc.conn.Close()
+		<-pc.loopDone
+		pc.handlers.Wait()
+	})
+	return err
+}
+
+// sendErr passes the error of a handler to the event handling routine
+func (pc *PeerConn) sendErr(err error) {
+	select {
+	case pc.errChan <- err:
+	case <-pc.closing:
+	}
+}
+
+// Stats returns the bytes transferred on the connection so far
+func (pc *PeerConn) Stats() TransferStats {
+	return TransferStats{
+		PayloadDown:  atomic.LoadInt64(&pc.stats.PayloadDown),
+		PayloadUp:    atomic.LoadInt64(&pc.stats.PayloadUp),
+		OverheadDown: atomic.LoadInt64(&pc.stats.OverheadDown),
+		OverheadUp:   atomic.LoadInt64(&pc.stats.OverheadUp),
+	}
 }
 
 func (pc *PeerConn) RemotePeerID() string {
-	return pc.remotePeer.PeerID
+	return pc.remotePeerID
 }
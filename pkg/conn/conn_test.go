@@ -0,0 +1,62 @@
+package conn
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
+)
+
+func TestWriteErrorReleasesConn(t *testing.T) {
+	local, remote := net.Pipe()
+	remote.Close()
+	pc := &PeerConn{conn: local, logger: log.NewLogger(log.NORMAL)}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// a failed write must not keep the connection locked for the next one
+		for i := 0; i < 2; i++ {
+			if err := pc.write(newPeerMessage(interested, []byte{})); err == nil {
+				t.Error("expected an error writing to a closed connection")
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("write blocked after a failed write")
+	}
+}
+
+func TestStateErrorDoesNotBlockEventLoop(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	pc := &PeerConn{
+		conn:        local,
+		logger:      log.NewLogger(log.NORMAL),
+		pending:     make(map[block]bool),
+		allowedFast: make(map[int]bool),
+		eventQueue:  make(chan *event),
+		errChan:     make(chan error, 5),
+		closing:     make(chan struct{}),
+		loopDone:    make(chan struct{}),
+	}
+	pc.initFSM()
+	// the handlers filled the error channel while the connection broke
+	for i := 0; i < cap(pc.errChan); i++ {
+		pc.errChan <- ErrChoked
+	}
+	go pc.handleEventQueue()
+
+	// invalid have messages fail in the event handling routine itself
+	for i := 0; i < cap(pc.errChan)+2; i++ {
+		select {
+		case pc.eventQueue <- &event{name: "have"}:
+		case <-time.After(time.Second):
+			t.Fatal("event handling routine blocked on its own error channel")
+		}
+	}
+	pc.Close()
+}
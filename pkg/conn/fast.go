@@ -0,0 +1,47 @@
+package conn
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"net"
+)
+
+// fastExtensionBit is set in the last reserved byte of the handshake by peers
+// supporting the Fast Extension (BEP 6)
+const fastExtensionBit byte = 0x04
+
+// allowedFastSetSize is the number of pieces advertised in the allowed fast set
+const allowedFastSetSize = 10
+
+// AllowedFastSet computes the k pieces a peer at the given IPv4 address is allowed
+// to request while choked, using the canonical algorithm of BEP 6. Both sides of
+// a connection can compute the same set, so it is stable across reconnections.
+func AllowedFastSet(ip net.IP, infohash []byte, noOfPieces, k int) []int {
+	ip4 := ip.To4()
+	if ip4 == nil || noOfPieces <= 0 {
+		return nil
+	}
+	if k > noOfPieces {
+		k = noOfPieces
+	}
+
+	// only the /24 network of the peer is taken into account
+	x := make([]byte, 0, 4+len(infohash))
+	x = append(x, ip4[0], ip4[1], ip4[2], 0)
+	x = append(x, infohash...)
+
+	res := make([]int, 0, k)
+	seen := make(map[int]bool, k)
+	for len(res) < k {
+		sum := sha1.Sum(x)
+		x = sum[:]
+		for i := 0; i < 5 && len(res) < k; i++ {
+			idx := int(binary.BigEndian.Uint32(x[i*4:i*4+4]) % uint32(noOfPieces))
+			if !seen[idx] {
+				seen[idx] = true
+				res = append(res, idx)
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,33 @@
+package conn
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestAllowedFastSet(t *testing.T) {
+	// test vectors from BEP 6
+	infohash := bytes.Repeat([]byte{0xaa}, 20)
+	ip := net.ParseIP("80.4.4.200")
+
+	got := AllowedFastSet(ip, infohash, 1313, 7)
+	want := []int{1059, 431, 808, 1217, 287, 376, 1188}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+
+	got = AllowedFastSet(ip, infohash, 1313, 9)
+	want = append(want, 353, 508)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("expected %v, got %v", want, got)
+	}
+}
+
+func TestAllowedFastSetFewPieces(t *testing.T) {
+	got := AllowedFastSet(net.ParseIP("10.0.0.1"), bytes.Repeat([]byte{0x01}, 20), 3, allowedFastSetSize)
+	if len(got) != 3 {
+		t.Fatalf("expected the whole torrent to be allowed, got %v", got)
+	}
+}
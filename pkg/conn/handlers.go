@@ -1,6 +1,7 @@
 package conn
 
 import (
+	"crypto/sha1"
 	"encoding/binary"
 	"fmt"
 	"sync"
@@ -17,6 +18,24 @@ type block struct {
 	length int
 }
 
+// BlockHash is the hash of a block of a piece as received from the peer
+type BlockHash struct {
+	Begin, Length int
+	Hash          [sha1.Size]byte
+}
+
+// HashMismatchError is returned when a piece fails the hash check. It holds the
+// hashes of the blocks received, so that the bad ones can be told apart once
+// the piece is downloaded from someone else.
+type HashMismatchError struct {
+	Piece  int
+	Blocks []BlockHash
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("actual and expected piece hash mismatch for piece %d", e.Piece)
+}
+
 func (pc *PeerConn) produceInterested(e *event) error {
 
 	// setting current piece index
@@ -47,6 +66,13 @@ func (pc *PeerConn) produceRequest(e *event) {
 	// split piece in blocks
 	noOfBlocks := int((curPieceLen + blockSize - 1) / blockSize)
 
+	// every block is outstanding until it is either received or rejected
+	pc.stateMu.Lock()
+	pc.outstanding = noOfBlocks
+	pc.rejected = 0
+	pc.blockHashes = nil
+	pc.stateMu.Unlock()
+
 	q := make(chan struct{}, pipelineRequestsLimit)
 	errChan := make(chan error, noOfBlocks)
 	wg := new(sync.WaitGroup)
@@ -91,7 +117,7 @@ func (pc *PeerConn) produceRequest(e *event) {
 			// main error channel buffer size does not matter,
 			// even if this blocks, eventually main handling routine will
 			// consume the errors
-			pc.errChan <- err
+			pc.sendErr(err)
 		}
 	}
 }
@@ -105,6 +131,11 @@ func (pc *PeerConn) requestBlock(q <-chan struct{}, wg *sync.WaitGroup, b *block
 	binary.BigEndian.PutUint32(payload[4:8], uint32(b.begin))
 	binary.BigEndian.PutUint32(payload[8:12], uint32(b.length))
 
+	// tracked before writing, since the response may arrive before write returns
+	pc.stateMu.Lock()
+	pc.pending[*b] = true
+	pc.stateMu.Unlock()
+
 	errChan <- pc.write(newPeerMessage(request, payload))
 
 	// task done, release worker
@@ -114,37 +145,71 @@ func (pc *PeerConn) requestBlock(q <-chan struct{}, wg *sync.WaitGroup, b *block
 
 func (pc *PeerConn) handlePiece(e *event) {
 
+	if len(e.payload) < 8 {
+		pc.sendErr(fmt.Errorf("invalid piece message"))
+		return
+	}
+
 	// unmarshal payload
 	pieceIdxReceived := int(binary.BigEndian.Uint32(e.payload[0:4]))
 	if pieceIdxReceived != pc.currentPiece.Index() {
-		pc.errChan <- fmt.Errorf("piece index mismatch")
+		pc.sendErr(fmt.Errorf("piece index mismatch"))
 		return
 	}
 	begin := int(binary.BigEndian.Uint32(e.payload[4:8]))
 	blockData := e.payload[8:len(e.payload)]
 
-	// no race conditions since different locations are assumed
-	pc.currentPiece.WriteBlock(begin, blockData)
+	b := block{idx: pieceIdxReceived, begin: begin, length: len(blockData)}
 
-	// check if complete
-	if !(pc.currentPiece.IsComplete()) {
+	pc.stateMu.Lock()
+	// blocks that were not requested, or whose request was dropped, are ignored
+	if !pc.pending[b] {
+		pc.stateMu.Unlock()
+		pc.logger.Debug("Ignoring unrequested block with begin", begin)
+		return
+	}
+	delete(pc.pending, b)
+
+	if err := pc.currentPiece.WriteBlock(begin, blockData); err != nil {
+		pc.stateMu.Unlock()
+		pc.sendErr(err)
+		return
+	}
+	pc.blockHashes = append(pc.blockHashes, BlockHash{
+		Begin:  begin,
+		Length: len(blockData),
+		Hash:   sha1.Sum(blockData),
+	})
+	pc.outstanding--
+	outstanding, rejected := pc.outstanding, pc.rejected
+	pc.stateMu.Unlock()
+
+	// check if complete, only the handler of the last block gets past this point
+	if outstanding > 0 {
+		return
+	}
+	if rejected > 0 {
+		pc.sendErr(ErrRequestRejected)
 		return
 	}
 
 	hashes, err := pc.torrent.Pieces()
 	if err != nil {
-		pc.errChan <- err
+		pc.sendErr(err)
 		return
 	}
 
 	// verify integrity of the piece received
 	if !pc.currentPiece.Verify(hashes[pc.currentPiece.Index()]) {
-		pc.errChan <- fmt.Errorf("actual and expected piece hash mismatch")
+		pc.stateMu.Lock()
+		blocks := append([]BlockHash(nil), pc.blockHashes...)
+		pc.stateMu.Unlock()
+		pc.sendErr(&HashMismatchError{Piece: pc.currentPiece.Index(), Blocks: blocks})
 		return
 	}
 
 	if err := pc.currentPiece.Commit(); err != nil {
-		pc.errChan <- err
+		pc.sendErr(err)
 		return
 	}
 
@@ -152,5 +217,18 @@ func (pc *PeerConn) handlePiece(e *event) {
 	// producing request messages will set it to the new piece
 
 	// signal end of piece download
-	close(e.signal)
+	pc.sendErr(nil)
+}
+
+// blockFromPayload parses the index, begin and length fields shared by
+// request, cancel and reject_request messages.
+func blockFromPayload(payload []byte) (*block, error) {
+	if len(payload) < 12 {
+		return nil, fmt.Errorf("invalid block payload length")
+	}
+	return &block{
+		idx:    int(binary.BigEndian.Uint32(payload[0:4])),
+		begin:  int(binary.BigEndian.Uint32(payload[4:8])),
+		length: int(binary.BigEndian.Uint32(payload[8:12])),
+	}, nil
 }
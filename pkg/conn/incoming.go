@@ -0,0 +1,88 @@
+package conn
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// handshakeTimeout bounds the time a peer that connected to us takes to send
+// its handshake
+const handshakeTimeout = 10 * time.Second
+
+// Incoming is a connection accepted from a peer whose handshake was read, so
+// that it can be handed to the download of the torrent the peer asks for
+type Incoming struct {
+	conn net.Conn
+	hs   *PeerHandshakeMsg
+}
+
+// ReadHandshake reads the handshake of a peer that connected to us
+func ReadHandshake(c net.Conn) (*Incoming, error) {
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	defer c.SetReadDeadline(time.Time{})
+
+	data := make([]byte, 68)
+	if _, err := io.ReadFull(c, data); err != nil {
+		return nil, &HandshakeError{fmt.Errorf("reading handshake: %v", err)}
+	}
+	hs, err := deserializePeerHandshakeMsg(data)
+	if err != nil {
+		return nil, &HandshakeError{err}
+	}
+	return &Incoming{conn: c, hs: hs}, nil
+}
+
+// InfoHash returns the infohash of the torrent the peer asks for
+func (in *Incoming) InfoHash() []byte {
+	return in.hs.infohash
+}
+
+// Peer returns the address the peer connected from
+func (in *Incoming) Peer() *torrent.Peer {
+	addr, ok := in.conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return &torrent.Peer{}
+	}
+	return &torrent.Peer{IP: addr.IP, Port: uint16(addr.Port), PeerID: in.hs.peerId}
+}
+
+// Close closes the connection of a peer that is turned down
+func (in *Incoming) Close() error {
+	return in.conn.Close()
+}
+
+// AcceptConnection answers the handshake of a peer that connected to us for
+// the torrent and returns the established connection, which is used like the
+// ones we dial. The connection is closed if it fails.
+func AcceptConnection(localPeerID string, in *Incoming, t torrent.Torrent, logger log.Logger, opts Options) (*PeerConn, error) {
+	pc, err := newPeerConn(localPeerID, in.Peer(), t, logger, opts)
+	if err != nil {
+		in.conn.Close()
+		return nil, err
+	}
+	if err := in.hs.validate([]byte(pc.infohash), localPeerID, ""); err != nil {
+		in.conn.Close()
+		return nil, &HandshakeError{err}
+	}
+
+	msg := pc.handshakeMsg().serialize()
+	if _, err := in.conn.Write(msg); err != nil {
+		in.conn.Close()
+		return nil, &HandshakeError{fmt.Errorf("error writing msg: %v", err)}
+	}
+	pc.fastEnabled = in.hs.supportsFast()
+	pc.remotePeerID = in.hs.peerId
+	atomic.AddInt64(&pc.stats.OverheadUp, int64(len(msg)))
+	atomic.AddInt64(&pc.stats.OverheadDown, int64(len(in.hs.serialize())))
+
+	if err := pc.start(in.conn); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
@@ -0,0 +1,103 @@
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// acceptTestConn returns the connection of a peer that connected to us and
+// sent a handshake for the infohash, and the peer side of it
+func acceptTestConn(t *testing.T, infohash []byte) (*Incoming, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	hs := newTestHandshake(infohash, testRemotePeerID)
+	hs.reserved[7] |= fastExtensionBit
+	if _, err := c.Write(hs.serialize()); err != nil {
+		t.Fatal(err)
+	}
+
+	accepted, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	in, err := ReadHandshake(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return in, c
+}
+
+func TestAcceptConnection(t *testing.T) {
+	tr := newTestTorrent(t)
+	infohash, err := tr.InfoHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := torrent.NewMemoryStorage(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, c := acceptTestConn(t, infohash)
+	if !bytes.Equal(in.InfoHash(), infohash) {
+		t.Fatalf("unexpected infohash %x", in.InfoHash())
+	}
+	if p := in.Peer(); p.PeerID != testRemotePeerID || !p.IP.IsLoopback() {
+		t.Fatalf("unexpected peer %+v", p)
+	}
+
+	pc, err := AcceptConnection(testLocalPeerID, in, tr, log.NewLogger(log.NORMAL), Options{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if pc.RemotePeerID() != testRemotePeerID {
+		t.Fatalf("unexpected remote peer id %q", pc.RemotePeerID())
+	}
+
+	// the peer gets our handshake, then what we have
+	reply := make([]byte, 68)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		t.Fatal(err)
+	}
+	hs, err := deserializePeerHandshakeMsg(reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hs.infohash, infohash) || hs.peerId != testLocalPeerID || !hs.supportsFast() {
+		t.Fatalf("unexpected handshake %+v", hs)
+	}
+	if msg := readTestMsg(t, c); msg.msgType != haveNone {
+		t.Fatalf("expected have none, got %v", msg.msgType)
+	}
+}
+
+func TestAcceptConnectionOtherTorrent(t *testing.T) {
+	tr := newTestTorrent(t)
+	in, c := acceptTestConn(t, bytes.Repeat([]byte{0x02}, 20))
+
+	_, err := AcceptConnection(testLocalPeerID, in, tr, log.NewLogger(log.NORMAL), Options{})
+	var hsErr *HandshakeError
+	if !errors.As(err, &hsErr) || !errors.Is(err, ErrInfoHashMismatch) {
+		t.Fatalf("expected handshake error wrapping %v, got %v", ErrInfoHashMismatch, err)
+	}
+	// the connection is closed without answering
+	if n, err := c.Read(make([]byte, 68)); err != io.EOF {
+		t.Fatalf("expected closed connection, read %d bytes: %v", n, err)
+	}
+}
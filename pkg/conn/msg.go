@@ -14,6 +14,15 @@ const (
 	cancel
 )
 
+// Fast Extension (BEP 6) message types
+const (
+	suggestPiece peerMsgType = iota + 0x0D
+	haveAll
+	haveNone
+	rejectRequest
+	allowedFast
+)
+
 var msgTypeToString = map[peerMsgType]string{
 	choke:         "choke",
 	unchoke:       "unchoke",
@@ -24,6 +33,11 @@ var msgTypeToString = map[peerMsgType]string{
 	request:       "request",
 	piece:         "piece",
 	cancel:        "cancel",
+	suggestPiece:  "suggestPiece",
+	haveAll:       "haveAll",
+	haveNone:      "haveNone",
+	rejectRequest: "rejectRequest",
+	allowedFast:   "allowedFast",
 }
 
 type peerMessage struct {
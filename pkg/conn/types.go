@@ -2,9 +2,31 @@ package conn
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 )
 
+const protocolName = "BitTorrent protocol"
+
+var ErrInvalidProtocol = errors.New("invalid handshake protocol")
+var ErrInfoHashMismatch = errors.New("handshake infohash mismatch")
+var ErrPeerIDMismatch = errors.New("handshake peer id mismatch")
+var ErrSelfConnection = errors.New("connected to ourselves")
+
+// HandshakeError wraps the errors that prevent a handshake from completing,
+// so callers can tell peers to skip apart from other failures
+type HandshakeError struct {
+	Err error
+}
+
+func (e *HandshakeError) Error() string {
+	return "handshake: " + e.Err.Error()
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return e.Err
+}
+
 type PeerHandshakeMsg struct {
 	protocolLen byte
 	protocol    string
@@ -39,8 +61,26 @@ func deserializePeerHandshakeMsg(data []byte) (*PeerHandshakeMsg, error) {
 	}, nil
 }
 
-// validate will check against the given message structure
-func (p *PeerHandshakeMsg) validate() bool {
-	return (p.protocolLen == 19) || (p.protocol == "BitTorrent protocol") ||
-		(bytes.Compare(p.reserved, make([]byte, 8)) == 0)
+// validate will check the handshake received against the given message structure,
+// the infohash requested and, if known, the peer id expected for the peer.
+// The reserved bits only advertise extensions, so they are not checked.
+func (p *PeerHandshakeMsg) validate(infohash []byte, localPeerID, expectedPeerID string) error {
+	if p.protocolLen != byte(len(protocolName)) || p.protocol != protocolName {
+		return ErrInvalidProtocol
+	}
+	if !bytes.Equal(p.infohash, infohash) {
+		return ErrInfoHashMismatch
+	}
+	if p.peerId == localPeerID {
+		return ErrSelfConnection
+	}
+	if expectedPeerID != "" && p.peerId != expectedPeerID {
+		return ErrPeerIDMismatch
+	}
+	return nil
+}
+
+// supportsFast reports whether the peer advertised the Fast Extension
+func (p *PeerHandshakeMsg) supportsFast() bool {
+	return len(p.reserved) == 8 && p.reserved[7]&fastExtensionBit != 0
 }
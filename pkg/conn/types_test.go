@@ -0,0 +1,144 @@
+package conn
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/internal/testtorrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+const (
+	testLocalPeerID  = "-SB0100-localpeer123"
+	testRemotePeerID = "-TR2940-remotepeer12"
+)
+
+func newTestHandshake(infohash []byte, peerID string) *PeerHandshakeMsg {
+	return &PeerHandshakeMsg{
+		protocolLen: 19,
+		protocol:    protocolName,
+		reserved:    make([]byte, 8),
+		infohash:    infohash,
+		peerId:      peerID,
+	}
+}
+
+func TestHandshakeValidate(t *testing.T) {
+	infohash := bytes.Repeat([]byte{0x01}, 20)
+
+	hs := newTestHandshake(infohash, testRemotePeerID)
+	// extension bits are not a reason to reject the peer
+	hs.reserved[5] = 0x10
+	if err := hs.validate(infohash, testLocalPeerID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := hs.validate(infohash, testLocalPeerID, testRemotePeerID); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		msg            *PeerHandshakeMsg
+		expectedPeerID string
+		err            error
+	}{
+		{&PeerHandshakeMsg{protocolLen: 18, protocol: protocolName, infohash: infohash, peerId: testRemotePeerID}, "", ErrInvalidProtocol},
+		{&PeerHandshakeMsg{protocolLen: 19, protocol: "BitTorrent protocoL", infohash: infohash, peerId: testRemotePeerID}, "", ErrInvalidProtocol},
+		{newTestHandshake(bytes.Repeat([]byte{0x02}, 20), testRemotePeerID), "", ErrInfoHashMismatch},
+		{newTestHandshake(infohash, testLocalPeerID), "", ErrSelfConnection},
+		{newTestHandshake(infohash, testRemotePeerID), "-XX0001-otherpeer123", ErrPeerIDMismatch},
+	}
+	for _, c := range cases {
+		if err := c.msg.validate(infohash, testLocalPeerID, c.expectedPeerID); err != c.err {
+			t.Fatalf("expected %v, got %v", c.err, err)
+		}
+	}
+}
+
+func newTestTorrent(t *testing.T) torrent.Torrent {
+	encoded := testtorrent.Encode(t, testtorrent.Options{Name: "test", Length: 16})
+	tr, err := torrent.NewSingleTorrentFile(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+// handshakePeer accepts one connection and responds to the handshake
+// with the given infohash and peer id
+func handshakePeer(t *testing.T, infohash []byte, peerID string) *torrent.Peer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.ReadFull(c, make([]byte, 68))
+		c.Write(newTestHandshake(infohash, peerID).serialize())
+		io.ReadAll(c)
+	}()
+
+	addr := l.Addr().(*net.TCPAddr)
+	return &torrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+func TestEstablishConnectionHandshakeErrors(t *testing.T) {
+	tr := newTestTorrent(t)
+	infohash, err := tr.InfoHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger := log.NewLogger(log.NORMAL)
+
+	cases := []struct {
+		infohash []byte
+		peerID   string
+		err      error
+	}{
+		{bytes.Repeat([]byte{0x02}, 20), testRemotePeerID, ErrInfoHashMismatch},
+		{infohash, testLocalPeerID, ErrSelfConnection},
+	}
+	for _, c := range cases {
+		peer := handshakePeer(t, c.infohash, c.peerID)
+		_, err := EstablishConnection(testLocalPeerID, peer, tr, logger)
+
+		var hsErr *HandshakeError
+		if !errors.As(err, &hsErr) || !errors.Is(err, c.err) {
+			t.Fatalf("expected handshake error wrapping %v, got %v", c.err, err)
+		}
+	}
+
+	// the expected peer id comes from non-compact tracker responses
+	peer := handshakePeer(t, infohash, testRemotePeerID)
+	peer.PeerID = "-XX0001-otherpeer123"
+	if _, err := EstablishConnection(testLocalPeerID, peer, tr, logger); !errors.Is(err, ErrPeerIDMismatch) {
+		t.Fatalf("expected peer id mismatch, got %v", err)
+	}
+}
+
+func TestEstablishConnectionByName(t *testing.T) {
+	tr := newTestTorrent(t)
+	infohash, err := tr.InfoHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := handshakePeer(t, infohash, testRemotePeerID)
+	named := &torrent.Peer{Host: "localhost", Port: peer.Port}
+
+	pc, err := EstablishConnection(testLocalPeerID, named, tr, log.NewLogger(log.NORMAL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	if ip := pc.RemoteIP(); ip == nil || !ip.IsLoopback() {
+		t.Fatalf("expected the resolved loopback address, got %v", ip)
+	}
+}
@@ -0,0 +1,223 @@
+package conn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/util"
+)
+
+const (
+	// maxQueuedRequests is the number of requests of the peer queued at once,
+	// the ones over it are dropped
+	maxQueuedRequests = 64
+	// maxRequestLength is the largest block served
+	maxRequestLength = 128 * 1024
+)
+
+// sendAvailability tells the peer which pieces we have right after the
+// handshake. With the Fast Extension the peer is also told which pieces it
+// may request while we choke it.
+func (pc *PeerConn) sendAvailability() error {
+	have := torrent.NewBitfield(pc.noOfPieces)
+	count := 0
+	if pc.serve != nil {
+		for i := 0; i < pc.noOfPieces; i++ {
+			if pc.serve.Completion(i) {
+				have.Set(i)
+				count++
+			}
+		}
+	}
+
+	var msg *peerMessage
+	switch {
+	case pc.fastEnabled && count == 0:
+		msg = newPeerMessage(haveNone, []byte{})
+	case pc.fastEnabled && count == pc.noOfPieces:
+		msg = newPeerMessage(haveAll, []byte{})
+	case count > 0:
+		msg = newPeerMessage(bitfield, have)
+	default:
+		// the bitfield is optional without pieces
+		return nil
+	}
+	if err := pc.write(msg); err != nil {
+		return err
+	}
+	if !pc.fastEnabled || count == 0 {
+		return nil
+	}
+
+	// the allowed fast set only holds pieces we have, since the peer could
+	// not get the others from us anyway
+	for _, idx := range AllowedFastSet(pc.RemoteIP(), []byte(pc.infohash), pc.noOfPieces, allowedFastSetSize) {
+		if !have.Has(idx) {
+			continue
+		}
+		payload := make([]byte, 4)
+		binary.BigEndian.PutUint32(payload, uint32(idx))
+		if err := pc.write(newPeerMessage(allowedFast, payload)); err != nil {
+			return err
+		}
+		pc.stateMu.Lock()
+		pc.grantedFast[idx] = true
+		pc.stateMu.Unlock()
+	}
+	return nil
+}
+
+// RemoteIP returns the IP address of the peer, the one connected to for peers
+// given by name
+func (pc *PeerConn) RemoteIP() net.IP {
+	if pc.remotePeer != nil && pc.remotePeer.IP != nil {
+		return pc.remotePeer.IP
+	}
+	if addr, ok := pc.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// handleUploadMsg handles the messages of the peer about the pieces we serve.
+// Interested peers are unchoked, requests are queued for the upload routine.
+func (pc *PeerConn) handleUploadMsg(e *event) error {
+	switch e.name {
+	case "interested":
+		if pc.serve == nil {
+			return nil
+		}
+		pc.stateMu.Lock()
+		choking := pc.amChoking
+		pc.amChoking = false
+		pc.stateMu.Unlock()
+		if choking {
+			return pc.write(newPeerMessage(unchoke, []byte{}))
+		}
+
+	case "notInterested":
+		pc.stateMu.Lock()
+		choking := pc.amChoking
+		pc.amChoking = true
+		pc.stateMu.Unlock()
+		if !choking {
+			return pc.write(newPeerMessage(choke, []byte{}))
+		}
+
+	case "request":
+		b, err := blockFromPayload(e.payload)
+		if err != nil {
+			return err
+		}
+		if !pc.canServe(*b) {
+			return pc.reject(*b)
+		}
+		select {
+		case pc.uploads <- *b:
+		default:
+			// too many requests queued
+			return pc.reject(*b)
+		}
+
+	case "cancel":
+		b, err := blockFromPayload(e.payload)
+		if err != nil {
+			return err
+		}
+		pc.stateMu.Lock()
+		// cancels of blocks already sent are never cleared, so they are bounded
+		// like the queue
+		if len(pc.cancelled) < maxQueuedRequests {
+			pc.cancelled[*b] = true
+		}
+		pc.stateMu.Unlock()
+	}
+	return nil
+}
+
+// canServe reports whether a block requested by the peer is served: the peer
+// must be unchoked or the piece in its allowed fast set, and the piece must be
+// complete in storage
+func (pc *PeerConn) canServe(b block) bool {
+	if pc.serve == nil || b.idx < 0 || b.idx >= pc.noOfPieces || b.length <= 0 || b.length > maxRequestLength {
+		return false
+	}
+	pieceLen, err := pc.torrent.PieceLength()
+	if err != nil {
+		return false
+	}
+	tLen, err := pc.torrent.Length()
+	if err != nil {
+		return false
+	}
+	if b.begin < 0 || b.begin+b.length > util.GetLengthForIdx(tLen, pieceLen, b.idx) {
+		return false
+	}
+
+	pc.stateMu.Lock()
+	allowed := !pc.amChoking || pc.grantedFast[b.idx]
+	pc.stateMu.Unlock()
+	return allowed && pc.serve.Completion(b.idx)
+}
+
+// reject tells the peer that a request won't be served. Without the Fast
+// Extension requests are silently dropped.
+func (pc *PeerConn) reject(b block) error {
+	if !pc.fastEnabled {
+		return nil
+	}
+	return pc.write(newPeerMessage(rejectRequest, blockPayload(b)))
+}
+
+// upload sends the blocks requested by the peer until the connection closes
+func (pc *PeerConn) upload() {
+	for {
+		var b block
+		select {
+		case <-pc.closing:
+			return
+		case b = <-pc.uploads:
+		}
+
+		pc.stateMu.Lock()
+		cancelled := pc.cancelled[b]
+		delete(pc.cancelled, b)
+		pc.stateMu.Unlock()
+		if cancelled {
+			continue
+		}
+
+		if err := pc.sendBlock(b); err != nil {
+			pc.logger.Debug("Serving block of piece", b.idx, ":", err)
+			return
+		}
+	}
+}
+
+// sendBlock sends a block requested by the peer, or rejects the request if the
+// peer was choked since
+func (pc *PeerConn) sendBlock(b block) error {
+	if !pc.canServe(b) {
+		return pc.reject(b)
+	}
+	payload := make([]byte, 8+b.length)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(b.idx))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(b.begin))
+	if _, err := pc.serve.ReadAt(payload[8:], b.idx, int64(b.begin)); err != nil {
+		pc.reject(b)
+		return fmt.Errorf("reading block: %v", err)
+	}
+	return pc.write(newPeerMessage(piece, payload))
+}
+
+// blockPayload returns the index, begin and length fields of a block, as sent
+// in request, cancel and reject_request messages
+func blockPayload(b block) []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(b.idx))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(b.begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(b.length))
+	return payload
+}
@@ -0,0 +1,153 @@
+package conn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/internal/testtorrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// fastPeer accepts one connection and completes the handshake advertising the
+// Fast Extension, handing the connection over to the test
+func fastPeer(t *testing.T, infohash []byte) (*torrent.Peer, <-chan net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conns := make(chan net.Conn, 1)
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.ReadFull(c, make([]byte, 68))
+		hs := newTestHandshake(infohash, testRemotePeerID)
+		hs.reserved[7] |= fastExtensionBit
+		c.Write(hs.serialize())
+		conns <- c
+	}()
+	addr := l.Addr().(*net.TCPAddr)
+	return &torrent.Peer{IP: addr.IP, Port: uint16(addr.Port)}, conns
+}
+
+// readTestMsg reads the next message sent over c, skipping keep-alives
+func readTestMsg(t *testing.T, c net.Conn) *peerMessage {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	lenBuf := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(c, lenBuf); err != nil {
+			t.Fatal(err)
+		}
+		if binary.BigEndian.Uint32(lenBuf) > 0 {
+			break
+		}
+	}
+	buf := make([]byte, binary.BigEndian.Uint32(lenBuf))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	return newPeerMessage(peerMsgType(buf[0]), buf[1:])
+}
+
+func writeTestMsg(t *testing.T, c net.Conn, msgType peerMsgType, payload []byte) {
+	buf := make([]byte, 5+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(1+len(payload)))
+	buf[4] = byte(msgType)
+	copy(buf[5:], payload)
+	if _, err := c.Write(buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServePieces(t *testing.T) {
+	data := testtorrent.Data(40 * testtorrent.PieceLength)
+	tr, err := torrent.NewSingleTorrentFile(bytes.NewReader(testtorrent.Encode(t, testtorrent.Options{Data: data})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	infohash, _ := tr.InfoHash()
+	storage, err := torrent.NewMemoryStorage(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, conns := fastPeer(t, infohash)
+	allowed := AllowedFastSet(peer.IP, infohash, 40, allowedFastSetSize)
+	// all pieces but one of the allowed fast set are complete, and one outside
+	missing, choked := allowed[0], -1
+	inSet := make(map[int]bool)
+	for _, idx := range allowed {
+		inSet[idx] = true
+	}
+	for i := 0; i < 40; i++ {
+		if i == missing {
+			continue
+		}
+		if choked < 0 && !inSet[i] {
+			choked = i
+		}
+		storage.WriteAt(data[i*16:(i+1)*16], i, 0)
+		storage.MarkComplete(i)
+	}
+
+	pc, err := EstablishConnectionWithOptions(testLocalPeerID, peer, tr, log.NewLogger(log.NORMAL), Options{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	c := <-conns
+	defer c.Close()
+
+	// the pieces we have, then the allowed fast set we have
+	if msg := readTestMsg(t, c); msg.msgType != bitfield || torrent.Bitfield(msg.payload).Has(missing) || !torrent.Bitfield(msg.payload).Has(choked) {
+		t.Fatalf("expected a bitfield without piece %d, got %v", missing, msg)
+	}
+	for _, idx := range allowed[1:] {
+		msg := readTestMsg(t, c)
+		if msg.msgType != allowedFast || int(binary.BigEndian.Uint32(msg.payload)) != idx {
+			t.Fatalf("expected piece %d to be allowed fast, got %v", idx, msg)
+		}
+	}
+
+	expectBlock := func(b block) {
+		t.Helper()
+		writeTestMsg(t, c, request, blockPayload(b))
+		msg := readTestMsg(t, c)
+		if msg.msgType != piece || !bytes.Equal(msg.payload[:8], blockPayload(b)[:8]) {
+			t.Fatalf("expected block %+v, got %v", b, msg)
+		}
+		start := b.idx*16 + b.begin
+		if !bytes.Equal(msg.payload[8:], data[start:start+b.length]) {
+			t.Fatalf("unexpected data for block %+v", b)
+		}
+	}
+	expectReject := func(b block) {
+		t.Helper()
+		writeTestMsg(t, c, request, blockPayload(b))
+		if msg := readTestMsg(t, c); msg.msgType != rejectRequest || !bytes.Equal(msg.payload, blockPayload(b)) {
+			t.Fatalf("expected block %+v to be rejected, got %v", b, msg)
+		}
+	}
+
+	// while choked only the allowed fast set is served
+	expectBlock(block{idx: allowed[1], begin: 4, length: 8})
+	expectReject(block{idx: choked, begin: 0, length: 16})
+
+	// interested peers are unchoked
+	writeTestMsg(t, c, interested, nil)
+	if msg := readTestMsg(t, c); msg.msgType != unchoke {
+		t.Fatalf("expected unchoke, got %v", msg)
+	}
+	expectBlock(block{idx: choked, begin: 0, length: 16})
+	// pieces we don't have and blocks out of the piece are rejected
+	expectReject(block{idx: missing, begin: 0, length: 16})
+	expectReject(block{idx: choked, begin: 8, length: 16})
+}
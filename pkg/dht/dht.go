@@ -0,0 +1,530 @@
+// Package dht finds the peers of torrents through the mainline DHT (BEP 5),
+// without a tracker. Nodes talk KRPC, bencoded messages over UDP, and each of
+// them keeps the peers of the torrents whose infohash is close to its id.
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+const (
+	queryTimeout = 2 * time.Second
+	// alpha is the number of queries a lookup has in flight at once
+	alpha = 3
+	// tokens given in get_peers responses are accepted until the secret they
+	// were made with was rotated twice
+	tokenRotation = 5 * time.Minute
+	// peers announced to us are dropped once they stop announcing
+	peerTTL = 30 * time.Minute
+	// limits of the peers kept for other nodes
+	maxTorrents       = 1000
+	maxPeersInTorrent = 100
+)
+
+// DefaultBootstrap are well known nodes asked first by a node that knows no
+// other one
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var ErrClosed = errors.New("dht is closed")
+var ErrNoNodes = errors.New("no dht node answered")
+var errTimeout = errors.New("dht query timed out")
+
+// Options configures a DHT node
+type Options struct {
+	// Addr is the UDP address the node listens on, a random port if empty
+	Addr string
+	// Bootstrap are the addresses of the nodes asked while the routing table
+	// is nearly empty, DefaultBootstrap if nil
+	Bootstrap []string
+}
+
+// DHT is a node of the DHT, shared by the downloads looking up peers. It
+// answers the queries of other nodes as long as it is open.
+type DHT struct {
+	conn      *net.UDPConn
+	id        nodeID
+	table     *table
+	bootstrap []string
+
+	mu      sync.Mutex
+	pending map[string]*pendingQuery
+	nextTx  uint16
+	// peers announced to us by infohash, with the time they expire
+	peers map[string]map[string]time.Time
+	// secrets the tokens are made with
+	secret, prevSecret []byte
+	rotated            time.Time
+
+	done chan struct{}
+}
+
+// pendingQuery waits for the response of a node to a query
+type pendingQuery struct {
+	addr *net.UDPAddr
+	resp chan *msg
+}
+
+func New(opts Options) (*DHT, error) {
+	if opts.Bootstrap == nil {
+		opts.Bootstrap = DefaultBootstrap
+	}
+	addr, err := net.ResolveUDPAddr("udp4", opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	id := randomID()
+	d := &DHT{
+		conn:      conn,
+		id:        id,
+		table:     newTable(id),
+		bootstrap: opts.Bootstrap,
+		pending:   make(map[string]*pendingQuery),
+		peers:     make(map[string]map[string]time.Time),
+		done:      make(chan struct{}),
+	}
+	d.secret = newSecret()
+	d.prevSecret = d.secret
+	d.rotated = time.Now()
+	go d.serve()
+	return d, nil
+}
+
+func newSecret() []byte {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return b
+}
+
+// Addr returns the address the node listens on
+func (d *DHT) Addr() net.Addr {
+	return d.conn.LocalAddr()
+}
+
+// Nodes returns the number of nodes in the routing table
+func (d *DHT) Nodes() int {
+	return d.table.len()
+}
+
+// Close stops the node, failing the lookups in progress
+func (d *DHT) Close() error {
+	err := d.conn.Close()
+	<-d.done
+	return err
+}
+
+// AddNode pings the node at addr, which is added to the routing table if it
+// answers
+func (d *DHT) AddNode(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return err
+	}
+	_, err = d.query(udpAddr, "ping", &args{})
+	return err
+}
+
+// serve reads the packets of other nodes until the node is closed
+func (d *DHT) serve() {
+	defer close(d.done)
+	buf := make([]byte, 4*maxPacketSize)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		m, err := decodeMsg(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch m.Y {
+		case "q":
+			d.handleQuery(m, addr)
+		case "r", "e":
+			d.deliver(m, addr)
+		}
+	}
+}
+
+func (d *DHT) send(addr *net.UDPAddr, m *msg) error {
+	data, err := bencode.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = d.conn.WriteToUDP(data, addr)
+	return err
+}
+
+func (d *DHT) sendError(tx string, addr *net.UDPAddr, code int, text string) {
+	d.send(addr, &msg{T: tx, Y: "e", E: []interface{}{code, text}})
+}
+
+// deliver hands a response to the query waiting for it, responses from
+// another address than the one queried are dropped
+func (d *DHT) deliver(m *msg, addr *net.UDPAddr) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	q, ok := d.pending[m.T]
+	if !ok || !equalAddr(q.addr, addr) {
+		return
+	}
+	delete(d.pending, m.T)
+	q.resp <- m
+}
+
+// query sends a query to the node at addr and waits for its response. Nodes
+// that answer are added to the routing table.
+func (d *DHT) query(addr *net.UDPAddr, q string, a *args) (*reply, error) {
+	a.ID = string(d.id[:])
+
+	d.mu.Lock()
+	d.nextTx++
+	tx := string([]byte{byte(d.nextTx >> 8), byte(d.nextTx)})
+	pq := &pendingQuery{addr: addr, resp: make(chan *msg, 1)}
+	d.pending[tx] = pq
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		if d.pending[tx] == pq {
+			delete(d.pending, tx)
+		}
+		d.mu.Unlock()
+	}()
+
+	if err := d.send(addr, &msg{T: tx, Y: "q", Q: q, A: a}); err != nil {
+		return nil, err
+	}
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+
+	select {
+	case m := <-pq.resp:
+		if m.Y == "e" {
+			return nil, newKRPCError(m.E)
+		}
+		if m.R == nil {
+			return nil, fmt.Errorf("%s response without values", q)
+		}
+		id, ok := idFromString(m.R.ID)
+		if !ok {
+			return nil, fmt.Errorf("%s response with invalid node id", q)
+		}
+		d.table.seen(id, addr, time.Now())
+		return m.R, nil
+	case <-timer.C:
+		d.table.failed(addr)
+		return nil, errTimeout
+	case <-d.done:
+		return nil, ErrClosed
+	}
+}
+
+// handleQuery answers the query of another node, which is added to the
+// routing table
+func (d *DHT) handleQuery(m *msg, addr *net.UDPAddr) {
+	if m.A == nil {
+		d.sendError(m.T, addr, errProtocol, "missing arguments")
+		return
+	}
+	id, ok := idFromString(m.A.ID)
+	if !ok {
+		d.sendError(m.T, addr, errProtocol, "invalid node id")
+		return
+	}
+
+	r := &reply{ID: string(d.id[:])}
+	switch m.Q {
+	case "ping":
+	case "find_node":
+		target, ok := idFromString(m.A.Target)
+		if !ok {
+			d.sendError(m.T, addr, errProtocol, "invalid target")
+			return
+		}
+		r.Nodes = encodeNodes(d.table.closest(target, bucketSize))
+	case "get_peers":
+		target, ok := idFromString(m.A.InfoHash)
+		if !ok {
+			d.sendError(m.T, addr, errProtocol, "invalid info_hash")
+			return
+		}
+		r.Token = d.token(addr.IP)
+		// the nodes closer to the infohash are given along with the peers,
+		// so that lookups go on to the nodes they announce to
+		r.Values = d.storedPeers(m.A.InfoHash)
+		r.Nodes = encodeNodes(d.table.closest(target, bucketSize))
+	case "announce_peer":
+		if _, ok := idFromString(m.A.InfoHash); !ok {
+			d.sendError(m.T, addr, errProtocol, "invalid info_hash")
+			return
+		}
+		if !d.validToken(m.A.Token, addr.IP) {
+			d.sendError(m.T, addr, errProtocol, "bad token")
+			return
+		}
+		port := m.A.Port
+		if m.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			d.sendError(m.T, addr, errProtocol, "invalid port")
+			return
+		}
+		d.store(m.A.InfoHash, addr.IP, port)
+	default:
+		d.sendError(m.T, addr, errMethodUnknown, "method unknown")
+		return
+	}
+	d.table.seen(id, addr, time.Now())
+	d.send(addr, &msg{T: m.T, Y: "r", R: r})
+}
+
+// token returns the token a node at ip has to send back to announce a peer
+func (d *DHT) token(ip net.IP) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotateSecret()
+	return makeToken(d.secret, ip)
+}
+
+// validToken reports whether the token was given to a node at ip recently
+func (d *DHT) validToken(token string, ip net.IP) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rotateSecret()
+	return token == makeToken(d.secret, ip) || token == makeToken(d.prevSecret, ip)
+}
+
+// rotateSecret replaces the secret of the tokens every tokenRotation. It is
+// called with d.mu held.
+func (d *DHT) rotateSecret() {
+	if time.Since(d.rotated) < tokenRotation {
+		return
+	}
+	d.prevSecret = d.secret
+	d.secret = newSecret()
+	d.rotated = time.Now()
+}
+
+func makeToken(secret []byte, ip net.IP) string {
+	h := sha1.New()
+	h.Write(secret)
+	h.Write(ip.To16())
+	return string(h.Sum(nil)[:8])
+}
+
+// store keeps a peer announced to us for the torrent
+func (d *DHT) store(infohash string, ip net.IP, port int) {
+	addr, ok := compactAddr(ip, port)
+	if !ok {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	peers, ok := d.peers[infohash]
+	if !ok {
+		if len(d.peers) >= maxTorrents {
+			return
+		}
+		peers = make(map[string]time.Time)
+		d.peers[infohash] = peers
+	}
+	if _, ok := peers[string(addr)]; ok || len(peers) < maxPeersInTorrent {
+		peers[string(addr)] = time.Now().Add(peerTTL)
+	}
+}
+
+// storedPeers returns the peers announced to us for the torrent in compact
+// form, dropping the expired ones
+func (d *DHT) storedPeers(infohash string) []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	var values []string
+	for addr, expires := range d.peers[infohash] {
+		if now.After(expires) {
+			delete(d.peers[infohash], addr)
+			continue
+		}
+		values = append(values, addr)
+	}
+	if len(d.peers[infohash]) == 0 {
+		delete(d.peers, infohash)
+	}
+	return values
+}
+
+// GetPeers looks up the peers of the torrent on the nodes closest to its
+// infohash
+func (d *DHT) GetPeers(infohash []byte) ([]*torrent.Peer, error) {
+	peers, _, err := d.lookup(infohash)
+	return peers, err
+}
+
+// Announce looks up the peers of the torrent like GetPeers, and tells the
+// closest nodes that answered that we download it and accept connections on
+// port
+func (d *DHT) Announce(infohash []byte, port int) ([]*torrent.Peer, error) {
+	peers, closest, err := d.lookup(infohash)
+	if err != nil {
+		return peers, err
+	}
+	var wg sync.WaitGroup
+	for _, c := range closest {
+		if c.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(c *candidate) {
+			defer wg.Done()
+			d.query(c.n.addr, "announce_peer", &args{
+				InfoHash: string(infohash),
+				Port:     port,
+				Token:    c.token,
+			})
+		}(c)
+	}
+	wg.Wait()
+	return peers, nil
+}
+
+// candidate is a node asked, or to be asked, during a lookup
+type candidate struct {
+	n                 *node
+	queried, answered bool
+	token             string
+}
+
+// lookup asks the nodes closest to the infohash for its peers, getting closer
+// with the nodes they return until the bucketSize closest nodes that answer
+// were all asked. It returns the peers found and the closest nodes that
+// answered, with their tokens.
+func (d *DHT) lookup(infohash []byte) ([]*torrent.Peer, []*candidate, error) {
+	target, ok := idFromString(string(infohash))
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid infohash length %d", len(infohash))
+	}
+
+	var cands []*candidate
+	known := make(map[string]bool)
+	add := func(n *node) {
+		if n.id == d.id || known[n.addr.String()] {
+			return
+		}
+		known[n.addr.String()] = true
+		cands = append(cands, &candidate{n: n})
+	}
+	for _, n := range d.table.closest(target, bucketSize) {
+		add(n)
+	}
+	// bootstrap nodes have no id until they answer, so they are asked first
+	if len(cands) < bucketSize {
+		for _, a := range d.bootstrap {
+			if addr, err := net.ResolveUDPAddr("udp4", a); err == nil {
+				add(&node{addr: addr})
+			}
+		}
+	}
+
+	// the peers announced to us count as well
+	var peers []*torrent.Peer
+	seen := make(map[string]bool)
+	for _, p := range decodePeers(d.storedPeers(string(infohash))) {
+		seen[p.Addr()] = true
+		peers = append(peers, p)
+	}
+	type result struct {
+		c   *candidate
+		r   *reply
+		err error
+	}
+	results := make(chan result, alpha)
+	for {
+		sortCandidates(cands, target)
+		var next []*candidate
+		live := 0
+		for _, c := range cands {
+			if c.queried && !c.answered {
+				continue
+			}
+			if live == bucketSize {
+				break
+			}
+			live++
+			if !c.queried && len(next) < alpha {
+				next = append(next, c)
+			}
+		}
+		if len(next) == 0 {
+			break
+		}
+
+		for _, c := range next {
+			c.queried = true
+			go func(c *candidate) {
+				r, err := d.query(c.n.addr, "get_peers", &args{InfoHash: string(infohash)})
+				results <- result{c, r, err}
+			}(c)
+		}
+		for range next {
+			res := <-results
+			if res.err == ErrClosed {
+				return nil, nil, ErrClosed
+			}
+			if res.err != nil {
+				continue
+			}
+			res.c.answered = true
+			res.c.token = res.r.Token
+			res.c.n.id, _ = idFromString(res.r.ID)
+			if nodes, err := decodeNodes(res.r.Nodes); err == nil {
+				for _, n := range nodes {
+					add(n)
+				}
+			}
+			for _, p := range decodePeers(res.r.Values) {
+				if !seen[p.Addr()] {
+					seen[p.Addr()] = true
+					peers = append(peers, p)
+				}
+			}
+		}
+	}
+
+	var closest []*candidate
+	for _, c := range cands {
+		if c.answered && len(closest) < bucketSize {
+			closest = append(closest, c)
+		}
+	}
+	if len(closest) == 0 {
+		return peers, nil, ErrNoNodes
+	}
+	return peers, closest, nil
+}
+
+func sortCandidates(cands []*candidate, target nodeID) {
+	sort.SliceStable(cands, func(i, j int) bool {
+		return closer(target, cands[i].n.id, cands[j].n.id)
+	})
+}
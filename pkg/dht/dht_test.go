@@ -0,0 +1,107 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// newTestNodes returns n nodes on the loopback interface that joined the DHT
+// through the first one
+func newTestNodes(t *testing.T, n int) []*DHT {
+	var nodes []*DHT
+	for i := 0; i < n; i++ {
+		var bootstrap []string
+		if i > 0 {
+			bootstrap = []string{nodes[0].Addr().String()}
+		}
+		d, err := New(Options{Addr: "127.0.0.1:0", Bootstrap: append([]string{}, bootstrap...)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { d.Close() })
+		if i > 0 {
+			if err := d.AddNode(nodes[0].Addr().String()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		nodes = append(nodes, d)
+	}
+	return nodes
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := newTestNodes(t, 12)
+	infohash := bytes.Repeat([]byte{0xab}, 20)
+
+	// a node without peers for the torrent finds none, and announces itself
+	peers, err := nodes[3].Announce(infohash, 51413)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 0 {
+		t.Fatalf("found %d peers before any announce", len(peers))
+	}
+
+	peers, err = nodes[9].GetPeers(infohash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || !peers[0].IP.IsLoopback() || peers[0].Port != 51413 {
+		t.Fatalf("unexpected peers %v", peers)
+	}
+	// the nodes asked during the lookup are known afterwards
+	if nodes[9].Nodes() < 2 {
+		t.Errorf("only %d nodes in the routing table", nodes[9].Nodes())
+	}
+}
+
+func TestGetPeersWithoutNodes(t *testing.T) {
+	d, err := New(Options{Addr: "127.0.0.1:0", Bootstrap: []string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if _, err := d.GetPeers(bytes.Repeat([]byte{0xab}, 20)); err != ErrNoNodes {
+		t.Fatalf("expected ErrNoNodes, got %v", err)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	nodes := newTestNodes(t, 2)
+	addr := nodes[0].Addr().(*net.UDPAddr)
+	infohash := string(bytes.Repeat([]byte{0xab}, 20))
+
+	cases := []struct {
+		q    string
+		a    *args
+		code int
+	}{
+		{"vote", &args{}, errMethodUnknown},
+		{"announce_peer", &args{InfoHash: infohash, Port: 1, Token: "stale"}, errProtocol},
+		{"get_peers", &args{InfoHash: "short"}, errProtocol},
+	}
+	for _, c := range cases {
+		_, err := nodes[1].query(addr, c.q, c.a)
+		if kerr, ok := err.(*krpcError); !ok || kerr.code != c.code {
+			t.Errorf("%s: expected error %d, got %v", c.q, c.code, err)
+		}
+	}
+
+	// the token of a get_peers response lets the node announce
+	r, err := nodes[1].query(addr, "get_peers", &args{InfoHash: infohash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nodes[1].query(addr, "announce_peer", &args{InfoHash: infohash, ImpliedPort: 1, Token: r.Token}); err != nil {
+		t.Fatal(err)
+	}
+	r, err = nodes[1].query(addr, "get_peers", &args{InfoHash: infohash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	peers := decodePeers(r.Values)
+	if len(peers) != 1 || int(peers[0].Port) != nodes[1].Addr().(*net.UDPAddr).Port {
+		t.Fatalf("implied port not stored: %v", peers)
+	}
+}
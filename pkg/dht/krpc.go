@@ -0,0 +1,164 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+const (
+	// KRPC messages fit in a single UDP packet
+	maxPacketSize = 1500
+	maxMsgDepth   = 4
+
+	// compact node entries are the node id followed by a compact IPv4 address
+	compactNodeLen = idLen + compactAddrLen
+	compactAddrLen = net.IPv4len + 2
+)
+
+// KRPC error codes
+const (
+	errGeneric       = 201
+	errProtocol      = 203
+	errMethodUnknown = 204
+)
+
+// msg is a KRPC message: a query, a response or an error
+type msg struct {
+	T string `bencode:"t"`
+	Y string `bencode:"y"`
+	Q string `bencode:"q,omitempty"`
+	A *args  `bencode:"a,omitempty"`
+	R *reply `bencode:"r,omitempty"`
+	// E is the error code and message of errors
+	E []interface{} `bencode:"e,omitempty"`
+}
+
+// args are the arguments of the queries
+type args struct {
+	ID       string `bencode:"id"`
+	Target   string `bencode:"target,omitempty"`
+	InfoHash string `bencode:"info_hash,omitempty"`
+	Port     int    `bencode:"port,omitempty"`
+	Token    string `bencode:"token,omitempty"`
+	// ImpliedPort tells to use the source port of the packet instead of Port
+	ImpliedPort int `bencode:"implied_port,omitempty"`
+}
+
+// reply holds the values of the responses
+type reply struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+}
+
+// decodeMsg decodes a packet. Nodes don't always follow the canonical
+// encoding, so their quirks are accepted.
+func decodeMsg(data []byte) (*msg, error) {
+	d := bencode.NewDecoder(bytes.NewReader(data))
+	d.SetMode(bencode.Lenient)
+	d.SetMaxDepth(maxMsgDepth)
+	d.SetMaxStringLength(maxPacketSize)
+	var m msg
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// krpcError is an error message received from a node
+type krpcError struct {
+	code int
+	msg  string
+}
+
+func (e *krpcError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.code, e.msg)
+}
+
+func newKRPCError(e []interface{}) error {
+	res := &krpcError{code: errGeneric, msg: "unknown error"}
+	if len(e) > 0 {
+		if code, ok := e[0].(int); ok {
+			res.code = code
+		}
+	}
+	if len(e) > 1 {
+		if s, ok := e[1].(string); ok {
+			res.msg = s
+		}
+	}
+	return res
+}
+
+// compactAddr encodes an IPv4 address and port in 6 bytes, returning false
+// for IPv6 addresses
+func compactAddr(ip net.IP, port int) ([]byte, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, false
+	}
+	b := make([]byte, compactAddrLen)
+	copy(b, ip4)
+	binary.BigEndian.PutUint16(b[net.IPv4len:], uint16(port))
+	return b, true
+}
+
+func parseCompactAddr(b []byte) *net.UDPAddr {
+	ip := make(net.IP, net.IPv4len)
+	copy(ip, b)
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(b[net.IPv4len:]))}
+}
+
+// encodeNodes encodes nodes in compact form, leaving out the IPv6 ones
+func encodeNodes(nodes []*node) string {
+	var buf bytes.Buffer
+	for _, n := range nodes {
+		addr, ok := compactAddr(n.addr.IP, n.addr.Port)
+		if !ok {
+			continue
+		}
+		buf.Write(n.id[:])
+		buf.Write(addr)
+	}
+	return buf.String()
+}
+
+// decodeNodes parses compact node entries
+func decodeNodes(s string) ([]*node, error) {
+	if len(s)%compactNodeLen != 0 {
+		return nil, fmt.Errorf("invalid nodes field")
+	}
+	nodes := make([]*node, 0, len(s)/compactNodeLen)
+	for i := 0; i < len(s); i += compactNodeLen {
+		n := &node{addr: parseCompactAddr([]byte(s[i+idLen : i+compactNodeLen]))}
+		copy(n.id[:], s[i:i+idLen])
+		if n.addr.Port == 0 {
+			continue
+		}
+		nodes = append(nodes, n)
+	}
+	return nodes, nil
+}
+
+// decodePeers parses the compact peer entries of a get_peers response,
+// skipping malformed ones
+func decodePeers(values []string) []*torrent.Peer {
+	var peers []*torrent.Peer
+	for _, v := range values {
+		if len(v) != compactAddrLen {
+			continue
+		}
+		addr := parseCompactAddr([]byte(v))
+		if addr.Port == 0 {
+			continue
+		}
+		peers = append(peers, &torrent.Peer{IP: addr.IP, Port: uint16(addr.Port)})
+	}
+	return peers
+}
@@ -0,0 +1,177 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	idLen = 20
+	// bucketSize is the number of nodes of a bucket, and of the nodes closest
+	// to a target a lookup asks
+	bucketSize = 8
+	// nodes failing this many queries in a row are replaced by new ones
+	maxFailures = 2
+)
+
+// nodeID identifies a node, and the torrents by their infohash, in the same
+// 160 bit space
+type nodeID [idLen]byte
+
+func randomID() nodeID {
+	var id nodeID
+	rand.Read(id[:])
+	return id
+}
+
+// closer reports whether a is closer to target than b by the XOR metric
+func closer(target, a, b nodeID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// commonPrefix returns the number of leading bits a and b share
+func commonPrefix(a, b nodeID) int {
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			continue
+		}
+		n := i * 8
+		for x&0x80 == 0 {
+			x <<= 1
+			n++
+		}
+		return n
+	}
+	return idLen * 8
+}
+
+// node is a DHT node known to the routing table
+type node struct {
+	id       nodeID
+	addr     *net.UDPAddr
+	lastSeen time.Time
+	failures int
+}
+
+// table is the routing table of a node. Nodes are kept in buckets by the
+// number of leading bits their id shares with ours, bucketSize per bucket, so
+// that we know more nodes close to us than far away.
+type table struct {
+	mu      sync.Mutex
+	self    nodeID
+	buckets [idLen*8 + 1][]*node
+}
+
+func newTable(self nodeID) *table {
+	return &table{self: self}
+}
+
+// seen records a node that answered us or sent us a query. A full bucket only
+// takes it in place of a node that stopped answering.
+func (t *table) seen(id nodeID, addr *net.UDPAddr, now time.Time) {
+	if id == t.self {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b := &t.buckets[commonPrefix(t.self, id)]
+	for i, n := range *b {
+		if n.id == id {
+			n.addr = addr
+			n.lastSeen = now
+			n.failures = 0
+			// the bucket is kept from the least to the most recently seen
+			*b = append(append((*b)[:i:i], (*b)[i+1:]...), n)
+			return
+		}
+	}
+	n := &node{id: id, addr: addr, lastSeen: now}
+	if len(*b) < bucketSize {
+		*b = append(*b, n)
+		return
+	}
+	for i, old := range *b {
+		if old.failures >= maxFailures {
+			*b = append(append((*b)[:i:i], (*b)[i+1:]...), n)
+			return
+		}
+	}
+}
+
+// failed records a query to the node that went unanswered
+func (t *table) failed(addr *net.UDPAddr) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, b := range t.buckets {
+		for _, n := range b {
+			if equalAddr(n.addr, addr) {
+				n.failures++
+				return
+			}
+		}
+	}
+}
+
+// closest returns up to k nodes closest to target, leaving out the ones that
+// stopped answering
+func (t *table) closest(target nodeID, k int) []*node {
+	t.mu.Lock()
+	var nodes []*node
+	for _, b := range t.buckets {
+		for _, n := range b {
+			if n.failures < maxFailures {
+				c := *n
+				nodes = append(nodes, &c)
+			}
+		}
+	}
+	t.mu.Unlock()
+	sortByDistance(nodes, target)
+	if len(nodes) > k {
+		nodes = nodes[:k]
+	}
+	return nodes
+}
+
+// len returns the number of nodes in the table
+func (t *table) len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, b := range t.buckets {
+		n += len(b)
+	}
+	return n
+}
+
+func sortByDistance(nodes []*node, target nodeID) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].id, nodes[j].id)
+	})
+}
+
+func idFromString(s string) (nodeID, bool) {
+	var id nodeID
+	if len(s) != idLen {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
+
+// equalAddr reports whether two UDP addresses are the same
+func equalAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && bytes.Equal(a.IP.To16(), b.IP.To16())
+}
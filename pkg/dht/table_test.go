@@ -0,0 +1,60 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func testID(first byte) nodeID {
+	var id nodeID
+	id[0] = first
+	return id
+}
+
+func testAddr(port int) *net.UDPAddr {
+	return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+}
+
+func TestTableClosest(t *testing.T) {
+	tb := newTable(testID(0))
+	for i := 1; i <= 5; i++ {
+		tb.seen(testID(byte(i)<<4), testAddr(i), time.Now())
+	}
+	closest := tb.closest(testID(0x31), 3)
+	want := []byte{0x30, 0x20, 0x10}
+	if len(closest) != len(want) {
+		t.Fatalf("got %d nodes", len(closest))
+	}
+	for i, n := range closest {
+		if n.id[0] != want[i] {
+			t.Fatalf("node %d is %x, want %x", i, n.id[0], want[i])
+		}
+	}
+}
+
+func TestTableFullBucket(t *testing.T) {
+	tb := newTable(testID(0))
+	// the nodes all share no prefix with ours and land in the same bucket
+	for i := 0; i < bucketSize; i++ {
+		id := testID(0x80)
+		id[1] = byte(i)
+		tb.seen(id, testAddr(i+1), time.Now())
+	}
+	extra := testID(0x80)
+	extra[1] = 0xff
+	tb.seen(extra, testAddr(100), time.Now())
+	if tb.len() != bucketSize {
+		t.Fatalf("full bucket grew to %d nodes", tb.len())
+	}
+
+	// a node that stopped answering makes room for a new one
+	for i := 0; i < maxFailures; i++ {
+		tb.failed(testAddr(1))
+	}
+	tb.seen(extra, testAddr(100), time.Now())
+	closest := tb.closest(extra, 1)
+	if tb.len() != bucketSize || closest[0].id != extra {
+		t.Fatalf("new node not added in place of the failing one")
+	}
+}
@@ -0,0 +1,408 @@
+// Package httpserve serves the files of torrents over HTTP while they download
+package httpserve
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/services"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+const (
+	defaultIdleTimeout = 5 * time.Minute
+	playlistName       = "playlist.m3u"
+)
+
+// ErrServerClosed is returned for requests arriving while the server closes
+var ErrServerClosed = errors.New("server is closed")
+
+// Options configures the server
+type Options struct {
+	// Storage opens the storage of a torrent when it is first requested, file
+	// storage in the working directory if nil. The pieces found in storage are
+	// hashed, so that the ones already downloaded are served right away.
+	Storage torrent.StorageOpener
+	// Service downloads the torrents, the default one if nil
+	Service services.DownloadFileService
+	// IdleTimeout is how long a torrent is kept downloading without requests
+	IdleTimeout time.Duration
+}
+
+// Server serves the files of torrents over HTTP, with range requests. A torrent
+// starts downloading with the first request for one of its files, and the
+// requests move the pieces they read to the front of the download. Torrents
+// without requests for IdleTimeout are stopped and their storage closed.
+//
+// Routes:
+//
+//	/                          JSON list of the torrents and their files
+//	/<infohash>/               JSON list of the files of a torrent
+//	/<infohash>/files/<index>  contents of a file, counting from 1
+//	/<infohash>/playlist.m3u   M3U playlist of the files of a torrent
+type Server struct {
+	opts Options
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	torrents map[string]*servedTorrent
+	order    []string
+	closed   bool
+
+	stop chan struct{}
+	// now is replaced in tests to control eviction
+	now func() time.Time
+}
+
+// servedTorrent is a torrent of the server, downloading while it is requested
+type servedTorrent struct {
+	torrent torrent.Torrent
+	name    string
+	files   []torrent.File
+
+	storage  torrent.Storage
+	download *services.Download
+	// requests in flight and the time the last one ended
+	active   int
+	lastUsed time.Time
+	// opening is set while the storage is opened and checked, and stopping
+	// while the download evicted stops and its storage closes. The torrent
+	// isn't activated meanwhile.
+	opening, stopping bool
+}
+
+type fileInfo struct {
+	Index  int    `json:"index"`
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+	URL    string `json:"url"`
+}
+
+type torrentInfo struct {
+	InfoHash string     `json:"infohash"`
+	Name     string     `json:"name"`
+	Files    []fileInfo `json:"files"`
+}
+
+func New(opts Options) *Server {
+	if opts.Storage == nil {
+		opts.Storage = torrent.FileStorageOpener(".")
+	}
+	if opts.Service == nil {
+		opts.Service = services.NewDownloadFileService()
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = defaultIdleTimeout
+	}
+	s := &Server{
+		opts:     opts,
+		torrents: make(map[string]*servedTorrent),
+		stop:     make(chan struct{}),
+		now:      time.Now,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	go s.evictLoop()
+	return s
+}
+
+// Add adds a torrent to the server and returns the hex infohash it is served under
+func (s *Server) Add(t torrent.Torrent) (string, error) {
+	hash, err := t.InfoHash()
+	if err != nil {
+		return "", err
+	}
+	name, err := t.Name()
+	if err != nil {
+		return "", err
+	}
+	files, err := t.Files()
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(hash)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.torrents[id]; !ok {
+		s.torrents[id] = &servedTorrent{torrent: t, name: name, files: files}
+		s.order = append(s.order, id)
+	}
+	return id, nil
+}
+
+// Close stops the downloads and closes the storage of all the torrents
+func (s *Server) Close() error {
+	close(s.stop)
+	s.mu.Lock()
+	s.closed = true
+	var torrents, stopped []*servedTorrent
+	for _, st := range s.torrents {
+		if st.stopping || st.storage == nil {
+			continue
+		}
+		torrents = append(torrents, st)
+		stopped = append(stopped, st.detach())
+	}
+	s.mu.Unlock()
+
+	var firstErr error
+	for i, st := range torrents {
+		if err := s.deactivate(st, stopped[i]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	// torrents being evicted or opened are waited for as well
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, st := range s.torrents {
+		for st.opening || st.stopping {
+			s.cond.Wait()
+		}
+	}
+	return firstErr
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/" {
+		s.serveIndex(w, r)
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 3)
+	s.mu.Lock()
+	st, ok := s.torrents[strings.ToLower(parts[0])]
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	id := strings.ToLower(parts[0])
+
+	switch {
+	case len(parts) == 1:
+		http.Redirect(w, r, "/"+id+"/", http.StatusMovedPermanently)
+	case parts[1] == "":
+		writeJSON(w, s.info(r, id, st))
+	case parts[1] == playlistName && len(parts) == 2:
+		s.servePlaylist(w, r, id, st)
+	case parts[1] == "files" && len(parts) == 3:
+		idx, err := strconv.Atoi(parts[2])
+		if err != nil || idx < 1 || idx > len(st.files) {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveFile(w, r, st, idx-1)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) serveIndex(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	list := make([]torrentInfo, 0, len(s.order))
+	for _, id := range s.order {
+		list = append(list, s.info(r, id, s.torrents[id]))
+	}
+	s.mu.Unlock()
+	writeJSON(w, list)
+}
+
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request, id string, st *servedTorrent) {
+	info := s.info(r, id, st)
+	w.Header().Set("Content-Type", "audio/x-mpegurl")
+	fmt.Fprintln(w, "#EXTM3U")
+	for _, f := range info.Files {
+		fmt.Fprintf(w, "#EXTINF:-1,%s\n%s\n", f.Path, f.URL)
+	}
+}
+
+// serveFile serves the file through a reader of the download, so that range
+// requests read the pieces they need first
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request, st *servedTorrent, idx int) {
+	s.mu.Lock()
+	d, err := s.activate(st)
+	if err == nil {
+		st.active++
+	}
+	s.mu.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		s.mu.Lock()
+		st.active--
+		st.lastUsed = s.now()
+		s.mu.Unlock()
+	}()
+
+	reader, err := d.NewReader(idx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	defer reader.Close()
+
+	f := st.files[idx]
+	http.ServeContent(w, r, f.Path[len(f.Path)-1], time.Time{}, reader)
+}
+
+// activate starts downloading the torrent, unless it is downloading already.
+// Downloads that failed are started again. It is called with s.mu held, which
+// is released while waiting for the torrent to stop or its storage to open.
+func (s *Server) activate(st *servedTorrent) (*services.Download, error) {
+	// a second storage and download are never opened on the same files
+	for st.opening || st.stopping {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil, ErrServerClosed
+	}
+	if st.download != nil {
+		select {
+		case <-st.download.Done():
+			if st.download.Wait() == nil {
+				return st.download, nil
+			}
+		default:
+			return st.download, nil
+		}
+	}
+
+	if st.storage == nil {
+		st.opening = true
+		s.mu.Unlock()
+		storage, err := s.open(st.torrent)
+		s.mu.Lock()
+		st.opening = false
+		s.cond.Broadcast()
+		if err != nil {
+			return nil, err
+		}
+		if s.closed {
+			storage.Close()
+			return nil, ErrServerClosed
+		}
+		st.storage = storage
+	}
+	d, err := s.opts.Service.StartDownload(st.torrent, st.storage)
+	if err != nil {
+		return nil, err
+	}
+	st.download = d
+	st.lastUsed = s.now()
+	return d, nil
+}
+
+// open opens the storage of the torrent and marks the pieces already in it
+// complete
+func (s *Server) open(t torrent.Torrent) (torrent.Storage, error) {
+	storage, err := s.opts.Storage(t)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := torrent.VerifyStorage(t, storage); err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return storage, nil
+}
+
+// detach moves the download and storage of the torrent to a copy of it, to be
+// deactivated without holding the lock of the server, and marks the torrent
+// stopping until then. It is called with s.mu held.
+func (st *servedTorrent) detach() *servedTorrent {
+	detached := &servedTorrent{storage: st.storage, download: st.download}
+	st.storage = nil
+	st.download = nil
+	st.stopping = true
+	return detached
+}
+
+// deactivate deactivates the download and storage detached from st, which can
+// be activated again afterwards
+func (s *Server) deactivate(st, detached *servedTorrent) error {
+	err := detached.deactivate()
+	s.mu.Lock()
+	st.stopping = false
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	return err
+}
+
+// deactivate stops the download of the torrent and closes its storage
+func (st *servedTorrent) deactivate() error {
+	if st.download != nil {
+		st.download.Stop()
+	}
+	if st.storage == nil {
+		return nil
+	}
+	return st.storage.Close()
+}
+
+// evictLoop deactivates the torrents without requests for the idle timeout
+func (s *Server) evictLoop() {
+	ticker := time.NewTicker(s.opts.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.evictIdle()
+		}
+	}
+}
+
+func (s *Server) evictIdle() {
+	s.mu.Lock()
+	var idle, detached []*servedTorrent
+	for _, st := range s.torrents {
+		if st.storage == nil || st.active > 0 || st.stopping {
+			continue
+		}
+		if s.now().Sub(st.lastUsed) >= s.opts.IdleTimeout {
+			idle = append(idle, st)
+			detached = append(detached, st.detach())
+		}
+	}
+	s.mu.Unlock()
+
+	for i, st := range idle {
+		s.deactivate(st, detached[i])
+	}
+}
+
+func (s *Server) info(r *http.Request, id string, st *servedTorrent) torrentInfo {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	info := torrentInfo{InfoHash: id, Name: st.name, Files: make([]fileInfo, len(st.files))}
+	for i, f := range st.files {
+		info.Files[i] = fileInfo{
+			Index:  i + 1,
+			Path:   path.Join(f.Path...),
+			Length: f.Length,
+			URL:    fmt.Sprintf("%s://%s/%s/files/%d", scheme, r.Host, id, i+1),
+		}
+	}
+	return info
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
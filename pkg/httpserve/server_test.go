@@ -0,0 +1,275 @@
+package httpserve
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/internal/testtorrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// newTestServer serves a torrent with two files of 40 and 60 bytes, whose
+// storage is opened with all the data already downloaded
+func newTestServer(t *testing.T) (*Server, string, []byte, *httptest.Server) {
+	data := testtorrent.Data(100)
+	encoded := testtorrent.Encode(t, testtorrent.Options{
+		Files: []testtorrent.File{{Path: []string{"a.bin"}, Length: 40}, {Path: []string{"video.mkv"}, Length: 60}},
+		Data:  data,
+	})
+	tr, err := torrent.NewSingleTorrentFile(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opener := func(t torrent.Torrent) (torrent.Storage, error) {
+		storage, err := torrent.NewMemoryStorage(t)
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i*16 < len(data); i++ {
+			end := (i + 1) * 16
+			if end > len(data) {
+				end = len(data)
+			}
+			storage.WriteAt(data[i*16:end], i, 0)
+			storage.MarkComplete(i)
+		}
+		return storage, nil
+	}
+	s := New(Options{Storage: opener, IdleTimeout: time.Hour})
+	id, err := s.Add(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	t.Cleanup(func() {
+		srv.Close()
+		s.Close()
+	})
+	return s, id, data, srv
+}
+
+func TestServeListing(t *testing.T) {
+	_, id, _, srv := newTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list []torrentInfo
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].InfoHash != id || list[0].Name != "dataset" {
+		t.Fatalf("unexpected listing: %+v", list)
+	}
+	files := list[0].Files
+	if len(files) != 2 || files[1].Path != "dataset/video.mkv" || files[1].Length != 60 {
+		t.Fatalf("unexpected files: %+v", files)
+	}
+	if files[1].URL != srv.URL+"/"+id+"/files/2" {
+		t.Fatalf("unexpected file URL: %s", files[1].URL)
+	}
+
+	resp, err = http.Get(srv.URL + "/" + id + "/playlist.m3u")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	playlist, _ := io.ReadAll(resp.Body)
+	if !strings.HasPrefix(string(playlist), "#EXTM3U\n") || !strings.Contains(string(playlist), files[0].URL+"\n") {
+		t.Fatalf("unexpected playlist: %s", playlist)
+	}
+
+	resp, err = http.Get(srv.URL + "/0000/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown torrent, got %d", resp.StatusCode)
+	}
+}
+
+func TestServeFileRange(t *testing.T) {
+	_, id, data, srv := newTestServer(t)
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/"+id+"/files/2", nil)
+	req.Header.Set("Range", "bytes=10-29")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("expected 206, got %d", resp.StatusCode)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(body, data[50:70]) {
+		t.Fatalf("unexpected range content: %v", body)
+	}
+
+	resp, err = http.Get(srv.URL + "/" + id + "/files/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ = io.ReadAll(resp.Body)
+	if !bytes.Equal(body, data[:40]) {
+		t.Fatalf("unexpected file content: %v", body)
+	}
+}
+
+func TestServeEvictIdle(t *testing.T) {
+	s, id, _, srv := newTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/" + id + "/files/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	st := s.torrents[id]
+	s.evictIdle()
+	if st.storage == nil {
+		t.Fatal("torrent evicted before the idle timeout")
+	}
+
+	s.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	s.evictIdle()
+	if st.storage != nil || st.download != nil {
+		t.Fatal("idle torrent not evicted")
+	}
+}
+
+// slowCloseStorage holds Close until released, recording the storages open
+type slowCloseStorage struct {
+	torrent.Storage
+	release chan struct{}
+	open    *int32
+	mu      *sync.Mutex
+}
+
+func (sc *slowCloseStorage) Close() error {
+	<-sc.release
+	sc.mu.Lock()
+	*sc.open--
+	sc.mu.Unlock()
+	return sc.Storage.Close()
+}
+
+func TestServeWaitsForEviction(t *testing.T) {
+	s, id, data, srv := newTestServer(t)
+	opener := s.opts.Storage
+	var mu sync.Mutex
+	var open, maxOpen int32
+	release := make(chan struct{})
+	s.opts.Storage = func(tr torrent.Torrent) (torrent.Storage, error) {
+		storage, err := opener(tr)
+		mu.Lock()
+		open++
+		if open > maxOpen {
+			maxOpen = open
+		}
+		mu.Unlock()
+		return &slowCloseStorage{Storage: storage, release: release, open: &open, mu: &mu}, err
+	}
+	get := func() []byte {
+		resp, err := http.Get(srv.URL + "/" + id + "/files/1")
+		if err != nil {
+			t.Error(err)
+			return nil
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return body
+	}
+	get()
+
+	// the storage of the evicted torrent takes a while to close
+	s.mu.Lock()
+	s.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	s.mu.Unlock()
+	evicted := make(chan struct{})
+	go func() {
+		s.evictIdle()
+		close(evicted)
+	}()
+	st := s.torrents[id]
+	for {
+		s.mu.Lock()
+		stopping := st.stopping
+		s.mu.Unlock()
+		if stopping {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// a request meanwhile waits for it instead of opening the files again
+	body := make(chan []byte)
+	go func() { body <- get() }()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	<-evicted
+	if got := <-body; !bytes.Equal(got, data[:40]) {
+		t.Fatalf("unexpected file content: %v", got)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if maxOpen > 1 {
+		t.Fatal("storage opened again while the evicted one was closing")
+	}
+}
+
+func TestServeExistingFiles(t *testing.T) {
+	data := testtorrent.Data(100)
+	encoded := testtorrent.Encode(t, testtorrent.Options{
+		Announce: "http://127.0.0.1:1/announce",
+		Files:    []testtorrent.File{{Path: []string{"a.bin"}, Length: 40}, {Path: []string{"b.bin"}, Length: 60}},
+		Data:     data,
+	})
+	tr, err := torrent.NewSingleTorrentFile(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the files were downloaded before, the tracker is gone
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "dataset"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "dataset", "a.bin"), data[:40], 0644)
+	os.WriteFile(filepath.Join(dir, "dataset", "b.bin"), data[40:], 0644)
+
+	s := New(Options{Storage: torrent.FileStorageOpener(dir), IdleTimeout: time.Hour})
+	id, err := s.Add(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s)
+	defer func() {
+		srv.Close()
+		s.Close()
+	}()
+
+	resp, err := http.Get(srv.URL + "/" + id + "/files/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(body, data[40:]) {
+		t.Fatalf("unexpected file content: %v", body)
+	}
+}
@@ -0,0 +1,120 @@
+// Package testtorrent builds the torrent files used by the tests of the other
+// packages. It only depends on bencode so that the tests of package torrent
+// can use it too.
+package testtorrent
+
+import (
+	"crypto/sha1"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+)
+
+// Announce is the default announce URL, where no tracker listens
+const Announce = "http://127.0.0.1:1/announce"
+
+// PieceLength is the default piece length
+const PieceLength = 16
+
+// File is a file of a multi file torrent
+type File struct {
+	Path   []string
+	Length int
+}
+
+// Options describe a test torrent. Only the fields set are used, the others
+// get a default.
+type Options struct {
+	// Name defaults to "dataset"
+	Name     string
+	Announce string
+	URLList  string
+	// PieceLength defaults to 16 bytes
+	PieceLength int
+	// Files makes a multi file torrent, a single file one is made otherwise
+	Files []File
+	// Length of a single file torrent, the length of Data when not set
+	Length int
+	// Data is hashed into the pieces, which get fake hashes without it
+	Data []byte
+	// Private sets the private flag of the info dictionary
+	Private bool
+}
+
+// Data returns n bytes of test data, where each byte is its offset
+func Data(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	return data
+}
+
+// Encode returns the bencoded torrent file described by opts
+func Encode(t testing.TB, opts Options) []byte {
+	if opts.Name == "" {
+		opts.Name = "dataset"
+	}
+	if opts.Announce == "" {
+		opts.Announce = Announce
+	}
+	if opts.PieceLength == 0 {
+		opts.PieceLength = PieceLength
+	}
+
+	info := map[string]interface{}{
+		"name":         opts.Name,
+		"piece length": opts.PieceLength,
+	}
+	length := opts.Length
+	if len(opts.Files) > 0 {
+		length = 0
+		var files []interface{}
+		for _, f := range opts.Files {
+			files = append(files, map[string]interface{}{"length": f.Length, "path": f.Path})
+			length += f.Length
+		}
+		info["files"] = files
+	} else {
+		if length == 0 {
+			length = len(opts.Data)
+		}
+		info["length"] = length
+	}
+	info["pieces"] = pieces(opts.Data, length, opts.PieceLength)
+	if opts.Private {
+		info["private"] = 1
+	}
+
+	file := map[string]interface{}{
+		"announce": opts.Announce,
+		"info":     info,
+	}
+	if opts.URLList != "" {
+		file["url-list"] = opts.URLList
+	}
+	encoded, err := bencode.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encoded
+}
+
+// pieces returns the hashes of the pieces of data, or fake ones for length
+// bytes if there is no data
+func pieces(data []byte, length, pieceLength int) string {
+	if data == nil {
+		return strings.Repeat("x", (length+pieceLength-1)/pieceLength*20)
+	}
+	var hashes []byte
+	for start := 0; start < len(data); start += pieceLength {
+		end := start + pieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hash := sha1.Sum(data[start:end])
+		hashes = append(hashes, hash[:]...)
+	}
+	return string(hashes)
+}
@@ -0,0 +1,126 @@
+// Package ratelimit limits transfer rates with token buckets
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket refilled at its rate in bytes per second, with a
+// burst of one second worth of tokens. A rate of zero doesn't limit anything,
+// and neither does a nil Limiter.
+//
+// Limiters can be derived from another one, like per peer limiters from a
+// template: they have their own bucket, but follow the rate of the one they
+// were derived from until given their own.
+type Limiter struct {
+	mu       sync.Mutex
+	rate     int64
+	ownRate  bool
+	schedule Schedule
+	base     *Limiter
+
+	tokens float64
+	last   time.Time
+
+	// replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate, ownRate: true, now: time.Now, sleep: time.Sleep}
+}
+
+// Derive returns a limiter with its own bucket that follows the rate of l
+func (l *Limiter) Derive() *Limiter {
+	if l == nil {
+		return nil
+	}
+	return &Limiter{base: l, now: l.now, sleep: l.sleep}
+}
+
+// SetRate sets the rate in bytes per second, zero for unlimited
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	l.rate = rate
+	l.ownRate = true
+	l.mu.Unlock()
+}
+
+// SetSchedule sets the rates that replace the rate of the limiter at some
+// times of the day
+func (l *Limiter) SetSchedule(s Schedule) {
+	l.mu.Lock()
+	l.schedule = s
+	l.mu.Unlock()
+}
+
+// Rate returns the rate in effect now
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rateAt(l.now())
+}
+
+// rateAt is called with l.mu held
+func (l *Limiter) rateAt(t time.Time) int64 {
+	if rate, ok := l.schedule.rate(t); ok {
+		return rate
+	}
+	if !l.ownRate && l.base != nil {
+		return l.base.Rate()
+	}
+	return l.rate
+}
+
+// WaitN takes n tokens, blocking until the bucket has them. Bytes taken past
+// the burst are paid for by waiting, so a single large message goes through
+// without having to fit in the bucket.
+func (l *Limiter) WaitN(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := l.now()
+	rate := l.rateAt(now)
+	if rate <= 0 {
+		l.last = now
+		l.mu.Unlock()
+		return
+	}
+
+	if l.last.IsZero() {
+		l.tokens = float64(rate)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	}
+	if burst := float64(rate); l.tokens > burst {
+		l.tokens = burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		l.sleep(wait)
+	}
+}
+
+// Chain is a list of limiters that all have to allow a transfer, like the
+// global, torrent and peer ones
+type Chain []*Limiter
+
+func (c Chain) WaitN(n int) {
+	for _, l := range c {
+		l.WaitN(n)
+	}
+}
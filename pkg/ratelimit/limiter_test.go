@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeClock moves forward only when slept on
+type fakeClock struct {
+	now   time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+	c.slept += d
+}
+
+func newTestLimiter(rate int64, start time.Time) (*Limiter, *fakeClock) {
+	clock := &fakeClock{now: start}
+	l := NewLimiter(rate)
+	l.now = func() time.Time { return clock.now }
+	l.sleep = clock.sleep
+	return l, clock
+}
+
+func TestLimiterWaitN(t *testing.T) {
+	l, clock := newTestLimiter(1000, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+
+	// the first second worth of bytes goes through the burst
+	l.WaitN(1000)
+	if clock.slept != 0 {
+		t.Fatalf("unexpected wait within the burst: %v", clock.slept)
+	}
+	l.WaitN(500)
+	if clock.slept != 500*time.Millisecond {
+		t.Fatalf("expected 500ms wait, got %v", clock.slept)
+	}
+	// more than the burst at once is paid for by waiting
+	l.WaitN(3000)
+	if clock.slept != 3500*time.Millisecond {
+		t.Fatalf("expected 3.5s wait, got %v", clock.slept)
+	}
+
+	l.SetRate(0)
+	l.WaitN(1 << 30)
+	if clock.slept != 3500*time.Millisecond {
+		t.Fatalf("unexpected wait without limit: %v", clock.slept)
+	}
+
+	var unlimited *Limiter
+	unlimited.WaitN(100)
+}
+
+func TestLimiterDerive(t *testing.T) {
+	base, clock := newTestLimiter(1000, time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC))
+	peer := base.Derive()
+
+	// derived limiters have their own bucket
+	peer.WaitN(1000)
+	base.WaitN(1000)
+	if clock.slept != 0 {
+		t.Fatalf("unexpected wait: %v", clock.slept)
+	}
+
+	// and follow the rate of the base one until given their own
+	base.SetRate(2000)
+	if peer.Rate() != 2000 {
+		t.Fatalf("expected derived rate 2000, got %d", peer.Rate())
+	}
+	peer.SetRate(100)
+	if peer.Rate() != 100 || base.Rate() != 2000 {
+		t.Fatalf("unexpected rates: %d and %d", peer.Rate(), base.Rate())
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	s, err := ParseSchedule("22:00-07:00=0, 12:00-13:00=2K")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, clock := newTestLimiter(1000, time.Date(2024, 1, 1, 23, 30, 0, 0, time.UTC))
+	l.SetSchedule(s)
+
+	tests := []struct {
+		hour, min int
+		rate      int64
+	}{
+		{23, 30, 0},
+		{6, 59, 0},
+		{7, 0, 1000},
+		{12, 30, 2048},
+		{13, 0, 1000},
+	}
+	for _, test := range tests {
+		clock.now = time.Date(2024, 1, 1, test.hour, test.min, 0, 0, time.UTC)
+		if rate := l.Rate(); rate != test.rate {
+			t.Errorf("%02d:%02d: expected rate %d, got %d", test.hour, test.min, test.rate, rate)
+		}
+	}
+
+	for _, invalid := range []string{"22:00=1", "25:00-07:00=1", "22:00-07:00=x"} {
+		if _, err := ParseSchedule(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	tests := map[string]int64{"0": 0, "512": 512, "500K": 500 << 10, "2m": 2 << 20, "1G": 1 << 30}
+	for s, expected := range tests {
+		rate, err := ParseRate(s)
+		if err != nil || rate != expected {
+			t.Errorf("%s: expected %d, got %d (%v)", s, expected, rate, err)
+		}
+	}
+	if _, err := ParseRate("-1"); err == nil {
+		t.Errorf("expected error for negative rate")
+	}
+}
@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rule replaces the rate of a limiter between two times of the day. Rules
+// with Start after End span midnight.
+type Rule struct {
+	// since midnight
+	Start, End time.Duration
+	Rate       int64
+}
+
+// Schedule is a list of rules, the first one matching the time of day applies
+type Schedule []Rule
+
+func (s Schedule) rate(t time.Time) (int64, bool) {
+	hour, min, sec := t.Clock()
+	now := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+	for _, r := range s {
+		if r.Start <= r.End {
+			if r.Start <= now && now < r.End {
+				return r.Rate, true
+			}
+		} else if now >= r.Start || now < r.End {
+			return r.Rate, true
+		}
+	}
+	return 0, false
+}
+
+// ParseSchedule parses a comma separated list of rules like
+// "22:00-07:00=0,12:00-13:00=2M", a rate of 0 meaning unlimited
+func ParseSchedule(spec string) (Schedule, error) {
+	var s Schedule
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		eq := strings.Index(part, "=")
+		dash := strings.Index(part, "-")
+		if eq < 0 || dash < 0 || dash > eq {
+			return nil, fmt.Errorf("invalid schedule rule %q", part)
+		}
+		start, err := parseClock(part[:dash])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(part[dash+1 : eq])
+		if err != nil {
+			return nil, err
+		}
+		rate, err := ParseRate(part[eq+1:])
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, Rule{Start: start, End: end, Rate: rate})
+	}
+	return s, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// ParseRate parses a rate in bytes per second, with an optional K, M or G
+// suffix for powers of 1024
+func ParseRate(s string) (int64, error) {
+	orig := s
+	s = strings.TrimSpace(s)
+	mult := int64(1)
+	if s != "" {
+		switch strings.ToUpper(s[len(s)-1:]) {
+		case "K":
+			mult = 1 << 10
+		case "M":
+			mult = 1 << 20
+		case "G":
+			mult = 1 << 30
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid rate %q", orig)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,188 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/conn"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// Ban is a peer banned for sending data that failed the hash check
+type Ban struct {
+	IP     string    `json:"ip"`
+	PeerID string    `json:"peer_id,omitempty"`
+	Client string    `json:"client,omitempty"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+// BanList holds the banned peers, by IP so that a peer can't get around the ban
+// by connecting from another port. Bans are kept in memory, and also saved to
+// a file when the list was loaded from one.
+type BanList struct {
+	mu     sync.Mutex
+	path   string
+	banned map[string]Ban
+}
+
+func NewBanList() *BanList {
+	return &BanList{banned: make(map[string]Ban)}
+}
+
+// LoadBanList returns the bans saved at path, which is created with the first
+// ban if it does not exist
+func LoadBanList(path string) (*BanList, error) {
+	bl := NewBanList()
+	bl.path = path
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bl, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var bans []Ban
+	if err := json.Unmarshal(data, &bans); err != nil {
+		return nil, err
+	}
+	for _, b := range bans {
+		bl.banned[b.IP] = b
+	}
+	return bl, nil
+}
+
+// Ban adds a ban, saving the list if it has a file
+func (bl *BanList) Ban(b Ban) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	bl.banned[b.IP] = b
+	if bl.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(bl.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(bl.path, data)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// over path, so that a crash while saving leaves either list whole
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// IsBanned reports whether the IP of the peer is banned. A nil list bans nobody.
+func (bl *BanList) IsBanned(p *torrent.Peer) bool {
+	if bl == nil {
+		return false
+	}
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	_, ok := bl.banned[p.IP.String()]
+	return ok
+}
+
+// Bans returns the bans ordered by time
+func (bl *BanList) Bans() []Ban {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	return bl.list()
+}
+
+func (bl *BanList) list() []Ban {
+	bans := make([]Ban, 0, len(bl.banned))
+	for _, b := range bl.banned {
+		bans = append(bans, b)
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		if bans[i].Time.Equal(bans[j].Time) {
+			return bans[i].IP < bans[j].IP
+		}
+		return bans[i].Time.Before(bans[j].Time)
+	})
+	return bans
+}
+
+// suspect is a peer that sent a copy of a piece that failed the hash check
+type suspect struct {
+	peer *torrent.Peer
+	// ip is the address the blocks came from, as the peer may be known by name
+	ip     net.IP
+	peerID string
+	blocks []conn.BlockHash
+}
+
+// hashBlame keeps the copies of pieces that failed the hash check until the
+// piece is verified. The blocks of each failed copy are then compared with the
+// verified data to find the peers that sent bad ones, since a failed piece may
+// also be the victim of a single bad block.
+type hashBlame struct {
+	mu     sync.Mutex
+	failed map[int][]suspect
+}
+
+func newHashBlame() *hashBlame {
+	return &hashBlame{failed: make(map[int][]suspect)}
+}
+
+// Failed records the blocks a peer sent for a piece that failed the hash check
+func (hb *hashBlame) Failed(piece int, s suspect) {
+	hb.mu.Lock()
+	defer hb.mu.Unlock()
+	hb.failed[piece] = append(hb.failed[piece], s)
+}
+
+// Verified returns the peers that sent blocks of the piece that differ from its
+// verified data in storage
+func (hb *hashBlame) Verified(piece int, storage torrent.Storage) ([]suspect, error) {
+	hb.mu.Lock()
+	suspects, ok := hb.failed[piece]
+	delete(hb.failed, piece)
+	hb.mu.Unlock()
+	if !ok {
+		return nil, nil
+	}
+
+	var culprits []suspect
+	for _, s := range suspects {
+		for _, b := range s.blocks {
+			data := make([]byte, b.Length)
+			if _, err := storage.ReadAt(data, piece, int64(b.Begin)); err != nil {
+				return culprits, err
+			}
+			if sha1.Sum(data) != b.Hash {
+				culprits = append(culprits, s)
+				break
+			}
+		}
+	}
+	return culprits, nil
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/conn"
+)
+
+func TestBanListPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	bl, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer := testPeers(6881)[0]
+	if bl.IsBanned(peer) {
+		t.Fatal("peer banned in an empty list")
+	}
+	if err := bl.Ban(Ban{IP: peer.IP.String(), Reason: "bad data", Time: time.Unix(1, 0)}); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the ban holds for any port of the IP
+	if !loaded.IsBanned(testPeers(6882)[0]) {
+		t.Fatal("ban not loaded from the file")
+	}
+	if bans := loaded.Bans(); len(bans) != 1 || bans[0].Reason != "bad data" {
+		t.Fatalf("loaded bans %+v", bans)
+	}
+
+	var nilList *BanList
+	if nilList.IsBanned(peer) {
+		t.Fatal("nil list bans peers")
+	}
+}
+
+func TestBanListSaveReplacesFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "bans.json")
+	bl, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if err := bl.Ban(Ban{IP: ip, Reason: "bad data", Time: time.Unix(1, 0)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the list is renamed over the old one, leaving no temporary files
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "bans.json" {
+		t.Fatalf("unexpected files next to the ban list: %v", entries)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Fatalf("unexpected ban list mode %v", info.Mode())
+	}
+	loaded, err := LoadBanList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bans := loaded.Bans(); len(bans) != 2 {
+		t.Fatalf("loaded bans %+v", bans)
+	}
+}
+
+func blockHashes(data []byte, size int) []conn.BlockHash {
+	var blocks []conn.BlockHash
+	for begin := 0; begin < len(data); begin += size {
+		blocks = append(blocks, conn.BlockHash{
+			Begin:  begin,
+			Length: size,
+			Hash:   sha1.Sum(data[begin : begin+size]),
+		})
+	}
+	return blocks
+}
+
+func TestHashBlame(t *testing.T) {
+	d, data := newTestDownload(t)
+	piece := data[16:32]
+
+	bad := append([]byte(nil), piece...)
+	bad[10] ^= 0xff
+	blame := newHashBlame()
+	blame.Failed(1, suspect{peer: testPeers(1)[0], blocks: blockHashes(bad, 8)})
+	// a peer whose blocks were all good, the piece failed for another reason
+	blame.Failed(1, suspect{peer: testPeers(2)[0], blocks: blockHashes(piece, 8)})
+
+	if culprits, err := blame.Verified(0, d.storage); err != nil || len(culprits) != 0 {
+		t.Fatalf("piece without failures blamed %v, %v", culprits, err)
+	}
+
+	if _, err := d.storage.WriteAt(piece, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	culprits, err := blame.Verified(1, d.storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(culprits) != 1 || culprits[0].peer.Port != 1 {
+		t.Fatalf("culprits %+v, want the peer that sent the bad block", culprits)
+	}
+	// failures are forgotten once the piece is verified
+	if culprits, _ := blame.Verified(1, d.storage); len(culprits) != 0 {
+		t.Fatal("culprits blamed twice")
+	}
+}
@@ -0,0 +1,38 @@
+package services
+
+// ConnLimiter limits the number of peer connections open at once across
+// downloads. A nil limiter doesn't limit anything.
+type ConnLimiter struct {
+	slots chan struct{}
+}
+
+func NewConnLimiter(n int) *ConnLimiter {
+	return &ConnLimiter{slots: make(chan struct{}, n)}
+}
+
+// Acquire blocks until a connection can be opened
+func (cl *ConnLimiter) Acquire() {
+	if cl != nil {
+		cl.slots <- struct{}{}
+	}
+}
+
+// TryAcquire takes a slot if one is free, returning false otherwise
+func (cl *ConnLimiter) TryAcquire() bool {
+	if cl == nil {
+		return true
+	}
+	select {
+	case cl.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// Release frees the slot of a closed connection
+func (cl *ConnLimiter) Release() {
+	if cl != nil {
+		<-cl.slots
+	}
+}
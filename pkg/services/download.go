@@ -0,0 +1,268 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/conn"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// DefaultReadahead is the number of bytes ahead of the position of a reader
+// that are downloaded first
+const DefaultReadahead = 4 << 20
+
+var ErrDownloadStopped = errors.New("download stopped before the data was downloaded")
+
+// Download is a download running in the background
+type Download struct {
+	torrent    torrent.Torrent
+	storage    torrent.Storage
+	picker     *piecePicker
+	files      []torrent.File
+	priorities []torrent.Priority
+	pieceLen   int
+
+	// rate limiters of the download
+	downLimit, upLimit *ratelimit.Limiter
+	// connections peers opened to us for the torrent
+	incoming chan *conn.Incoming
+
+	done chan struct{}
+	err  error
+
+	mu      sync.Mutex
+	readers int
+}
+
+func newDownload(t torrent.Torrent, storage torrent.Storage, picker *piecePicker, priorities []torrent.Priority) (*Download, error) {
+	files, err := t.Files()
+	if err != nil {
+		return nil, err
+	}
+	pieceLen, err := t.PieceLength()
+	if err != nil {
+		return nil, err
+	}
+	return &Download{
+		torrent:    t,
+		storage:    storage,
+		picker:     picker,
+		files:      files,
+		priorities: priorities,
+		pieceLen:   pieceLen,
+		incoming:   make(chan *conn.Incoming),
+		done:       make(chan struct{}),
+	}, nil
+}
+
+// finish records the result of the download and wakes up the readers
+func (d *Download) finish(err error) {
+	d.err = err
+	d.picker.Close()
+	close(d.done)
+}
+
+// Done is closed when the download is over
+func (d *Download) Done() <-chan struct{} {
+	return d.done
+}
+
+// Wait blocks until the download is over and returns its error
+func (d *Download) Wait() error {
+	<-d.done
+	return d.err
+}
+
+// Stop stops the download and waits for it to end. Pieces being downloaded are
+// dropped, and nothing is written to storage once it returns.
+func (d *Download) Stop() error {
+	d.picker.Close()
+	return d.Wait()
+}
+
+// Accept hands a connection a peer opened to us for the torrent to the
+// download, which takes care of closing it. It fails once the download is over,
+// leaving the connection to the caller.
+func (d *Download) Accept(in *conn.Incoming) error {
+	select {
+	case d.incoming <- in:
+		return nil
+	case <-d.done:
+		return ErrDownloadStopped
+	}
+}
+
+// Limits returns the download and upload rate limiters of the download, whose
+// rates can be changed while it runs
+func (d *Download) Limits() (download, upload *ratelimit.Limiter) {
+	return d.downLimit, d.upLimit
+}
+
+// Files returns the files of the torrent
+func (d *Download) Files() []torrent.File {
+	return d.files
+}
+
+// NewReader returns a reader of the file with the given index. The file can't
+// be one of the skipped ones.
+func (d *Download) NewReader(file int) (*Reader, error) {
+	if file < 0 || file >= len(d.files) {
+		return nil, fmt.Errorf("file index %d out of range", file)
+	}
+	if d.priorities[file] == torrent.PrioritySkip {
+		return nil, torrent.ErrFileSkipped
+	}
+	d.mu.Lock()
+	d.readers++
+	id := d.readers
+	d.mu.Unlock()
+
+	r := &Reader{d: d, file: d.files[file], id: id, readahead: DefaultReadahead}
+	r.setWindow(0)
+	return r, nil
+}
+
+// Reader reads a file of a torrent while it downloads. Reads block until the
+// pieces holding the data are verified, and the pieces just ahead of the
+// position of the reader are downloaded before any other.
+type Reader struct {
+	d    *Download
+	file torrent.File
+	id   int
+
+	mu        sync.Mutex
+	pos       int64
+	readahead int64
+}
+
+// SetReadahead sets the number of bytes ahead of the position that are
+// downloaded first
+func (r *Reader) SetReadahead(n int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.readahead = n
+	r.setWindow(r.pos)
+}
+
+// setWindow moves the readahead window to the given position of the file
+func (r *Reader) setWindow(pos int64) {
+	length := int64(r.file.Length)
+	if pos >= length {
+		r.d.picker.RemoveWindow(r.id)
+		return
+	}
+	end := pos + r.readahead
+	if end > length {
+		end = length
+	}
+	if end <= pos {
+		end = pos + 1
+	}
+	start := int64(r.file.Offset) + pos
+	last := int64(r.file.Offset) + end - 1
+	r.d.picker.SetWindow(r.id, int(start/int64(r.d.pieceLen)), int(last/int64(r.d.pieceLen)))
+}
+
+// ReadAt reads len(p) bytes of the file starting at off, waiting for the pieces
+// holding them
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	length := int64(r.file.Length)
+	if off >= length {
+		return 0, io.EOF
+	}
+	var err error
+	if int64(len(p)) > length-off {
+		p = p[:length-off]
+		err = io.EOF
+	}
+
+	n := 0
+	for n < len(p) {
+		abs := int64(r.file.Offset) + off + int64(n)
+		piece := int(abs / int64(r.d.pieceLen))
+		inPiece := abs % int64(r.d.pieceLen)
+		size := len(p) - n
+		if rest := r.d.pieceLen - int(inPiece); size > rest {
+			size = rest
+		}
+
+		if !r.d.picker.WaitPiece(piece) {
+			// the picker is closed when the download ends or is stopped, and
+			// its error is only set once it's done
+			if err := r.d.Wait(); err != nil {
+				return n, err
+			}
+			return n, ErrDownloadStopped
+		}
+		read, readErr := r.d.storage.ReadAt(p[n:n+size], piece, inPiece)
+		n += read
+		if readErr != nil {
+			return n, readErr
+		}
+	}
+	return n, err
+}
+
+// Read reads from the current position, at most up to the end of the piece it
+// is in so that data is returned as soon as a piece is verified
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	length := int64(r.file.Length)
+	if r.pos >= length {
+		return 0, io.EOF
+	}
+	abs := int64(r.file.Offset) + r.pos
+	if rest := int64(r.d.pieceLen) - abs%int64(r.d.pieceLen); int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	if int64(len(p)) > length-r.pos {
+		p = p[:length-r.pos]
+	}
+
+	r.setWindow(r.pos)
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the position of the next Read, moving the readahead window with it
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = int64(r.file.Length) + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = pos
+	r.setWindow(pos)
+	return pos, nil
+}
+
+// Close removes the readahead window of the reader
+func (r *Reader) Close() error {
+	r.d.picker.RemoveWindow(r.id)
+	return nil
+}
@@ -1,27 +1,93 @@
 package services
 
 import (
-	"bytes"
 	"fmt"
 	"io"
-	"math/rand"
-	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/conn"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/dht"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/ratelimit"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/util"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/webseed"
 )
 
 type DownloadFileService interface {
+	// DownloadFile downloads the torrent at the given path. Single file torrents
+	// are saved to the output path, multi file ones in a directory under it.
 	DownloadFile(string, string) error
+	// DownloadToStorage downloads the pieces of the selected files of the torrent
+	// missing from storage
+	DownloadToStorage(torrent.Torrent, torrent.Storage) error
+	// StartDownload starts downloading the torrent to storage in the background,
+	// the files can be read while they are downloading
+	StartDownload(torrent.Torrent, torrent.Storage) (*Download, error)
+	// StreamFile downloads the torrent like DownloadFile, writing the file with
+	// the given index to the writer as soon as its pieces are downloaded
+	StreamFile(torrentFile, filepath string, file int, w io.Writer) error
 }
 
+// DownloadOptions configures how DownloadFile stores the torrent
+type DownloadOptions struct {
+	// Mmap stores the files through memory maps instead of plain reads and writes
+	Mmap bool
+	// CacheSize is the size in bytes of the write-back cache in front of the
+	// files, no cache is used if zero
+	CacheSize   int64
+	FlushPolicy torrent.FlushPolicy
+	// Files selects the files of multi file torrents to download
+	Files torrent.FileSelection
+	// Workers is the number of peer connections of a download, 5 if zero
+	Workers int
+	// Conns limits the peer connections shared by the downloads of the service
+	Conns *ConnLimiter
+	// Limits rate limit the block data of peers and web seeds
+	Limits RateLimits
+	// Bans holds the peers banned for sending bad data, shared by the
+	// downloads of the service. A new in-memory list is used if nil.
+	Bans *BanList
+	// Port announced to trackers and the DHT, the one peers connect to
+	// through Download.Accept
+	Port int
+	// DHT finds peers for the downloads of public torrents, in addition to
+	// their trackers. It isn't used if nil.
+	DHT *dht.DHT
+}
+
+// RateLimits are the rate limiters of a service, nil ones don't limit anything
+type RateLimits struct {
+	// Download and Upload are shared by all the downloads of the service
+	Download, Upload *ratelimit.Limiter
+	// every download gets its own limiters following the rates of
+	// TorrentDownload and TorrentUpload, which can be changed for the download
+	TorrentDownload, TorrentUpload *ratelimit.Limiter
+	// every peer connection gets its own limiters following these rates
+	PeerDownload, PeerUpload *ratelimit.Limiter
+}
+
+const defaultWorkers = 5
+
+// dhtInterval is the time between the DHT lookups of a download
+const dhtInterval = 15 * time.Minute
+
 type downloadFileServiceImpl struct {
 	logger log.Logger
+	opts   DownloadOptions
 }
 
 func NewDownloadFileService() DownloadFileService {
-	return &downloadFileServiceImpl{log.NewLogger(log.NORMAL)}
+	return NewDownloadFileServiceWithOptions(DownloadOptions{})
+}
+
+func NewDownloadFileServiceWithOptions(opts DownloadOptions) DownloadFileService {
+	if opts.Bans == nil {
+		opts.Bans = NewBanList()
+	}
+	return &downloadFileServiceImpl{logger: log.NewLogger(log.NORMAL), opts: opts}
 }
 
 func (df *downloadFileServiceImpl) DownloadFile(torrentFile, filepath string) error {
@@ -29,115 +95,569 @@ func (df *downloadFileServiceImpl) DownloadFile(torrentFile, filepath string) er
 	if err != nil {
 		return err
 	}
-	tracker := torrent.NewTracker(t)
+	storage, err := df.open(t, filepath)
+	if err != nil {
+		return err
+	}
+	err = df.DownloadToStorage(t, storage)
+	if closeErr := df.close(storage); err == nil {
+		err = closeErr
+	}
+	return err
+}
 
-	resp, err := tracker.AskForPeers()
+func (df *downloadFileServiceImpl) StreamFile(torrentFile, filepath string, file int, w io.Writer) error {
+	t, err := torrent.NewSingleTorrentFromFile(torrentFile)
 	if err != nil {
 		return err
 	}
+	storage, err := df.open(t, filepath)
+	if err != nil {
+		return err
+	}
+	defer df.close(storage)
 
-	if len(resp.Peers) == 0 {
-		return fmt.Errorf("no peers found")
+	d, err := df.StartDownload(t, storage)
+	if err != nil {
+		return err
 	}
+	r, err := d.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		return err
+	}
+	// the rest of the selected files keep downloading
+	return d.Wait()
+}
 
-	pieces, err := t.Pieces()
+// open returns the storage of the torrent under filepath, behind the cache if
+// one is configured
+func (df *downloadFileServiceImpl) open(t torrent.Torrent, filepath string) (torrent.Storage, error) {
+	files, err := t.Files()
+	if err != nil {
+		return nil, err
+	}
+	priorities, err := df.opts.Files.Priorities(files)
+	if err != nil {
+		return nil, err
+	}
+
+	storage, err := df.openStorage(t, files, priorities, filepath)
+	if err != nil || df.opts.CacheSize <= 0 {
+		return storage, err
+	}
+	cache, err := torrent.NewCachedStorage(t, storage, torrent.CacheOptions{
+		Size:   df.opts.CacheSize,
+		Policy: df.opts.FlushPolicy,
+	})
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return cache, nil
+}
+
+// close closes storage, which flushes the cache as well
+func (df *downloadFileServiceImpl) close(storage torrent.Storage) error {
+	err := storage.Close()
+	if cache, ok := storage.(*torrent.CachedStorage); ok {
+		stats := cache.Stats()
+		df.logger.Info("Cache hits:", stats.Hits, "misses:", stats.Misses, "pieces flushed:", stats.Flushes)
+	}
+	return err
+}
+
+func (df *downloadFileServiceImpl) openStorage(t torrent.Torrent, files []torrent.File, priorities []torrent.Priority, filepath string) (torrent.Storage, error) {
+	if len(files) == 1 && len(files[0].Path) == 1 {
+		if df.opts.Mmap {
+			return torrent.NewMmapStorage(t, []string{filepath})
+		}
+		return torrent.NewBlobStorage(t, filepath)
+	}
+
+	paths, err := torrent.FilePaths(t, filepath)
+	if err != nil {
+		return nil, err
+	}
+	// skipped files get no path, so that they are never created
+	skipped := false
+	for i, p := range priorities {
+		if p == torrent.PrioritySkip {
+			paths[i] = ""
+			skipped = true
+		}
+	}
+
+	var storage torrent.Storage
+	if df.opts.Mmap {
+		storage, err = torrent.NewMmapStorage(t, paths)
+	} else {
+		storage, err = torrent.NewFileStorageFromPaths(t, paths)
+	}
+	if err != nil || !skipped {
+		return storage, err
+	}
+
+	name, err := t.Name()
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	partPath, err := torrent.FilePath(filepath, []string{"." + name + ".parts"})
+	if err != nil {
+		storage.Close()
+		return nil, err
+	}
+	return torrent.NewPartialStorage(t, storage, priorities, partPath)
+}
+
+func (df *downloadFileServiceImpl) DownloadToStorage(t torrent.Torrent, storage torrent.Storage) error {
+	d, err := df.StartDownload(t, storage)
 	if err != nil {
 		return err
 	}
+	return d.Wait()
+}
 
-	// for each piece, one bytes.Buffer to store it
-	pieceStorage := make([]*bytes.Buffer, len(pieces))
+func (df *downloadFileServiceImpl) StartDownload(t torrent.Torrent, storage torrent.Storage) (*Download, error) {
+	pieces, err := t.Pieces()
+	if err != nil {
+		return nil, err
+	}
+	files, err := t.Files()
+	if err != nil {
+		return nil, err
+	}
+	filePriorities, err := df.opts.Files.Priorities(files)
+	if err != nil {
+		return nil, err
+	}
+	piecePriorities, err := torrent.PiecePriorities(t, filePriorities)
+	if err != nil {
+		return nil, err
+	}
 
-	// place all the indexes as tasks in a queue
-	pieceQueue := make(chan int, len(pieces))
+	// the picker holds the indexes of the wanted pieces missing from storage as tasks
+	picker := newPiecePicker(len(pieces), storage.Completion, piecePriorities)
 	df.logger.Info("Torrent no of pieces:", len(pieces))
 
-	for i := 0; i < len(pieces); i++ {
-		pieceQueue <- i
-		pieceStorage[i] = new(bytes.Buffer)
+	d, err := newDownload(t, storage, picker, filePriorities)
+	if err != nil {
+		return nil, err
+	}
+	d.downLimit = df.opts.Limits.TorrentDownload.Derive()
+	if d.downLimit == nil {
+		d.downLimit = ratelimit.NewLimiter(0)
+	}
+	d.upLimit = df.opts.Limits.TorrentUpload.Derive()
+	if d.upLimit == nil {
+		d.upLimit = ratelimit.NewLimiter(0)
 	}
+	go func() {
+		d.finish(df.download(t, storage, picker, d.downLimit, d.upLimit, d.incoming))
+	}()
+	return d, nil
+}
 
-	successChan := make(chan struct{})
+func (df *downloadFileServiceImpl) download(t torrent.Torrent, storage torrent.Storage, picker *piecePicker, downLimit, upLimit *ratelimit.Limiter, incoming <-chan *conn.Incoming) error {
+	tLen, err := t.Length()
+	if err != nil {
+		return err
+	}
+	pieceLen, err := t.PieceLength()
+	if err != nil {
+		return err
+	}
 
-	// will limit the max number of workers that can be spawned
-	workersq := make(chan struct{}, 5)
+	pieces, err := t.Pieces()
+	if err != nil {
+		return err
+	}
 
-	go func() {
-		for pidx := range pieceQueue {
+	// bytes of pieces verified and of blocks served in this run, reported to
+	// the tracker along with the bytes of the wanted pieces still missing from
+	// storage
+	var downloaded, uploaded int64
+	stats := func() (int64, int64, int64) {
+		var left int64
+		for i := range pieces {
+			if picker.Wanted(i) && !storage.Completion(i) {
+				left += int64(util.GetLengthForIdx(tLen, pieceLen, i))
+			}
+		}
+		return atomic.LoadInt64(&uploaded), atomic.LoadInt64(&downloaded), left
+	}
+	// the completed event is only sent by the run that completes the torrent
+	completeAtStart := picker.Finished()
 
-			// avoiding Go's unexpected behavior in this case
-			pidx := pidx
+	announcer := torrent.NewAnnouncer(torrent.NewTracker(t), stats)
+	announcer.SetPort(df.opts.Port)
 
-			// "get" a worker
-			workersq <- struct{}{}
+	// will limit the max number of workers that can be spawned
+	workers := df.opts.Workers
+	if workers <= 0 {
+		workers = defaultWorkers
+	}
+	pm := NewPeerManager(PeerManagerOptions{MaxConns: workers, Banned: df.opts.Bans.IsBanned})
+	defer pm.Close()
 
-			go func() {
+	// pieces that failed the hash check, to blame the peers that sent bad
+	// blocks once the piece is verified
+	blame := newHashBlame()
+	verified := func(pidx int) {
+		atomic.AddInt64(&downloaded, int64(util.GetLengthForIdx(tLen, pieceLen, pidx)))
+		df.banCulprits(blame, pidx, storage)
+	}
 
-				defer func() {
-					// "release" a worker
-					<-workersq
-				}()
+	lookupDHT := df.dhtLookup(t)
 
-				// select one peer at random each time
-				selectedPeer := resp.Peers[rand.Intn(len(resp.Peers))]
-				df.logger.Debug(selectedPeer)
+	resp, err := announcer.Start()
+	if err == nil {
+		pm.Add(resp.Peers, SourceTracker)
+	} else if len(t.WebSeeds()) == 0 && lookupDHT == nil {
+		return err
+	} else {
+		// web seeds and the DHT can still provide the whole torrent
+		df.logger.Warn("Asking tracker for peers:", err)
+	}
+	defer func() {
+		if err := announcer.Stop(); err != nil {
+			df.logger.Warn("Sending stopped event to tracker:", err)
+		}
+	}()
 
-				peerConn, err := conn.EstablishConnection(torrent.LocalPeerID, selectedPeer, t, Logger)
-				df.logger.Debug("worker established one connection for idx", pidx, "with peer:", selectedPeer)
-				if err != nil {
-					// if error occurs put back in queue
-					pieceQueue <- pidx
-					df.logger.Debug(err)
+	// the DHT is asked for peers along with the tracker, and again every
+	// dhtInterval until the download is over. The download only waits for the
+	// first lookup when the tracker gave no peers.
+	if lookupDHT != nil {
+		looked := false
+		if pm.Len() == 0 {
+			pm.Add(lookupDHT(), SourceDHT)
+			looked = true
+		}
+		stopDHT := make(chan struct{})
+		defer close(stopDHT)
+		go func() {
+			if !looked {
+				pm.Add(lookupDHT(), SourceDHT)
+			}
+			ticker := time.NewTicker(dhtInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					pm.Add(lookupDHT(), SourceDHT)
+				case <-stopDHT:
 					return
 				}
+			}
+		}()
+	}
 
-				defer func() {
-					if err := peerConn.Close(); err != nil {
-						df.logger.Debug(err)
-					}
-				}()
+	if pm.Len() == 0 && len(t.WebSeeds()) == 0 && !completeAtStart {
+		return fmt.Errorf("no peers found")
+	}
 
-				err = peerConn.AskForPiece(pidx, pieceStorage[pidx])
-				if err != nil {
-					// if error occurs put back in queue
-					pieceQueue <- pidx
-					df.logger.Debug(err)
-					return
-				}
+	// peers received in re-announces are added to the ones known
+	go func() {
+		for peers := range announcer.Peers() {
+			pm.Add(peers, SourceTracker)
+		}
+	}()
 
-				df.logger.Info("Piece with idx", pidx, "downloaded")
+	// the peer and web seed workers write to storage, they are all waited for
+	// before returning
+	var wg sync.WaitGroup
 
-				// signal successful completion of task
-				// a counter is kept in the main routine to know when all tasks are finished
-				successChan <- struct{}{}
+	// web seeds take pieces from the same picker as the peer workers
+	for _, u := range t.WebSeeds() {
+		ws := webseed.NewWebSeed(u, t)
+		ws.SetLimits(ratelimit.Chain{df.opts.Limits.Download, downLimit})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			df.webSeedWorker(ws, picker, storage, verified)
+		}()
+	}
 
-			}()
+	limits := func() conn.Limits {
+		return conn.Limits{
+			Download: ratelimit.Chain{df.opts.Limits.Download, downLimit, df.opts.Limits.PeerDownload.Derive()},
+			Upload:   ratelimit.Chain{df.opts.Limits.Upload, upLimit, df.opts.Limits.PeerUpload.Derive()},
+		}
+	}
+
+	// fetch downloads the piece over the established connection and closes it,
+	// the pieces we have are served to the peer meanwhile
+	fetch := func(peerConn *conn.PeerConn, peer *torrent.Peer, pidx int) {
+		defer func() {
+			if err := peerConn.Close(); err != nil {
+				df.logger.Debug(err)
+			}
+			atomic.AddInt64(&uploaded, peerConn.Stats().PayloadUp)
+		}()
+
+		// a stopped download drops the piece instead of waiting for it
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-picker.Closed():
+				peerConn.Close()
+			case <-finished:
+			}
+		}()
+
+		start := time.Now()
+		err := peerConn.AskForPiece(pidx, storage)
+
+		// pieces suggested by the peer are picked next
+		for _, suggested := range peerConn.Suggestions() {
+			picker.Suggest(suggested)
+		}
+
+		if err != nil {
+			// the blocks of a piece that failed the hash check are kept to
+			// find out who sent the bad ones
+			if mismatch, ok := err.(*conn.HashMismatchError); ok {
+				blame.Failed(pidx, suspect{
+					peer:   peer,
+					ip:     peerConn.RemoteIP(),
+					peerID: peerConn.RemotePeerID(),
+					blocks: mismatch.Blocks,
+				})
+			}
+			// if error occurs put back in queue
+			pm.Failed(peer)
+			picker.Retry(pidx)
+			df.logger.Debug(err)
+			return
+		}
+		pm.Done(peer, int64(util.GetLengthForIdx(tLen, pieceLen, pidx)), time.Since(start))
+
+		df.logger.Info("Piece with idx", pidx, "downloaded")
+
+		// signal successful completion of task
+		verified(pidx)
+		picker.Done(pidx)
+	}
+
+	// accept answers the handshake of a peer that connected to us and
+	// downloads a piece from it like from the dialed ones, as long as the
+	// connection limits leave room for it
+	accept := func(in *conn.Incoming) {
+		if !df.opts.Conns.TryAcquire() {
+			in.Close()
+			return
+		}
+		defer df.opts.Conns.Release()
+		peer := in.Peer()
+		if !pm.Accept(peer) {
+			in.Close()
+			return
+		}
+
+		peerConn, err := conn.AcceptConnection(torrent.LocalPeerID, in, t, Logger, conn.Options{
+			Limits:  limits(),
+			Storage: storage,
+		})
+		if err != nil {
+			pm.Failed(peer)
+			df.logger.Debug(err)
+			return
+		}
+		df.logger.Debug("accepted connection from peer:", peer)
+
+		pidx, ok := picker.Next()
+		if !ok {
+			peerConn.Close()
+			atomic.AddInt64(&uploaded, peerConn.Stats().PayloadUp)
+			pm.Done(peer, 0, 0)
+			return
+		}
+		fetch(peerConn, peer, pidx)
+	}
+
+	stopAccepting := make(chan struct{})
+	acceptorDone := make(chan struct{})
+	go func() {
+		defer close(acceptorDone)
+		for {
+			select {
+			case in := <-incoming:
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					accept(in)
+				}()
+			case <-stopAccepting:
+				return
+			}
 		}
 	}()
 
-	counter := len(pieces)
+	workersq := make(chan struct{}, workers)
 
-	// waiting for all tasks to finish
-	for {
-		<-successChan
-		if counter--; counter == 0 {
-			close(pieceQueue)
-			close(workersq)
+	// peers are used until they are all banned
+	for pm.Len() > 0 && !pm.AllBanned() {
+		// "get" a worker before picking the piece, so that the piece follows
+		// the readahead windows set while waiting for it
+		workersq <- struct{}{}
+
+		pidx, ok := picker.Next()
+		if !ok {
+			// all pieces downloaded
+			<-workersq
 			break
 		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			defer func() {
+				// "release" a worker
+				<-workersq
+			}()
+
+			// the peer manager picks the peer, waiting for one to be free
+			selectedPeer, err := pm.Dial()
+			if err != nil {
+				picker.Retry(pidx)
+				return
+			}
+			df.logger.Debug(selectedPeer)
+
+			// a connection shared with the other downloads is only taken
+			// once there is a peer to connect to
+			df.opts.Conns.Acquire()
+			defer df.opts.Conns.Release()
+
+			peerConn, err := conn.EstablishConnectionWithOptions(torrent.LocalPeerID, selectedPeer, t, Logger, conn.Options{
+				Limits:  limits(),
+				Storage: storage,
+			})
+			df.logger.Debug("worker established one connection for idx", pidx, "with peer:", selectedPeer)
+			if err != nil {
+				// if error occurs put back in queue
+				pm.Failed(selectedPeer)
+				picker.Retry(pidx)
+				df.logger.Debug(err)
+				return
+			}
+			pm.Connected(selectedPeer)
+
+			fetch(peerConn, selectedPeer, pidx)
+		}()
 	}
-	close(successChan)
 
-	f, err := os.OpenFile(filepath, os.O_CREATE|os.O_WRONLY, 0644)
-	defer f.Close()
-	if err != nil {
-		return err
+	// workers waiting for a peer give up their piece, and web seeds download
+	// the pieces left
+	pm.Close()
+	if len(t.WebSeeds()) > 0 {
+		picker.Wait()
 	}
+	close(stopAccepting)
+	<-acceptorDone
+	wg.Wait()
 
-	// write the buffers holding the pieces to a file
-	for _, p := range pieceStorage {
-		io.Copy(f, p)
+	if picker.Stopped() {
+		return ErrDownloadStopped
+	}
+	if !picker.Finished() {
+		return ErrAllPeersBanned
+	}
+	if !completeAtStart {
+		if err := announcer.Completed(); err != nil {
+			df.logger.Warn("Sending completed event to tracker:", err)
+		}
 	}
 
 	return nil
 }
+
+// dhtLookup returns a function looking up the peers of the torrent on the DHT,
+// which announces the port we accept connections on if there is one. It is nil
+// without a DHT, and for private torrents whose peers only come from their
+// trackers.
+func (df *downloadFileServiceImpl) dhtLookup(t torrent.Torrent) func() []*torrent.Peer {
+	if df.opts.DHT == nil {
+		return nil
+	}
+	if p, ok := t.(interface{ Private() bool }); ok && p.Private() {
+		return nil
+	}
+	infohash, err := t.InfoHash()
+	if err != nil {
+		return nil
+	}
+	return func() []*torrent.Peer {
+		var peers []*torrent.Peer
+		var err error
+		if df.opts.Port > 0 {
+			peers, err = df.opts.DHT.Announce(infohash, df.opts.Port)
+		} else {
+			peers, err = df.opts.DHT.GetPeers(infohash)
+		}
+		if err != nil {
+			df.logger.Warn("Looking up peers on the DHT:", err)
+		}
+		return peers
+	}
+}
+
+// banCulprits bans the peers that sent bad blocks of a piece that failed the
+// hash check before it was verified
+func (df *downloadFileServiceImpl) banCulprits(blame *hashBlame, pidx int, storage torrent.Storage) {
+	culprits, err := blame.Verified(pidx, storage)
+	if err != nil {
+		df.logger.Warn("Comparing the blocks of piece", pidx, ":", err)
+	}
+	for _, s := range culprits {
+		client := "unknown client"
+		if info, ok := torrent.ParsePeerID(s.peerID); ok {
+			client = info.String()
+		}
+		df.logger.Warn(fmt.Sprintf("Banning peer %s (%s, peer id %q) for sending bad data for piece %d", s.peer.Addr(), client, s.peerID, pidx))
+		err := df.opts.Bans.Ban(Ban{
+			IP:     s.ip.String(),
+			PeerID: s.peerID,
+			Client: client,
+			Reason: fmt.Sprintf("bad data for piece %d", pidx),
+			Time:   time.Now(),
+		})
+		if err != nil {
+			df.logger.Warn("Saving ban list:", err)
+		}
+	}
+}
+
+// webSeedWorker downloads pieces from a web seed until none are left. Pieces are
+// only taken while the web seed is not backing off after failures.
+func (df *downloadFileServiceImpl) webSeedWorker(ws *webseed.WebSeed, picker *piecePicker, storage torrent.Storage, onPiece func(int)) {
+	for {
+		select {
+		case <-time.After(ws.Backoff()):
+		case <-picker.Closed():
+			return
+		}
+
+		pidx, ok := picker.Next()
+		if !ok {
+			return
+		}
+
+		if err := ws.DownloadPiece(pidx, storage); err != nil {
+			picker.Retry(pidx)
+			df.logger.Debug("web seed", ws.URL(), "failed piece", pidx, ":", err)
+			continue
+		}
+
+		df.logger.Info("Piece with idx", pidx, "downloaded from web seed", ws.URL())
+		onPiece(pidx)
+		picker.Done(pidx)
+	}
+}
@@ -1,13 +1,14 @@
 package services
 
 import (
+	"errors"
 	"fmt"
 	"os"
-	"strings"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/conn"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/util"
 )
 
 var Logger log.Logger
@@ -39,28 +40,56 @@ func (dps *downloadPieceServiceImpl) DownloadPiece(filepath string, torrentFile
 		return fmt.Errorf("no peers found")
 	}
 
-	var peerConn *conn.PeerConn
-
-	f, err := os.OpenFile(filepath, os.O_CREATE|os.O_WRONLY, 0644)
-	defer f.Close()
+	// only one piece is kept, so it is held in memory until written out
+	storage, err := torrent.NewMemoryStorage(t)
 	if err != nil {
 		return err
 	}
+	defer storage.Close()
 
 	for _, remotePeer := range resp.Peers {
 
-		peerConn, err = conn.EstablishConnection(torrent.LocalPeerID, remotePeer, t, Logger)
+		peerConn, err := conn.EstablishConnection(torrent.LocalPeerID, remotePeer, t, Logger)
 		if err != nil {
-			if strings.Contains(err.Error(), "reading handshake") {
+			// peers the handshake fails with are skipped
+			var hsErr *conn.HandshakeError
+			if errors.As(err, &hsErr) {
+				Logger.Info("Skipping peer", remotePeer.Addr(), ":", err)
 				continue
 			}
 			return err
 		}
-		Logger.Info("Established connection with peer: ", remotePeer.AddrIPV4, remotePeer.Port)
-		break
+		Logger.Info("Established connection with peer: ", remotePeer.Addr())
+
+		err = peerConn.AskForPiece(idx, storage)
+		peerConn.Close()
+		// peers announcing they don't have the piece are skipped
+		if err == conn.ErrPieceNotAvailable {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return writePiece(storage, t, idx, filepath)
 	}
 
-	defer peerConn.Close()
+	return fmt.Errorf("no peer could provide piece %d", idx)
+}
+
+// writePiece writes the piece with the given index from storage to a file
+func writePiece(storage torrent.Storage, t torrent.Torrent, idx int, filepath string) error {
+	tLen, err := t.Length()
+	if err != nil {
+		return err
+	}
+	pieceLen, err := t.PieceLength()
+	if err != nil {
+		return err
+	}
 
-	return peerConn.AskForPiece(idx, f)
+	data := make([]byte, util.GetLengthForIdx(tLen, pieceLen, idx))
+	if _, err := storage.ReadAt(data, idx, 0); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath, data, 0644)
 }
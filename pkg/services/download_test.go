@@ -0,0 +1,435 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/dht"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/internal/testtorrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// testTorrent returns a torrent with two files of 40 and 60 bytes in pieces of
+// 16 bytes announced to the tracker, and its data
+func testTorrent(t *testing.T, announce string) (torrent.Torrent, []byte) {
+	data := testtorrent.Data(100)
+	encoded := testtorrent.Encode(t, testtorrent.Options{
+		Announce: announce,
+		Files:    []testtorrent.File{{Path: []string{"a.bin"}, Length: 40}, {Path: []string{"b.bin"}, Length: 60}},
+		Data:     data,
+	})
+	tr, err := torrent.NewSingleTorrentFile(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr, data
+}
+
+// newTestDownload returns a download of the test torrent, with nothing
+// downloading the pieces yet
+func newTestDownload(t *testing.T) (*Download, []byte) {
+	tr, data := testTorrent(t, "http://127.0.0.1:1/announce")
+	storage, err := torrent.NewMemoryStorage(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	picker := newPiecePicker(7, storage.Completion, nil)
+	d, err := newDownload(tr, storage, picker, []torrent.Priority{torrent.PriorityNormal, torrent.PriorityNormal})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, data
+}
+
+// downloadNext stores the next piece handed out by the picker, like a download
+// worker would
+func downloadNext(t *testing.T, d *Download, data []byte) {
+	idx, ok := d.picker.Next()
+	if !ok {
+		t.Error("no piece left to download")
+		return
+	}
+	end := (idx + 1) * 16
+	if end > len(data) {
+		end = len(data)
+	}
+	if _, err := d.storage.WriteAt(data[idx*16:end], idx, 0); err != nil {
+		t.Error(err)
+		return
+	}
+	d.storage.MarkComplete(idx)
+	d.picker.Done(idx)
+}
+
+func TestReaderReadahead(t *testing.T) {
+	d, _ := newTestDownload(t)
+	r, err := d.NewReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.SetReadahead(16)
+
+	// b.bin starts in piece 2, at offset 8
+	if idx, _ := d.picker.Next(); idx != 2 {
+		t.Fatalf("expected piece 2 first, got %d", idx)
+	}
+	// seeking moves the window right away
+	if _, err := r.Seek(-10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if idx, _ := d.picker.Next(); idx != 5 {
+		t.Fatalf("expected piece 5 after seeking, got %d", idx)
+	}
+	r.Close()
+	if idx, _ := d.picker.Next(); idx != 0 {
+		t.Fatalf("expected piece 0 without readers, got %d", idx)
+	}
+}
+
+func TestReaderRead(t *testing.T) {
+	d, data := newTestDownload(t)
+	r, err := d.NewReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	go func() {
+		for i := 0; i < 7; i++ {
+			downloadNext(t, d, data)
+		}
+	}()
+
+	read, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data[40:]) {
+		t.Fatalf("unexpected data read: %v", read)
+	}
+
+	buf := make([]byte, 10)
+	if _, err := r.ReadAt(buf, 5); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[45:55]) {
+		t.Fatalf("unexpected data read at 5: %v", buf)
+	}
+	if n, err := r.ReadAt(buf, 55); n != 5 || err != io.EOF {
+		t.Fatalf("expected 5 bytes and io.EOF, got %d and %v", n, err)
+	}
+}
+
+func TestReaderStopped(t *testing.T) {
+	d, _ := newTestDownload(t)
+	r, err := d.NewReader(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.finish(nil)
+	if _, err := r.Read(make([]byte, 4)); err != ErrDownloadStopped {
+		t.Fatalf("expected ErrDownloadStopped, got %v", err)
+	}
+}
+
+func TestReaderStoppedWhileWaiting(t *testing.T) {
+	d, _ := newTestDownload(t)
+	r, err := d.NewReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// the download routine ends with its error once the picker is closed
+	go func() {
+		<-d.picker.Closed()
+		d.finish(ErrDownloadStopped)
+	}()
+
+	read := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 4))
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if err := d.Stop(); err != ErrDownloadStopped {
+		t.Fatalf("expected ErrDownloadStopped from Stop, got %v", err)
+	}
+	if err := <-read; err != ErrDownloadStopped {
+		t.Fatalf("expected ErrDownloadStopped from the blocked read, got %v", err)
+	}
+}
+
+func TestDownloadAnnouncesLeft(t *testing.T) {
+	var mu sync.Mutex
+	var announces []url.Values
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		announces = append(announces, r.URL.Query())
+		mu.Unlock()
+		w.Write([]byte("d8:intervali60e5:peers0:e"))
+	}))
+	defer tracker.Close()
+
+	tr, _ := testTorrent(t, tracker.URL+"/announce")
+	storage, err := torrent.NewMemoryStorage(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// only a.bin is wanted, which is in pieces 0 to 2
+	df := NewDownloadFileServiceWithOptions(DownloadOptions{
+		Files: torrent.FileSelection{Exclude: []string{"b.bin"}},
+	})
+	storage.MarkComplete(0)
+	storage.MarkComplete(1)
+
+	events := func() map[string]string {
+		mu.Lock()
+		defer mu.Unlock()
+		left := make(map[string]string)
+		for _, a := range announces {
+			left[a.Get("event")] = a.Get("left")
+		}
+		announces = nil
+		return left
+	}
+
+	if err := df.DownloadToStorage(tr, storage); err == nil {
+		t.Fatal("expected the download to fail without peers")
+	}
+	if got := events()["started"]; got != "16" {
+		t.Errorf("left %s announced, want the 16 bytes of the missing wanted piece", got)
+	}
+
+	// a torrent already complete is not announced as completed again
+	storage.MarkComplete(2)
+	if err := df.DownloadToStorage(tr, storage); err != nil {
+		t.Fatal(err)
+	}
+	got := events()
+	if got["started"] != "0" {
+		t.Errorf("left %s announced for a complete torrent", got["started"])
+	}
+	if _, ok := got["completed"]; ok {
+		t.Error("completed event sent for a torrent complete from the start")
+	}
+}
+
+func TestDownloadPeersFromDHT(t *testing.T) {
+	// the logger of the peer connections is set by the CLI
+	Logger = log.NewLogger(log.NORMAL)
+
+	// a peer that hangs up on every connection
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed := make(chan struct{}, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+			select {
+			case dialed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	nodes := make([]*dht.DHT, 2)
+	for i := range nodes {
+		nodes[i], err = dht.New(dht.Options{Addr: "127.0.0.1:0", Bootstrap: []string{}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nodes[i].Close()
+	}
+	if err := nodes[0].AddNode(nodes[1].Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, private := range []bool{false, true} {
+		// the tracker is unreachable, the peer was only announced to the DHT
+		encoded := testtorrent.Encode(t, testtorrent.Options{Announce: "http://127.0.0.1:1/announce", Length: 32, Private: private})
+		tr, err := torrent.NewSingleTorrentFile(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		infohash, _ := tr.InfoHash()
+		if _, err := nodes[1].Announce(infohash, l.Addr().(*net.TCPAddr).Port); err != nil {
+			t.Fatal(err)
+		}
+		storage, err := torrent.NewMemoryStorage(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		df := NewDownloadFileServiceWithOptions(DownloadOptions{DHT: nodes[0]})
+		d, err := df.StartDownload(tr, storage)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if private {
+			// private torrents only get peers from their trackers
+			if err := d.Wait(); err == nil || err == ErrDownloadStopped {
+				t.Fatalf("expected the tracker error, got %v", err)
+			}
+			continue
+		}
+		select {
+		case <-dialed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("the peer found on the DHT was not dialed")
+		}
+		if err := d.Stop(); err != ErrDownloadStopped {
+			t.Fatalf("expected ErrDownloadStopped, got %v", err)
+		}
+	}
+}
+
+// testSeeder is a peer having all the pieces of the torrent, which reports the
+// pieces requested and holds the first request until released
+type testSeeder struct {
+	l         net.Listener
+	data      []byte
+	infohash  []byte
+	requested chan int
+	release   chan struct{}
+}
+
+func newTestSeeder(t *testing.T, infohash, data []byte) *testSeeder {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &testSeeder{l: l, data: data, infohash: infohash, requested: make(chan int, 10), release: make(chan struct{})}
+	go func() {
+		for first := true; ; first = false {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c, first)
+		}
+	}()
+	return s
+}
+
+// peers returns the compact peers field of a tracker response with the seeder
+func (s *testSeeder) peers() string {
+	addr := s.l.Addr().(*net.TCPAddr)
+	b := append([]byte{}, addr.IP.To4()...)
+	return string(append(b, byte(addr.Port>>8), byte(addr.Port)))
+}
+
+func (s *testSeeder) serve(c net.Conn, first bool) {
+	defer c.Close()
+	if _, err := io.ReadFull(c, make([]byte, 68)); err != nil {
+		return
+	}
+	hs := append([]byte("\x13BitTorrent protocol"), make([]byte, 8)...)
+	hs = append(hs, s.infohash...)
+	c.Write(append(hs, "-TR2940-remotepeer12"...))
+
+	pieces := (len(s.data) + 15) / 16
+	bitfield := make([]byte, (pieces+7)/8)
+	for i := 0; i < pieces; i++ {
+		bitfield[i/8] |= 0x80 >> (i % 8)
+	}
+	writeMsg := func(id byte, payload []byte) {
+		buf := make([]byte, 5, 5+len(payload))
+		binary.BigEndian.PutUint32(buf, uint32(1+len(payload)))
+		buf[4] = id
+		c.Write(append(buf, payload...))
+	}
+	writeMsg(5, bitfield)
+	writeMsg(1, nil)
+
+	for {
+		lenBuf := make([]byte, 4)
+		if _, err := io.ReadFull(c, lenBuf); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(lenBuf))
+		if _, err := io.ReadFull(c, msg); err != nil {
+			return
+		}
+		// requests only, keep-alives and other messages are skipped
+		if len(msg) != 13 || msg[0] != 6 {
+			continue
+		}
+		idx := int(binary.BigEndian.Uint32(msg[1:]))
+		begin := int(binary.BigEndian.Uint32(msg[5:]))
+		length := int(binary.BigEndian.Uint32(msg[9:]))
+		s.requested <- idx
+		if first {
+			<-s.release
+			first = false
+		}
+		writeMsg(7, append(append([]byte{}, msg[1:9]...), s.data[idx*16+begin:idx*16+begin+length]...))
+	}
+}
+
+func TestDownloadPicksAfterWorkerSlot(t *testing.T) {
+	Logger = log.NewLogger(log.NORMAL)
+	var peers string
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali60e5:peers6:" + peers + "e"))
+	}))
+	defer tracker.Close()
+
+	tr, data := testTorrent(t, tracker.URL+"/announce")
+	infohash, _ := tr.InfoHash()
+	seeder := newTestSeeder(t, infohash, data)
+	peers = seeder.peers()
+	storage, err := torrent.NewMemoryStorage(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the only worker is busy with the first piece
+	df := NewDownloadFileServiceWithOptions(DownloadOptions{Workers: 1})
+	d, err := df.StartDownload(tr, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Stop()
+	if idx := <-seeder.requested; idx != 0 {
+		t.Fatalf("first piece requested is %d", idx)
+	}
+
+	// a reader of the end of b.bin wants the last piece next
+	r, err := d.NewReader(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := r.Seek(59, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	close(seeder.release)
+
+	select {
+	case idx := <-seeder.requested:
+		if idx != 6 {
+			t.Fatalf("piece %d requested after the reader moved to piece 6", idx)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no piece requested after the first one")
+	}
+}
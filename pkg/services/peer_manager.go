@@ -0,0 +1,426 @@
+package services
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+var ErrPeerManagerClosed = errors.New("peer manager is closed")
+var ErrAllPeersBanned = errors.New("all the peers known are banned")
+
+// PeerSource is where a peer was found. A peer found through several sources
+// has all of them set.
+type PeerSource uint8
+
+const (
+	SourceTracker PeerSource = 1 << iota
+	SourceDHT
+	SourcePEX
+	SourceLSD
+	SourceIncoming
+)
+
+var sourceNames = []string{"tracker", "dht", "pex", "lsd", "incoming"}
+
+func (s PeerSource) String() string {
+	var names []string
+	for i, name := range sourceNames {
+		if s&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// PeerState is the state of a known peer
+type PeerState int
+
+const (
+	// PeerIdle peers can be dialed
+	PeerIdle PeerState = iota
+	// PeerDialing peers have a connection being established
+	PeerDialing
+	PeerConnected
+	// PeerBackoff peers failed and are not dialed until their backoff ends
+	PeerBackoff
+	// PeerBanned peers are never dialed
+	PeerBanned
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerIdle:
+		return "idle"
+	case PeerDialing:
+		return "dialing"
+	case PeerConnected:
+		return "connected"
+	case PeerBackoff:
+		return "backoff"
+	case PeerBanned:
+		return "banned"
+	}
+	return "unknown"
+}
+
+// PeerInfo is the state of a peer known to a PeerManager
+type PeerInfo struct {
+	Addr     string
+	Sources  PeerSource
+	State    PeerState
+	Failures int
+	// Rate is the download rate of the peer in bytes per second, zero if
+	// nothing was downloaded from it yet
+	Rate float64
+}
+
+type PeerManagerOptions struct {
+	// MaxConns limits the connections open at once, including the half-open ones
+	MaxConns int
+	// MaxHalfOpen limits the connections being established at once
+	MaxHalfOpen int
+	// a peer that failed is not dialed for MinBackoff, doubled with every
+	// consecutive failure up to MaxBackoff
+	MinBackoff, MaxBackoff time.Duration
+	// Banned reports the peers that must not be dialed
+	Banned func(*torrent.Peer) bool
+}
+
+const (
+	defaultMaxHalfOpen = 4
+	defaultMinBackoff  = 2 * time.Second
+	defaultMaxBackoff  = 2 * time.Minute
+)
+
+// rateWeight is the weight of the last transfer in the rate of a peer
+const rateWeight = 0.3
+
+type knownPeer struct {
+	peer     *torrent.Peer
+	sources  PeerSource
+	state    PeerState
+	failures int
+	nextDial time.Time
+	rate     float64
+}
+
+// PeerManager keeps the peers known for a download and decides which one to
+// connect to next. Peers are deduplicated by address, peers that performed
+// well are preferred and peers that failed are backed off exponentially.
+type PeerManager struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	opts PeerManagerOptions
+
+	peers    map[string]*knownPeer
+	order    []*knownPeer
+	halfOpen int
+	conns    int
+	closed   bool
+
+	// wakes up Dial when the earliest backoff ends
+	timer    *time.Timer
+	deadline time.Time
+	now      func() time.Time
+}
+
+func NewPeerManager(opts PeerManagerOptions) *PeerManager {
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = defaultWorkers
+	}
+	if opts.MaxHalfOpen <= 0 {
+		opts.MaxHalfOpen = defaultMaxHalfOpen
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = defaultMaxBackoff
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+	pm := &PeerManager{
+		opts:  opts,
+		peers: make(map[string]*knownPeer),
+		now:   time.Now,
+	}
+	pm.cond = sync.NewCond(&pm.mu)
+	return pm
+}
+
+// Add adds peers found through the source, peers already known only get the
+// source added
+func (pm *PeerManager) Add(peers []*torrent.Peer, source PeerSource) {
+	pm.mu.Lock()
+	for _, p := range peers {
+		if kp, ok := pm.peers[p.Addr()]; ok {
+			kp.sources |= source
+			continue
+		}
+		kp := &knownPeer{peer: p, sources: source}
+		pm.peers[p.Addr()] = kp
+		pm.order = append(pm.order, kp)
+	}
+	pm.mu.Unlock()
+	pm.cond.Broadcast()
+}
+
+// Len returns the number of peers known
+func (pm *PeerManager) Len() int {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return len(pm.order)
+}
+
+// Peers returns the state of the peers known, in the order they were found
+func (pm *PeerManager) Peers() []PeerInfo {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	infos := make([]PeerInfo, 0, len(pm.order))
+	for _, kp := range pm.order {
+		infos = append(infos, PeerInfo{
+			Addr:     kp.peer.Addr(),
+			Sources:  kp.sources,
+			State:    kp.state,
+			Failures: kp.failures,
+			Rate:     kp.rate,
+		})
+	}
+	return infos
+}
+
+// Dial blocks until a peer can be connected to and returns it, in the dialing
+// state. The caller reports the outcome with Connected, Failed or Done. It
+// fails when the manager was closed, or when all the peers known are banned
+// since none of them can be dialed anymore.
+func (pm *PeerManager) Dial() (*torrent.Peer, error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for !pm.closed {
+		if pm.halfOpen < pm.opts.MaxHalfOpen && pm.halfOpen+pm.conns < pm.opts.MaxConns {
+			if kp := pm.best(); kp != nil {
+				kp.state = PeerDialing
+				pm.halfOpen++
+				return kp.peer, nil
+			}
+		}
+		if pm.allBanned() {
+			return nil, ErrAllPeersBanned
+		}
+		pm.cond.Wait()
+	}
+	return nil, ErrPeerManagerClosed
+}
+
+// Accept records the connection a peer opened to us, in the connected state,
+// and reports whether it can be kept. It is turned down when the manager has
+// MaxConns connections, or when the peer is banned or already has one. Peers
+// are accepted after Close, which only stops dialing. The caller reports the
+// outcome like for Dial.
+func (pm *PeerManager) Accept(p *torrent.Peer) bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	if pm.halfOpen+pm.conns >= pm.opts.MaxConns {
+		return false
+	}
+	kp, ok := pm.peers[p.Addr()]
+	if !ok {
+		if pm.opts.Banned != nil && pm.opts.Banned(p) {
+			return false
+		}
+		kp = &knownPeer{peer: p}
+		pm.peers[p.Addr()] = kp
+		pm.order = append(pm.order, kp)
+	} else if pm.banned(kp) || kp.state == PeerDialing || kp.state == PeerConnected {
+		return false
+	}
+	kp.sources |= SourceIncoming
+	kp.state = PeerConnected
+	pm.conns++
+	return true
+}
+
+// AllBanned reports whether peers are known and all of them are banned
+func (pm *PeerManager) AllBanned() bool {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	return pm.allBanned()
+}
+
+func (pm *PeerManager) allBanned() bool {
+	for _, kp := range pm.order {
+		if !pm.banned(kp) {
+			return false
+		}
+	}
+	return len(pm.order) > 0
+}
+
+// banned reports whether the peer is banned, moving it to the banned state.
+// Peers connected are only moved once their connection is over.
+func (pm *PeerManager) banned(kp *knownPeer) bool {
+	if kp.state == PeerIdle || kp.state == PeerBackoff {
+		if pm.opts.Banned != nil && pm.opts.Banned(kp.peer) {
+			kp.state = PeerBanned
+		}
+	}
+	return kp.state == PeerBanned
+}
+
+// best returns the peer to dial next, or nil if none can be dialed now. Peers
+// never tried come first, then the fastest ones, and peers that only failed
+// last.
+func (pm *PeerManager) best() *knownPeer {
+	now := pm.now()
+	var best *knownPeer
+	var wake time.Time
+	for _, kp := range pm.order {
+		// peers only known from their connection to us listen on another port
+		if kp.sources == SourceIncoming || pm.banned(kp) {
+			continue
+		}
+		if kp.state == PeerBackoff {
+			if now.Before(kp.nextDial) {
+				if wake.IsZero() || kp.nextDial.Before(wake) {
+					wake = kp.nextDial
+				}
+				continue
+			}
+			kp.state = PeerIdle
+		}
+		if kp.state != PeerIdle {
+			continue
+		}
+		if best == nil || better(kp, best) {
+			best = kp
+		}
+	}
+	if best == nil && !wake.IsZero() {
+		pm.wakeAt(wake)
+	}
+	return best
+}
+
+func better(a, b *knownPeer) bool {
+	rank := func(kp *knownPeer) int {
+		switch {
+		case kp.rate == 0 && kp.failures == 0:
+			return 2
+		case kp.rate > 0:
+			return 1
+		}
+		return 0
+	}
+	if rank(a) != rank(b) {
+		return rank(a) > rank(b)
+	}
+	if a.rate != b.rate {
+		return a.rate > b.rate
+	}
+	return a.failures < b.failures
+}
+
+// wakeAt wakes up the goroutines waiting in Dial at t
+func (pm *PeerManager) wakeAt(t time.Time) {
+	if pm.timer != nil && !pm.deadline.After(t) {
+		return
+	}
+	if pm.timer != nil {
+		pm.timer.Stop()
+	}
+	pm.deadline = t
+	pm.timer = time.AfterFunc(t.Sub(pm.now()), func() {
+		pm.mu.Lock()
+		pm.timer = nil
+		pm.mu.Unlock()
+		pm.cond.Broadcast()
+	})
+}
+
+// Connected records that the connection to a peer was established
+func (pm *PeerManager) Connected(p *torrent.Peer) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	kp, ok := pm.peers[p.Addr()]
+	if !ok || kp.state != PeerDialing {
+		return
+	}
+	kp.state = PeerConnected
+	pm.halfOpen--
+	pm.conns++
+}
+
+// Failed records that dialing a peer or the transfer over its connection
+// failed, and backs the peer off
+func (pm *PeerManager) Failed(p *torrent.Peer) {
+	pm.mu.Lock()
+	kp, ok := pm.peers[p.Addr()]
+	if ok && pm.release(kp) {
+		kp.failures++
+		backoff := pm.opts.MinBackoff
+		for i := 1; i < kp.failures && backoff < pm.opts.MaxBackoff; i++ {
+			backoff *= 2
+		}
+		if backoff > pm.opts.MaxBackoff {
+			backoff = pm.opts.MaxBackoff
+		}
+		kp.state = PeerBackoff
+		kp.nextDial = pm.now().Add(backoff)
+	}
+	pm.mu.Unlock()
+	pm.cond.Broadcast()
+}
+
+// Done records that n bytes were downloaded from a peer in elapsed time and
+// that its connection was closed
+func (pm *PeerManager) Done(p *torrent.Peer, n int64, elapsed time.Duration) {
+	pm.mu.Lock()
+	kp, ok := pm.peers[p.Addr()]
+	if ok && pm.release(kp) {
+		kp.state = PeerIdle
+		kp.failures = 0
+		if n > 0 && elapsed > 0 {
+			rate := float64(n) / elapsed.Seconds()
+			if kp.rate == 0 {
+				kp.rate = rate
+			} else {
+				kp.rate = (1-rateWeight)*kp.rate + rateWeight*rate
+			}
+		}
+	}
+	pm.mu.Unlock()
+	pm.cond.Broadcast()
+}
+
+// release frees the connection slot held by a peer, returning false if it
+// held none
+func (pm *PeerManager) release(kp *knownPeer) bool {
+	switch kp.state {
+	case PeerDialing:
+		pm.halfOpen--
+	case PeerConnected:
+		pm.conns--
+	default:
+		return false
+	}
+	return true
+}
+
+// Close wakes up the goroutines waiting in Dial, which then return false
+func (pm *PeerManager) Close() {
+	pm.mu.Lock()
+	pm.closed = true
+	if pm.timer != nil {
+		pm.timer.Stop()
+		pm.timer = nil
+	}
+	pm.mu.Unlock()
+	pm.cond.Broadcast()
+}
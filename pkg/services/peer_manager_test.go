@@ -0,0 +1,227 @@
+package services
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+func testPeers(ports ...uint16) []*torrent.Peer {
+	var peers []*torrent.Peer
+	for _, port := range ports {
+		peers = append(peers, &torrent.Peer{IP: net.IPv4(127, 0, 0, 1), Port: port})
+	}
+	return peers
+}
+
+func TestPeerManagerDeduplicates(t *testing.T) {
+	pm := NewPeerManager(PeerManagerOptions{})
+	pm.Add(testPeers(1, 2), SourceTracker)
+	pm.Add(testPeers(2, 3), SourcePEX)
+
+	infos := pm.Peers()
+	if len(infos) != 3 {
+		t.Fatalf("got %d peers, want 3", len(infos))
+	}
+	if infos[1].Sources != SourceTracker|SourcePEX {
+		t.Errorf("sources of the peer found twice are %v", infos[1].Sources)
+	}
+	if got := infos[1].Sources.String(); got != "tracker,pex" {
+		t.Errorf("sources printed as %q", got)
+	}
+}
+
+// dialNow dials without blocking, returning nil if no peer can be dialed
+func dialNow(t *testing.T, pm *PeerManager) *torrent.Peer {
+	dialed := make(chan *torrent.Peer, 1)
+	go func() {
+		p, _ := pm.Dial()
+		dialed <- p
+	}()
+	select {
+	case p := <-dialed:
+		return p
+	case <-time.After(50 * time.Millisecond):
+		pm.Close()
+		<-dialed
+		return nil
+	}
+}
+
+func TestPeerManagerLimits(t *testing.T) {
+	pm := NewPeerManager(PeerManagerOptions{MaxConns: 3, MaxHalfOpen: 2})
+	pm.Add(testPeers(1, 2, 3, 4), SourceTracker)
+
+	a, _ := pm.Dial()
+	b, _ := pm.Dial()
+	if a.Port == b.Port {
+		t.Fatal("the same peer was dialed twice")
+	}
+	// two connections are half-open
+	if p := dialNow(t, pm); p != nil {
+		t.Fatalf("dialed %v over the half-open limit", p.Addr())
+	}
+
+	pm = NewPeerManager(PeerManagerOptions{MaxConns: 3, MaxHalfOpen: 2})
+	pm.Add(testPeers(1, 2, 3, 4), SourceTracker)
+	for i := 0; i < 3; i++ {
+		p, _ := pm.Dial()
+		pm.Connected(p)
+	}
+	if p := dialNow(t, pm); p != nil {
+		t.Fatalf("dialed %v over the connection limit", p.Addr())
+	}
+}
+
+func TestPeerManagerBackoff(t *testing.T) {
+	now := time.Unix(0, 0)
+	pm := NewPeerManager(PeerManagerOptions{MinBackoff: time.Second, MaxBackoff: 3 * time.Second})
+	pm.now = func() time.Time { return now }
+	pm.Add(testPeers(1), SourceTracker)
+
+	wantNext := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 3 * time.Second}
+	for i, want := range wantNext {
+		p, _ := pm.Dial()
+		pm.Failed(p)
+		if got := pm.peers[p.Addr()].nextDial.Sub(now); got != want {
+			t.Errorf("failure %d: backoff %v, want %v", i+1, got, want)
+		}
+		if pm.best() != nil {
+			t.Fatalf("failure %d: peer dialable during its backoff", i+1)
+		}
+		now = now.Add(want)
+	}
+	pm.Close()
+}
+
+func TestPeerManagerBackoffWakesDial(t *testing.T) {
+	pm := NewPeerManager(PeerManagerOptions{MinBackoff: 20 * time.Millisecond})
+	pm.Add(testPeers(1), SourceTracker)
+	p, _ := pm.Dial()
+	pm.Failed(p)
+
+	start := time.Now()
+	if p, err := pm.Dial(); err != nil || p.Port != 1 {
+		t.Fatal("peer not dialed again after its backoff")
+	}
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("peer dialed again after %v", elapsed)
+	}
+}
+
+func TestPeerManagerPrefersFastPeers(t *testing.T) {
+	pm := NewPeerManager(PeerManagerOptions{MinBackoff: time.Hour})
+	pm.Add(testPeers(1, 2, 3), SourceTracker)
+
+	// all peers are tried once, peer 3 fails
+	rates := map[uint16]int64{1: 100, 2: 1000}
+	for i := 0; i < 3; i++ {
+		p, _ := pm.Dial()
+		if p.Port == 3 {
+			pm.Failed(p)
+			continue
+		}
+		pm.Connected(p)
+		pm.Done(p, rates[p.Port], time.Second)
+	}
+	pm.peers[testPeers(3)[0].Addr()].nextDial = time.Time{}
+
+	// and the fastest peer is dialed first, the one that failed last
+	for _, want := range []uint16{2, 1, 3} {
+		p, _ := pm.Dial()
+		if p.Port != want {
+			t.Fatalf("dialed peer %d, want %d", p.Port, want)
+		}
+	}
+}
+
+func TestPeerManagerSkipsBannedPeers(t *testing.T) {
+	bans := NewBanList()
+	pm := NewPeerManager(PeerManagerOptions{Banned: bans.IsBanned})
+	pm.Add([]*torrent.Peer{{IP: net.IPv4(10, 0, 0, 1), Port: 1}}, SourceTracker)
+	pm.Add(testPeers(2), SourceTracker)
+	bans.Ban(Ban{IP: "127.0.0.1"})
+
+	if p, _ := pm.Dial(); p.Port != 1 {
+		t.Fatalf("dialed peer %v", p.Addr())
+	}
+	if p := dialNow(t, pm); p != nil {
+		t.Fatalf("dialed banned peer %v", p.Addr())
+	}
+	if state := pm.Peers()[1].State; state != PeerBanned {
+		t.Errorf("banned peer is %v", state)
+	}
+}
+
+func TestPeerManagerAllBanned(t *testing.T) {
+	bans := NewBanList()
+	pm := NewPeerManager(PeerManagerOptions{MinBackoff: time.Hour, Banned: bans.IsBanned})
+	pm.Add(testPeers(1, 2), SourceTracker)
+
+	p, _ := pm.Dial()
+	pm.Failed(p)
+	p, _ = pm.Dial()
+	pm.Connected(p)
+
+	// a waiting Dial fails once the last peer is banned, including the one
+	// backing off
+	dialed := make(chan error)
+	go func() {
+		_, err := pm.Dial()
+		dialed <- err
+	}()
+	bans.Ban(Ban{IP: "127.0.0.1"})
+	pm.Done(p, 10, time.Second)
+
+	select {
+	case err := <-dialed:
+		if err != ErrAllPeersBanned {
+			t.Fatalf("expected ErrAllPeersBanned, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Dial blocked with all the peers banned")
+	}
+	if !pm.AllBanned() {
+		t.Error("peers not reported as all banned")
+	}
+}
+
+func TestPeerManagerAccept(t *testing.T) {
+	bans := NewBanList()
+	pm := NewPeerManager(PeerManagerOptions{MaxConns: 2, Banned: bans.IsBanned})
+	pm.Add(testPeers(1), SourceTracker)
+	bans.Ban(Ban{IP: "10.0.0.1"})
+
+	if pm.Accept(&torrent.Peer{IP: net.IPv4(10, 0, 0, 1), Port: 2}) {
+		t.Fatal("accepted a banned peer")
+	}
+	incoming := testPeers(2)[0]
+	if !pm.Accept(incoming) {
+		t.Fatal("incoming peer turned down")
+	}
+	if pm.Accept(incoming) {
+		t.Fatal("accepted a peer already connected")
+	}
+	known, _ := pm.Dial()
+	pm.Connected(known)
+	// connections to us count towards the limit
+	if pm.Accept(testPeers(3)[0]) {
+		t.Fatal("accepted a peer over the connection limit")
+	}
+
+	// the port of incoming peers is not the one they listen on, they are
+	// never dialed
+	pm.Done(incoming, 10, time.Second)
+	pm.Done(known, 10, time.Second)
+	if p, _ := pm.Dial(); p != known {
+		t.Fatalf("dialed %v", p.Addr())
+	}
+	if p := dialNow(t, pm); p != nil {
+		t.Fatalf("dialed incoming peer %v", p.Addr())
+	}
+	if infos := pm.Peers(); infos[1].Sources != SourceIncoming {
+		t.Errorf("incoming peer has sources %v", infos[1].Sources)
+	}
+}
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// priorityReadahead is given to the pieces just ahead of the position of
+// readers, above the priorities of files
+const priorityReadahead = torrent.PriorityHigh + 1
+
+// piecePicker hands out the indexes of the pieces left to download to the
+// download workers. Pieces of higher priority are handed out first, and among
+// pieces of the same priority the ones suggested by peers.
+type piecePicker struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	queue      []int
+	priorities []torrent.Priority
+	remaining  int
+	closed     bool
+	// stopped is closed along with the picker
+	stopped chan struct{}
+
+	complete func(int) bool
+	// readahead windows of readers by id, as ranges of piece indexes
+	windows map[int][2]int
+}
+
+// newPiecePicker returns a picker for the pieces that are not complete yet.
+// Pieces with PrioritySkip are left out, and all pieces have the normal priority
+// if priorities is nil.
+func newPiecePicker(noOfPieces int, complete func(int) bool, priorities []torrent.Priority) *piecePicker {
+	pp := &piecePicker{
+		priorities: priorities,
+		complete:   complete,
+		windows:    make(map[int][2]int),
+		stopped:    make(chan struct{}),
+	}
+	pp.cond = sync.NewCond(&pp.mu)
+	for i := 0; i < noOfPieces; i++ {
+		if !complete(i) && pp.priority(i) != torrent.PrioritySkip {
+			pp.queue = append(pp.queue, i)
+		}
+	}
+	pp.remaining = len(pp.queue)
+	return pp
+}
+
+// Next blocks until a piece is available to download and returns its index.
+// The second value is false when all the pieces have been downloaded.
+func (pp *piecePicker) Next() (int, bool) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	for len(pp.queue) == 0 && pp.remaining > 0 && !pp.closed {
+		pp.cond.Wait()
+	}
+	if pp.remaining == 0 || pp.closed {
+		return 0, false
+	}
+
+	next := 0
+	for i, idx := range pp.queue {
+		if pp.priority(idx) > pp.priority(pp.queue[next]) {
+			next = i
+		}
+	}
+	idx := pp.queue[next]
+	pp.queue = append(pp.queue[:next], pp.queue[next+1:]...)
+	return idx, true
+}
+
+func (pp *piecePicker) priority(idx int) torrent.Priority {
+	for _, w := range pp.windows {
+		if w[0] <= idx && idx <= w[1] {
+			return priorityReadahead
+		}
+	}
+	if pp.priorities == nil {
+		return torrent.PriorityNormal
+	}
+	return pp.priorities[idx]
+}
+
+// Wanted reports whether the piece is to be downloaded, that is not skipped
+func (pp *piecePicker) Wanted(idx int) bool {
+	return pp.priorities == nil || pp.priorities[idx] != torrent.PrioritySkip
+}
+
+// Retry puts a piece whose download failed back in the queue
+func (pp *piecePicker) Retry(idx int) {
+	pp.mu.Lock()
+	pp.queue = append(pp.queue, idx)
+	pp.mu.Unlock()
+	pp.cond.Signal()
+}
+
+// Done marks a piece as downloaded
+func (pp *piecePicker) Done(idx int) {
+	pp.mu.Lock()
+	pp.remaining--
+	pp.mu.Unlock()
+	pp.cond.Broadcast()
+}
+
+// Finished reports whether all the pieces have been downloaded
+func (pp *piecePicker) Finished() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.remaining == 0
+}
+
+// Wait blocks until all the pieces have been downloaded
+func (pp *piecePicker) Wait() {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for pp.remaining > 0 && !pp.closed {
+		pp.cond.Wait()
+	}
+}
+
+// WaitPiece blocks until the piece is complete. It returns false if the picker
+// was closed before that.
+func (pp *piecePicker) WaitPiece(idx int) bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for !pp.complete(idx) {
+		if pp.closed {
+			return false
+		}
+		pp.cond.Wait()
+	}
+	return true
+}
+
+// Close stops handing out pieces and wakes up everyone waiting on the picker
+func (pp *piecePicker) Close() {
+	pp.mu.Lock()
+	if !pp.closed {
+		pp.closed = true
+		close(pp.stopped)
+	}
+	pp.mu.Unlock()
+	pp.cond.Broadcast()
+}
+
+// Closed returns a channel that is closed when the picker is closed
+func (pp *piecePicker) Closed() <-chan struct{} {
+	return pp.stopped
+}
+
+// Stopped reports whether the picker was closed before all the pieces were
+// downloaded
+func (pp *piecePicker) Stopped() bool {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	return pp.closed && pp.remaining > 0
+}
+
+// SetWindow sets the readahead window of a reader to the pieces from first to
+// last, which are handed out before any other
+func (pp *piecePicker) SetWindow(id, first, last int) {
+	pp.mu.Lock()
+	pp.windows[id] = [2]int{first, last}
+	pp.mu.Unlock()
+}
+
+// RemoveWindow removes the readahead window of a reader
+func (pp *piecePicker) RemoveWindow(id int) {
+	pp.mu.Lock()
+	delete(pp.windows, id)
+	pp.mu.Unlock()
+}
+
+// Suggest moves a queued piece to the front of the queue. It is used as a hint
+// for the pieces peers sent suggest_piece messages for.
+func (pp *piecePicker) Suggest(idx int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	for i, queued := range pp.queue {
+		if queued == idx {
+			copy(pp.queue[1:i+1], pp.queue[:i])
+			pp.queue[0] = idx
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package services
+
+import (
+	"encoding/hex"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+// ScrapeResult holds the swarm counters of one torrent, or the error that
+// prevented getting them
+type ScrapeResult struct {
+	Path     string `json:"path"`
+	Name     string `json:"name"`
+	InfoHash string `json:"infohash"`
+	Tracker  string `json:"tracker"`
+	Seeders  int    `json:"seeders"`
+	Leechers int    `json:"leechers"`
+	// number of completed downloads reported by the tracker
+	Completed int    `json:"completed"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ScrapeService interface {
+	Scrape([]string) []*ScrapeResult
+}
+
+type scrapeServiceImpl struct {
+}
+
+func NewScrapeService() ScrapeService {
+	return &scrapeServiceImpl{}
+}
+
+// Scrape gets the swarm counters of the given torrent files. Torrents sharing a
+// tracker are scraped with a single request.
+func (ss *scrapeServiceImpl) Scrape(torrentFiles []string) []*ScrapeResult {
+	results := make([]*ScrapeResult, len(torrentFiles))
+	infohashes := make([][]byte, len(torrentFiles))
+	// indexes of the results grouped by tracker
+	byTracker := make(map[string][]int)
+	var trackers []string
+
+	for i, path := range torrentFiles {
+		results[i] = &ScrapeResult{Path: path}
+
+		t, err := torrent.NewSingleTorrentFromFile(path)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		ih, err := t.InfoHash()
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].Name, _ = t.Name()
+		results[i].InfoHash = hex.EncodeToString(ih)
+		results[i].Tracker = t.Announce()
+		infohashes[i] = ih
+
+		if _, ok := byTracker[t.Announce()]; !ok {
+			trackers = append(trackers, t.Announce())
+		}
+		byTracker[t.Announce()] = append(byTracker[t.Announce()], i)
+	}
+
+	for _, tracker := range trackers {
+		idxs := byTracker[tracker]
+		hashes := make([][]byte, len(idxs))
+		for j, idx := range idxs {
+			hashes[j] = infohashes[idx]
+		}
+
+		stats, err := torrent.Scrape(tracker, hashes)
+		for _, idx := range idxs {
+			if err != nil {
+				results[idx].Error = err.Error()
+				continue
+			}
+			s, ok := stats[string(infohashes[idx])]
+			if !ok {
+				results[idx].Error = "torrent not known to tracker"
+				continue
+			}
+			results[idx].Seeders = s.Complete
+			results[idx].Leechers = s.Incomplete
+			results[idx].Completed = s.Downloaded
+		}
+	}
+
+	return results
+}
@@ -0,0 +1,549 @@
+// Package session downloads many torrents at once, sharing connection limits,
+// a listener for incoming peers, a DHT node and a queue deciding which
+// torrents are active
+package session
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/conn"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/dht"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/services"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+const (
+	defaultMaxActive = 3
+	defaultMaxConns  = 50
+)
+
+var ErrTorrentExists = errors.New("torrent already in session")
+var ErrUnknownTorrent = errors.New("torrent not in session")
+var ErrSessionClosed = errors.New("session is closed")
+
+// State of a torrent in the session
+type State int
+
+const (
+	// Queued torrents wait for one of the active ones to finish
+	Queued State = iota
+	Active
+	Paused
+	Completed
+	Failed
+)
+
+func (s State) String() string {
+	switch s {
+	case Queued:
+		return "queued"
+	case Active:
+		return "active"
+	case Paused:
+		return "paused"
+	case Completed:
+		return "completed"
+	case Failed:
+		return "failed"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Options configures a session
+type Options struct {
+	// Storage opens the storage of the torrents added, file storage in the
+	// working directory if nil
+	Storage torrent.StorageOpener
+	// MaxActive is the number of torrents downloading at once
+	MaxActive int
+	// MaxConns is the number of peer connections open at once across torrents
+	MaxConns int
+	// ConnsPerTorrent is the number of peer connections of each torrent
+	ConnsPerTorrent int
+	// rates in bytes per second of the whole session, of each torrent and of
+	// each peer connection, zero for unlimited
+	DownloadRate, UploadRate               int64
+	TorrentDownloadRate, TorrentUploadRate int64
+	PeerDownloadRate, PeerUploadRate       int64
+	// RateSchedule overrides DownloadRate and UploadRate at times of day
+	RateSchedule ratelimit.Schedule
+	// Bans holds the peers banned for sending bad data, use
+	// services.LoadBanList to keep them across sessions. The bans only last
+	// for the session if nil.
+	Bans *services.BanList
+	// Listener accepts the connections of peers for all the torrents, which
+	// announce its port to their trackers. The session closes it on Close.
+	// No connections are accepted if nil.
+	Listener net.Listener
+	// DHT finds peers for the public torrents, announcing the port of the
+	// listener. The session closes it on Close. It isn't used if nil.
+	DHT *dht.DHT
+}
+
+// Status is a snapshot of a torrent in the session
+type Status struct {
+	InfoHash string
+	Name     string
+	State    State
+	// Err is set for failed torrents
+	Err error
+	// pieces downloaded out of all the pieces
+	Completed int
+	Pieces    int
+}
+
+// Session is a long lived client managing many torrents. Torrents are queued in
+// the order they are added and downloaded MaxActive at a time, with the peer
+// connections limited across all of them. Peers connecting to the listener
+// of the session are handed to the active torrent they ask for, and the
+// torrents share the DHT node of the session.
+type Session struct {
+	opts    Options
+	service services.DownloadFileService
+	limits  services.RateLimits
+	logger  log.Logger
+	// closed once the listener stopped accepting connections
+	accepting chan struct{}
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	torrents map[string]*entry
+	order    []string
+	closed   bool
+	// torrents removed whose download is still stopping
+	removing map[string]bool
+}
+
+// entry is a torrent of the session
+type entry struct {
+	id       string
+	name     string
+	torrent  torrent.Torrent
+	storage  torrent.Storage
+	download *services.Download
+	// stopping is the download paused, whose workers may still write to
+	// storage. No download is started until it is over.
+	stopping *services.Download
+	state    State
+	err      error
+	pieces   int
+
+	// rates set for the torrent, applied to every download of it
+	downRate, upRate *int64
+}
+
+func New(opts Options) *Session {
+	if opts.Storage == nil {
+		opts.Storage = torrent.FileStorageOpener(".")
+	}
+	if opts.MaxActive <= 0 {
+		opts.MaxActive = defaultMaxActive
+	}
+	if opts.MaxConns <= 0 {
+		opts.MaxConns = defaultMaxConns
+	}
+	limits := services.RateLimits{
+		Download:        ratelimit.NewLimiter(opts.DownloadRate),
+		Upload:          ratelimit.NewLimiter(opts.UploadRate),
+		TorrentDownload: ratelimit.NewLimiter(opts.TorrentDownloadRate),
+		TorrentUpload:   ratelimit.NewLimiter(opts.TorrentUploadRate),
+		PeerDownload:    ratelimit.NewLimiter(opts.PeerDownloadRate),
+		PeerUpload:      ratelimit.NewLimiter(opts.PeerUploadRate),
+	}
+	if opts.Bans == nil {
+		opts.Bans = services.NewBanList()
+	}
+	if opts.RateSchedule != nil {
+		limits.Download.SetSchedule(opts.RateSchedule)
+		limits.Upload.SetSchedule(opts.RateSchedule)
+	}
+	port := 0
+	if opts.Listener != nil {
+		if addr, ok := opts.Listener.Addr().(*net.TCPAddr); ok {
+			port = addr.Port
+		}
+	}
+	s := &Session{
+		opts:   opts,
+		limits: limits,
+		logger: log.NewLogger(log.NORMAL),
+		service: services.NewDownloadFileServiceWithOptions(services.DownloadOptions{
+			Workers: opts.ConnsPerTorrent,
+			Conns:   services.NewConnLimiter(opts.MaxConns),
+			Limits:  limits,
+			Bans:    opts.Bans,
+			Port:    port,
+			DHT:     opts.DHT,
+		}),
+		torrents:  make(map[string]*entry),
+		removing:  make(map[string]bool),
+		accepting: make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	if opts.Listener != nil {
+		go s.listen()
+	} else {
+		close(s.accepting)
+	}
+	return s
+}
+
+// listen accepts the connections of peers until the listener is closed
+func (s *Session) listen() {
+	defer close(s.accepting)
+	for {
+		c, err := s.opts.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go s.handshake(c)
+	}
+}
+
+// handshake reads the handshake of a peer that connected to us and hands the
+// connection to the download of the torrent it asks for. It is closed if the
+// torrent isn't active in the session.
+func (s *Session) handshake(c net.Conn) {
+	in, err := conn.ReadHandshake(c)
+	if err != nil {
+		s.logger.Debug("incoming connection from", c.RemoteAddr(), ":", err)
+		c.Close()
+		return
+	}
+
+	s.mu.Lock()
+	var d *services.Download
+	if e, ok := s.torrents[hex.EncodeToString(in.InfoHash())]; ok {
+		d = e.download
+	}
+	s.mu.Unlock()
+
+	if d == nil || d.Accept(in) != nil {
+		in.Close()
+	}
+}
+
+// Add queues a torrent for download and returns its hex infohash, used to
+// refer to it afterwards
+func (s *Session) Add(t torrent.Torrent) (string, error) {
+	hash, err := t.InfoHash()
+	if err != nil {
+		return "", err
+	}
+	name, err := t.Name()
+	if err != nil {
+		return "", err
+	}
+	pieces, err := t.Pieces()
+	if err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(hash)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the storage of a torrent being removed is closed first
+	for s.removing[id] && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return "", ErrSessionClosed
+	}
+	if _, ok := s.torrents[id]; ok {
+		return "", ErrTorrentExists
+	}
+	storage, err := s.opts.Storage(t)
+	if err != nil {
+		return "", err
+	}
+	s.torrents[id] = &entry{id: id, name: name, torrent: t, storage: storage, pieces: len(pieces)}
+	s.order = append(s.order, id)
+	s.schedule()
+	return id, nil
+}
+
+// Remove stops the torrent and removes it from the session. Its downloaded
+// files are left in place.
+func (s *Session) Remove(id string) error {
+	s.mu.Lock()
+	e, ok := s.torrents[id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrUnknownTorrent
+	}
+	delete(s.torrents, id)
+	for i, queued := range s.order {
+		if queued == id {
+			s.order = append(s.order[:i], s.order[i+1:]...)
+			break
+		}
+	}
+	d, stopping := e.download, e.stopping
+	e.download = nil
+	s.removing[id] = true
+	s.schedule()
+	s.mu.Unlock()
+
+	// the download is over, with nothing writing to storage, once Stop returns
+	if d != nil {
+		d.Stop()
+	}
+	if stopping != nil {
+		stopping.Wait()
+	}
+	err := e.storage.Close()
+
+	s.mu.Lock()
+	delete(s.removing, id)
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	return err
+}
+
+// Pause stops downloading the torrent, or keeps it from starting if queued.
+// Pieces already downloaded are kept.
+func (s *Session) Pause(id string) error {
+	s.mu.Lock()
+	e, ok := s.torrents[id]
+	if !ok {
+		s.mu.Unlock()
+		return ErrUnknownTorrent
+	}
+	if e.state != Queued && e.state != Active {
+		s.mu.Unlock()
+		return nil
+	}
+	d := e.download
+	e.download = nil
+	// a torrent paused again before its previous download stopped keeps
+	// waiting for that one
+	if d != nil {
+		e.stopping = d
+	}
+	e.state = Paused
+	s.schedule()
+	s.mu.Unlock()
+
+	if d != nil {
+		d.Stop()
+	}
+	return nil
+}
+
+// Resume queues a paused or failed torrent again
+func (s *Session) Resume(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.torrents[id]
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	if e.state == Paused || e.state == Failed {
+		e.state = Queued
+		e.err = nil
+		s.schedule()
+	}
+	return nil
+}
+
+// Limits returns the rate limiters of the whole session, whose rates and
+// schedules can be changed at any time. The per torrent and per peer rates
+// follow TorrentLimits and PeerLimits unless set for a torrent.
+func (s *Session) Limits() (download, upload *ratelimit.Limiter) {
+	return s.limits.Download, s.limits.Upload
+}
+
+// Bans returns the peers banned in the session
+func (s *Session) Bans() []services.Ban {
+	return s.opts.Bans.Bans()
+}
+
+// TorrentLimits returns the limiters holding the default rates of each torrent
+func (s *Session) TorrentLimits() (download, upload *ratelimit.Limiter) {
+	return s.limits.TorrentDownload, s.limits.TorrentUpload
+}
+
+// PeerLimits returns the limiters holding the rates of each peer connection
+func (s *Session) PeerLimits() (download, upload *ratelimit.Limiter) {
+	return s.limits.PeerDownload, s.limits.PeerUpload
+}
+
+// SetTorrentRates sets the rates of a torrent in bytes per second, zero for
+// unlimited, in place of the default ones
+func (s *Session) SetTorrentRates(id string, download, upload int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.torrents[id]
+	if !ok {
+		return ErrUnknownTorrent
+	}
+	e.downRate, e.upRate = &download, &upload
+	if e.download != nil {
+		e.applyRates()
+	}
+	return nil
+}
+
+// applyRates sets the rates of the torrent on its download
+func (e *entry) applyRates() {
+	down, up := e.download.Limits()
+	if e.downRate != nil {
+		down.SetRate(*e.downRate)
+	}
+	if e.upRate != nil {
+		up.SetRate(*e.upRate)
+	}
+}
+
+// Torrents returns the status of the torrents, in the order they were added
+func (s *Session) Torrents() []Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]Status, 0, len(s.order))
+	for _, id := range s.order {
+		e := s.torrents[id]
+		completed := 0
+		for i := 0; i < e.pieces; i++ {
+			if e.storage.Completion(i) {
+				completed++
+			}
+		}
+		res = append(res, Status{
+			InfoHash:  id,
+			Name:      e.name,
+			State:     e.state,
+			Err:       e.err,
+			Completed: completed,
+			Pieces:    e.pieces,
+		})
+	}
+	return res
+}
+
+// Wait blocks until no torrent is queued or active
+func (s *Session) Wait() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed && s.busy() {
+		s.cond.Wait()
+	}
+}
+
+func (s *Session) busy() bool {
+	for _, e := range s.torrents {
+		if e.state == Queued || e.state == Active {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops all the torrents, closes their storage, the listener and the DHT
+func (s *Session) Close() error {
+	if s.opts.Listener != nil {
+		s.opts.Listener.Close()
+	}
+	<-s.accepting
+
+	s.mu.Lock()
+	s.closed = true
+	entries := make([]*entry, 0, len(s.torrents))
+	for _, id := range s.order {
+		entries = append(entries, s.torrents[id])
+	}
+	downloads := make([]*services.Download, len(entries))
+	stopping := make([]*services.Download, len(entries))
+	for i, e := range entries {
+		downloads[i], stopping[i] = e.download, e.stopping
+		e.download = nil
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+
+	var firstErr error
+	for i, e := range entries {
+		if downloads[i] != nil {
+			downloads[i].Stop()
+		}
+		if stopping[i] != nil {
+			stopping[i].Wait()
+		}
+		if err := e.storage.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if s.opts.DHT != nil {
+		s.opts.DHT.Close()
+	}
+	return firstErr
+}
+
+// schedule starts queued torrents while fewer than MaxActive are active. It is
+// called with s.mu held.
+func (s *Session) schedule() {
+	defer s.cond.Broadcast()
+	if s.closed {
+		return
+	}
+	active := 0
+	for _, e := range s.torrents {
+		if e.state == Active {
+			active++
+		}
+	}
+	for _, id := range s.order {
+		if active >= s.opts.MaxActive {
+			return
+		}
+		e := s.torrents[id]
+		if e.state != Queued || e.stopping != nil {
+			continue
+		}
+		d, err := s.service.StartDownload(e.torrent, e.storage)
+		if err != nil {
+			e.state = Failed
+			e.err = err
+			continue
+		}
+		e.state = Active
+		e.download = d
+		e.applyRates()
+		active++
+		go s.watch(e, d)
+	}
+}
+
+// watch waits for the download of a torrent to end and updates its state,
+// unless the torrent was paused or removed in the meantime
+func (s *Session) watch(e *entry, d *services.Download) {
+	err := d.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e.stopping == d {
+		// a torrent resumed while pausing can start now
+		e.stopping = nil
+		s.schedule()
+		return
+	}
+	if e.download != d {
+		return
+	}
+	e.download = nil
+	if err != nil {
+		e.state = Failed
+		e.err = err
+	} else {
+		e.state = Completed
+	}
+	s.schedule()
+}
@@ -0,0 +1,307 @@
+package session
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/internal/testtorrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/log"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/services"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+func newTorrent(t *testing.T, name, announce string) torrent.Torrent {
+	encoded := testtorrent.Encode(t, testtorrent.Options{Name: name, Announce: announce, Length: 32})
+	tr, err := torrent.NewSingleTorrentFile(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func states(s *Session) []State {
+	var res []State
+	for _, status := range s.Torrents() {
+		res = append(res, status.State)
+	}
+	return res
+}
+
+func TestSessionQueue(t *testing.T) {
+	// the tracker holds the announces until released, keeping torrents active
+	release := make(chan struct{})
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("d14:failure reason4:gonee"))
+	}))
+	defer tracker.Close()
+
+	s := New(Options{
+		Storage:   func(t torrent.Torrent) (torrent.Storage, error) { return torrent.NewMemoryStorage(t) },
+		MaxActive: 1,
+	})
+	defer s.Close()
+
+	first, err := s.Add(newTorrent(t, "first", tracker.URL+"/announce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.Add(newTorrent(t, "second", tracker.URL+"/announce"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Add(newTorrent(t, "first", tracker.URL+"/announce")); err != ErrTorrentExists {
+		t.Fatalf("expected ErrTorrentExists, got %v", err)
+	}
+	if got := states(s); got[0] != Active || got[1] != Queued {
+		t.Fatalf("unexpected states: %v", got)
+	}
+
+	if err := s.Pause(second); err != nil {
+		t.Fatal(err)
+	}
+	if got := states(s); got[1] != Paused {
+		t.Fatalf("unexpected states after pause: %v", got)
+	}
+	if err := s.Resume(second); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second torrent starts once the first one fails
+	close(release)
+	s.Wait()
+	for _, status := range s.Torrents() {
+		if status.State != Failed || status.Err == nil {
+			t.Fatalf("expected failed torrent, got %+v", status)
+		}
+		if status.Pieces != 2 || status.Completed != 0 {
+			t.Fatalf("unexpected piece counts: %+v", status)
+		}
+	}
+
+	if err := s.Remove(first); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Torrents(); len(got) != 1 || got[0].InfoHash != second {
+		t.Fatalf("unexpected torrents after remove: %+v", got)
+	}
+	if err := s.Remove(first); err != ErrUnknownTorrent {
+		t.Fatalf("expected ErrUnknownTorrent, got %v", err)
+	}
+}
+
+// slowStorage takes a while to write, recording writes that overlap and the
+// ones made while or after closing it
+type slowStorage struct {
+	torrent.Storage
+	started chan struct{}
+
+	mu                  sync.Mutex
+	writing, maxWriting int
+	closed              bool
+	closedWhileWriting  bool
+	writeAfterClose     bool
+}
+
+func (ss *slowStorage) WriteAt(p []byte, piece int, off int64) (int, error) {
+	ss.mu.Lock()
+	ss.writeAfterClose = ss.writeAfterClose || ss.closed
+	ss.writing++
+	if ss.writing > ss.maxWriting {
+		ss.maxWriting = ss.writing
+	}
+	ss.mu.Unlock()
+	select {
+	case ss.started <- struct{}{}:
+	default:
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	ss.mu.Lock()
+	ss.writing--
+	ss.mu.Unlock()
+	return ss.Storage.WriteAt(p, piece, off)
+}
+
+func (ss *slowStorage) Close() error {
+	ss.mu.Lock()
+	ss.closed = true
+	ss.closedWhileWriting = ss.writing > 0
+	ss.mu.Unlock()
+	return ss.Storage.Close()
+}
+
+// newSlowSession returns a session downloading a torrent from a web seed to
+// slow storage, and the id of the torrent. The storage of opts is replaced.
+func newSlowSession(t *testing.T, opts Options) (*Session, string, *slowStorage) {
+	data := testtorrent.Data(128)
+	// the torrent is downloaded from a web seed, the tracker has no peers
+	seed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "data", time.Time{}, bytes.NewReader(data))
+	}))
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason4:gonee"))
+	}))
+	encoded := testtorrent.Encode(t, testtorrent.Options{
+		Name:     "data",
+		Announce: tracker.URL + "/announce",
+		URLList:  seed.URL + "/data",
+		Data:     data,
+	})
+	tr, err := torrent.NewSingleTorrentFile(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storage := &slowStorage{started: make(chan struct{})}
+	opts.Storage = func(t torrent.Torrent) (torrent.Storage, error) {
+		ms, err := torrent.NewMemoryStorage(t)
+		storage.Storage = ms
+		return storage, err
+	}
+	s := New(opts)
+	t.Cleanup(func() {
+		s.Close()
+		seed.Close()
+		tracker.Close()
+	})
+	id, err := s.Add(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, id, storage
+}
+
+func TestSessionWaitsForWorkers(t *testing.T) {
+	s, id, storage := newSlowSession(t, Options{})
+
+	// resuming while the paused download is still writing must not start
+	// another one on the same storage
+	<-storage.started
+	paused := make(chan error)
+	go func() { paused <- s.Pause(id) }()
+	for states(s)[0] != Paused {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Resume(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-paused; err != nil {
+		t.Fatal(err)
+	}
+
+	// and the storage is only closed once nothing writes to it
+	<-storage.started
+	if err := s.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.maxWriting > 1 {
+		t.Error("two downloads wrote to the storage at once")
+	}
+	if storage.closedWhileWriting || storage.writeAfterClose {
+		t.Error("storage closed while a download was writing to it")
+	}
+}
+
+func TestSessionPauseTwiceWhileStopping(t *testing.T) {
+	s, id, storage := newSlowSession(t, Options{})
+
+	// the torrent is paused again while its first download is still
+	// stopping, and resumed
+	<-storage.started
+	paused := make(chan error)
+	go func() { paused <- s.Pause(id) }()
+	for states(s)[0] != Paused {
+		time.Sleep(time.Millisecond)
+	}
+	for _, step := range []func(string) error{s.Resume, s.Pause, s.Resume} {
+		if err := step(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-paused; err != nil {
+		t.Fatal(err)
+	}
+	<-storage.started
+	if err := s.Remove(id); err != nil {
+		t.Fatal(err)
+	}
+
+	storage.mu.Lock()
+	defer storage.mu.Unlock()
+	if storage.maxWriting > 1 {
+		t.Error("a download started while the paused one was writing")
+	}
+	if storage.closedWhileWriting || storage.writeAfterClose {
+		t.Error("storage closed while a download was writing to it")
+	}
+}
+
+// handshake sends a handshake for the infohash over c and returns the reply
+func handshake(t *testing.T, c net.Conn, infohash []byte) ([]byte, error) {
+	msg := append([]byte("\x13BitTorrent protocol"), make([]byte, 8)...)
+	msg = append(msg, infohash...)
+	msg = append(msg, "-TR2940-remotepeer12"...)
+	if _, err := c.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	reply := make([]byte, 68)
+	_, err := io.ReadFull(c, reply)
+	return reply, err
+}
+
+func TestSessionListener(t *testing.T) {
+	// the logger of the peer connections is set by the CLI
+	services.Logger = log.NewLogger(log.NORMAL)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, id, storage := newSlowSession(t, Options{Listener: l})
+	<-storage.started
+	infohash, _ := hex.DecodeString(id)
+
+	// peers asking for the active torrent get our handshake
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	reply, err := handshake(t, c, infohash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reply[28:48], infohash) || string(reply[48:]) != torrent.LocalPeerID {
+		t.Fatalf("unexpected handshake reply %q", reply)
+	}
+
+	// and the other ones are turned down
+	other, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	if _, err := handshake(t, other, bytes.Repeat([]byte{0x02}, 20)); err != io.EOF {
+		t.Fatalf("expected closed connection, got %v", err)
+	}
+
+	// the listener is closed along with the session
+	s.Close()
+	if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		c.Close()
+		t.Fatal("listener still accepting after Close")
+	}
+}
@@ -0,0 +1,224 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	defaultAnnounceInterval = 30 * time.Minute
+	minRetryInterval        = 15 * time.Second
+	defaultNumWant          = 50
+)
+
+// stoppedTimeout bounds the stopped announce, which is only a courtesy to the
+// tracker and should not hold up the download that stops
+var stoppedTimeout = 5 * time.Second
+
+// Stats returns the transfer counters reported in announces
+type Stats func() (uploaded, downloaded, left int64)
+
+// Announcer keeps the tracker updated during the lifetime of a download. It sends
+// the started event, re-announces periodically to get fresh peers, and sends the
+// completed and stopped events when told to.
+type Announcer struct {
+	mu sync.Mutex
+
+	tracker *Tracker
+	stats   Stats
+	key     string
+	port    int
+
+	trackerID   string
+	interval    time.Duration
+	minInterval time.Duration
+	// set when the completed event still has to reach the tracker
+	completedPending bool
+	started          bool
+
+	peers chan []*Peer
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func NewAnnouncer(tracker *Tracker, stats Stats) *Announcer {
+	key := make([]byte, 4)
+	rand.Read(key)
+
+	return &Announcer{
+		tracker:  tracker,
+		stats:    stats,
+		key:      hex.EncodeToString(key),
+		interval: defaultAnnounceInterval,
+		peers:    make(chan []*Peer, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start sends the started event and begins re-announcing in the background.
+// The response of the first announce is returned.
+func (a *Announcer) Start() (*TrackerResponse, error) {
+	resp, err := a.announce(EventStarted)
+	if err != nil {
+		close(a.peers)
+		close(a.done)
+		return nil, err
+	}
+	a.mu.Lock()
+	a.started = true
+	a.mu.Unlock()
+	go a.loop()
+	return resp, nil
+}
+
+// Peers returns a channel with the peers received in every re-announce. Only the
+// most recent list is kept if it isn't consumed in time. The channel is closed
+// when the announcer stops.
+func (a *Announcer) Peers() <-chan []*Peer {
+	return a.peers
+}
+
+// Completed sends the completed event. If it fails, it is sent again
+// with the next periodic announce.
+func (a *Announcer) Completed() error {
+	_, err := a.announce(EventCompleted)
+	if err != nil {
+		a.mu.Lock()
+		a.completedPending = true
+		a.mu.Unlock()
+	}
+	return err
+}
+
+// Stop ends the periodic announces and sends the stopped event. It does nothing
+// if the announcer was not started.
+func (a *Announcer) Stop() error {
+	a.mu.Lock()
+	started := a.started
+	a.mu.Unlock()
+	if !started {
+		return nil
+	}
+	close(a.stop)
+	<-a.done
+
+	_, err := a.announce(EventStopped)
+	return err
+}
+
+func (a *Announcer) loop() {
+	defer close(a.done)
+	defer close(a.peers)
+
+	retries := 0
+	timer := time.NewTimer(a.nextAnnounce())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-a.stop:
+			return
+		case <-timer.C:
+		}
+
+		a.mu.Lock()
+		event := ""
+		if a.completedPending {
+			event = EventCompleted
+		}
+		a.mu.Unlock()
+
+		resp, err := a.announce(event)
+		if err != nil {
+			// retry sooner than the interval, backing off on repeated failures
+			retry := minRetryInterval << uint(retries)
+			if next := a.nextAnnounce(); retry > next || retry <= 0 {
+				retry = next
+			}
+			a.mu.Lock()
+			if retry < a.minInterval {
+				retry = a.minInterval
+			}
+			a.mu.Unlock()
+			retries++
+			timer.Reset(retry)
+			continue
+		}
+		retries = 0
+
+		// replace the peers not yet consumed with the fresh ones
+		select {
+		case <-a.peers:
+		default:
+		}
+		a.peers <- resp.Peers
+
+		timer.Reset(a.nextAnnounce())
+	}
+}
+
+// SetPort sets the port peers are told to connect to, the default one if zero
+func (a *Announcer) SetPort(port int) {
+	a.mu.Lock()
+	a.port = port
+	a.mu.Unlock()
+}
+
+// nextAnnounce returns the time to wait until the next regular announce,
+// which is the interval unless the tracker asks for a longer min interval
+func (a *Announcer) nextAnnounce() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	wait := a.interval
+	if wait < a.minInterval {
+		wait = a.minInterval
+	}
+	return wait
+}
+
+func (a *Announcer) announce(event string) (*TrackerResponse, error) {
+	uploaded, downloaded, left := a.stats()
+
+	a.mu.Lock()
+	params := &AnnounceParams{
+		Event:      event,
+		Uploaded:   uploaded,
+		Downloaded: downloaded,
+		Left:       left,
+		TrackerID:  a.trackerID,
+		NumWant:    defaultNumWant,
+		Key:        a.key,
+		Port:       a.port,
+	}
+	if event == EventStopped {
+		// no more peers needed
+		params.NumWant = 0
+		params.Timeout = stoppedTimeout
+	}
+	a.mu.Unlock()
+
+	resp, err := a.tracker.Announce(params)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if event == EventCompleted {
+		a.completedPending = false
+	}
+	if resp.TrackerID != "" {
+		a.trackerID = resp.TrackerID
+	}
+	if resp.Interval > 0 {
+		a.interval = time.Duration(resp.Interval) * time.Second
+	}
+	if resp.MinInterval > 0 {
+		a.minInterval = time.Duration(resp.MinInterval) * time.Second
+	}
+	return resp, nil
+}
@@ -0,0 +1,151 @@
+package torrent
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAnnouncerLifecycle(t *testing.T) {
+	var mu sync.Mutex
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries = append(queries, r.URL.Query())
+		mu.Unlock()
+		io.WriteString(w, "d8:intervali1e10:tracker id3:tid5:peers6:\x7f\x00\x00\x01\x1a\xe1e")
+	}))
+	defer srv.Close()
+
+	var downloaded int64
+	stats := func() (int64, int64, int64) {
+		d := atomic.LoadInt64(&downloaded)
+		return 0, d, 32768 - d
+	}
+	a := NewAnnouncer(NewTracker(&mockTorrent{announce: srv.URL + "/announce"}), stats)
+	a.SetPort(51413)
+
+	resp, err := a.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1 {
+		t.Fatalf("expected one peer in first response, got %d", len(resp.Peers))
+	}
+
+	// wait for the periodic re-announce
+	select {
+	case peers := <-a.Peers():
+		if len(peers) != 1 {
+			t.Fatalf("expected one peer in re-announce, got %d", len(peers))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no re-announce within the interval")
+	}
+
+	atomic.StoreInt64(&downloaded, 32768)
+	if err := a.Completed(); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(queries) < 4 {
+		t.Fatalf("expected at least 4 announces, got %d", len(queries))
+	}
+
+	first, regular := queries[0], queries[1]
+	completed, stopped := queries[len(queries)-2], queries[len(queries)-1]
+
+	if first.Get("event") != EventStarted || first.Get("trackerid") != "" {
+		t.Fatalf("unexpected first announce: %v", first)
+	}
+	if regular.Get("event") != "" || regular.Get("trackerid") != "tid" {
+		t.Fatalf("unexpected regular announce: %v", regular)
+	}
+	if first.Get("port") != "51413" || regular.Get("port") != "51413" {
+		t.Fatalf("port not announced: %v", regular)
+	}
+	if regular.Get("key") == "" || regular.Get("key") != first.Get("key") || regular.Get("numwant") != "50" {
+		t.Fatalf("key and numwant not sent consistently: %v", regular)
+	}
+	if completed.Get("event") != EventCompleted || completed.Get("downloaded") != "32768" || completed.Get("left") != "0" {
+		t.Fatalf("unexpected completed announce: %v", completed)
+	}
+	if stopped.Get("event") != EventStopped {
+		t.Fatalf("unexpected last announce: %v", stopped)
+	}
+}
+
+func TestAnnouncerStartFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "d14:failure reason6:bannede")
+	}))
+	defer srv.Close()
+
+	a := NewAnnouncer(NewTracker(&mockTorrent{announce: srv.URL + "/announce"}), func() (int64, int64, int64) {
+		return 0, 0, 0
+	})
+	if _, err := a.Start(); err == nil {
+		t.Fatalf("expected error from failing tracker")
+	}
+	if _, ok := <-a.Peers(); ok {
+		t.Fatalf("expected peers channel to be closed")
+	}
+	if err := a.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAnnouncerStopWithoutStart(t *testing.T) {
+	a := NewAnnouncer(NewTracker(&mockTorrent{announce: "http://127.0.0.1:1/announce"}), func() (int64, int64, int64) {
+		return 0, 0, 0
+	})
+	stopped := make(chan error, 1)
+	go func() { stopped <- a.Stop() }()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Stop blocked on an announcer never started")
+	}
+}
+
+func TestAnnouncerStoppedDeadline(t *testing.T) {
+	defer func(timeout time.Duration) { stoppedTimeout = timeout }(stoppedTimeout)
+	stoppedTimeout = 50 * time.Millisecond
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("event") == EventStopped {
+			// a tracker that hangs
+			<-r.Context().Done()
+			return
+		}
+		io.WriteString(w, "d8:intervali60e5:peers0:e")
+	}))
+	defer srv.Close()
+
+	a := NewAnnouncer(NewTracker(&mockTorrent{announce: srv.URL + "/announce"}), func() (int64, int64, int64) {
+		return 0, 0, 0
+	})
+	if _, err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := a.Stop(); err == nil {
+		t.Fatal("expected the stopped announce to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Stop took %v", elapsed)
+	}
+}
@@ -0,0 +1,33 @@
+package torrent
+
+// Bitfield keeps track of the pieces a peer has, using the wire format of the
+// bitfield message (high bit of the first byte is piece 0).
+type Bitfield []byte
+
+func NewBitfield(noOfPieces int) Bitfield {
+	return make(Bitfield, (noOfPieces+7)/8)
+}
+
+// Has reports whether the piece with the given index is set. Indexes
+// outside of the bitfield are reported as missing.
+func (bf Bitfield) Has(idx int) bool {
+	if idx < 0 || idx/8 >= len(bf) {
+		return false
+	}
+	return bf[idx/8]>>(7-uint(idx%8))&1 != 0
+}
+
+// Set marks the piece with the given index as present.
+func (bf Bitfield) Set(idx int) {
+	if idx < 0 || idx/8 >= len(bf) {
+		return
+	}
+	bf[idx/8] |= 1 << (7 - uint(idx%8))
+}
+
+// SetAll marks the first noOfPieces pieces as present.
+func (bf Bitfield) SetAll(noOfPieces int) {
+	for i := 0; i < noOfPieces; i++ {
+		bf.Set(i)
+	}
+}
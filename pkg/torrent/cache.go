@@ -0,0 +1,377 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"sort"
+	"sync"
+)
+
+// DefaultCacheSize is the size of the cache when none is given
+const DefaultCacheSize = 64 << 20
+
+// FlushPolicy decides when complete pieces are written from the cache to storage
+type FlushPolicy int
+
+const (
+	// FlushOnComplete writes a piece to storage as soon as it is marked complete
+	FlushOnComplete FlushPolicy = iota
+	// FlushWhenFull keeps complete pieces in memory until the cache is full or
+	// flushed, and then writes them all in offset order
+	FlushWhenFull
+)
+
+// CacheOptions configures a CachedStorage
+type CacheOptions struct {
+	// Size is the number of bytes of piece data kept in memory
+	Size   int64
+	Policy FlushPolicy
+}
+
+// CacheStats counts the work done by a CachedStorage
+type CacheStats struct {
+	// reads served from memory and from storage
+	Hits   int64
+	Misses int64
+	// pieces and bytes written to storage
+	Flushes      int64
+	BytesFlushed int64
+}
+
+// CachedStorage is a write-back cache in front of another storage. Blocks are
+// gathered into whole pieces in memory, where pieces are also hashed, and
+// written to storage in offset order with one write per contiguous range.
+// Pieces read are kept as well, so that the following blocks of the piece are
+// served from memory. The least recently used pieces are evicted when the cache
+// grows past its size.
+type CachedStorage struct {
+	storage Storage
+	layout  *pieceLayout
+	opts    CacheOptions
+
+	mu      sync.Mutex
+	entries map[int]*cacheEntry
+	size    int64
+	clock   uint64
+	stats   CacheStats
+	closed  bool
+}
+
+// cacheEntry holds the data of a piece in the cache
+type cacheEntry struct {
+	piece int
+	data  []byte
+	// sorted, non overlapping ranges of data that hold piece data
+	ranges [][2]int
+	// dirty entries have data that isn't in storage yet
+	dirty bool
+	// complete entries were marked complete, but not in storage yet
+	complete bool
+	lastUsed uint64
+}
+
+func NewCachedStorage(t Torrent, storage Storage, opts CacheOptions) (*CachedStorage, error) {
+	layout, err := newPieceLayout(t)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Size <= 0 {
+		opts.Size = DefaultCacheSize
+	}
+	return &CachedStorage{
+		storage: storage,
+		layout:  layout,
+		opts:    opts,
+		entries: make(map[int]*cacheEntry),
+	}, nil
+}
+
+// Stats returns the cache counters so far
+func (cs *CachedStorage) Stats() CacheStats {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.stats
+}
+
+func (cs *CachedStorage) WriteAt(p []byte, piece int, off int64) (int, error) {
+	if _, err := cs.layout.check(piece, off, len(p)); err != nil {
+		return 0, err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		return 0, ErrStorageClosed
+	}
+
+	e, ok := cs.entries[piece]
+	if !ok {
+		e = cs.add(piece)
+	}
+	copy(e.data[off:], p)
+	e.addRange(int(off), int(off)+len(p))
+	e.dirty = true
+	cs.touch(e)
+
+	if !ok {
+		if err := cs.evict(e); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+func (cs *CachedStorage) ReadAt(p []byte, piece int, off int64) (int, error) {
+	if _, err := cs.layout.check(piece, off, len(p)); err != nil {
+		return 0, err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		return 0, ErrStorageClosed
+	}
+
+	e, ok := cs.entries[piece]
+	if ok && e.covers(int(off), len(p)) {
+		cs.stats.Hits++
+		cs.touch(e)
+		return copy(p, e.data[off:]), nil
+	}
+	cs.stats.Misses++
+	if ok {
+		// storage must have everything the cache has before reading from it
+		if err := cs.flush(e); err != nil {
+			return 0, err
+		}
+	}
+
+	// the rest of a complete piece is likely to be read next
+	if cs.storage.Completion(piece) {
+		if !ok {
+			e = cs.add(piece)
+		}
+		if _, err := cs.storage.ReadAt(e.data, piece, 0); err != nil {
+			cs.remove(e)
+			return 0, err
+		}
+		e.ranges = [][2]int{{0, len(e.data)}}
+		cs.touch(e)
+		n := copy(p, e.data[off:])
+		return n, cs.evict(e)
+	}
+	return cs.storage.ReadAt(p, piece, off)
+}
+
+// HashPiece returns the SHA-1 of the piece, computed in memory when all of its
+// data is in the cache
+func (cs *CachedStorage) HashPiece(piece int) ([]byte, error) {
+	length := cs.layout.pieceLength(piece)
+	if _, err := cs.layout.check(piece, 0, length); err != nil {
+		return nil, err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		return nil, ErrStorageClosed
+	}
+
+	e, ok := cs.entries[piece]
+	if ok && e.covers(0, length) {
+		hash := sha1.Sum(e.data)
+		return hash[:], nil
+	}
+	// part of the piece was evicted, hash it in storage
+	if ok {
+		if err := cs.flush(e); err != nil {
+			return nil, err
+		}
+	}
+	if hasher, ok := cs.storage.(PieceHasher); ok {
+		return hasher.HashPiece(piece)
+	}
+	data := make([]byte, length)
+	if _, err := cs.storage.ReadAt(data, piece, 0); err != nil {
+		return nil, err
+	}
+	hash := sha1.Sum(data)
+	return hash[:], nil
+}
+
+func (cs *CachedStorage) MarkComplete(piece int) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	e, ok := cs.entries[piece]
+	if !ok || !e.dirty {
+		return cs.storage.MarkComplete(piece)
+	}
+	e.complete = true
+	if cs.opts.Policy == FlushOnComplete {
+		return cs.flush(e)
+	}
+	return nil
+}
+
+func (cs *CachedStorage) Completion(piece int) bool {
+	cs.mu.Lock()
+	e, ok := cs.entries[piece]
+	pending := ok && e.complete
+	cs.mu.Unlock()
+	return pending || cs.storage.Completion(piece)
+}
+
+// Flush writes all the data in the cache to storage, in offset order
+func (cs *CachedStorage) Flush() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		return ErrStorageClosed
+	}
+	return cs.flushAll(false)
+}
+
+// Close flushes the cache and closes the storage
+func (cs *CachedStorage) Close() error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.closed {
+		return nil
+	}
+	err := cs.flushAll(false)
+	cs.closed = true
+	cs.entries = nil
+	cs.size = 0
+	if closeErr := cs.storage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (cs *CachedStorage) add(piece int) *cacheEntry {
+	e := &cacheEntry{piece: piece, data: make([]byte, cs.layout.pieceLength(piece))}
+	cs.entries[piece] = e
+	cs.size += int64(len(e.data))
+	return e
+}
+
+func (cs *CachedStorage) remove(e *cacheEntry) {
+	delete(cs.entries, e.piece)
+	cs.size -= int64(len(e.data))
+}
+
+func (cs *CachedStorage) touch(e *cacheEntry) {
+	cs.clock++
+	e.lastUsed = cs.clock
+}
+
+// flush writes the data of the entry to storage, one write per range
+func (cs *CachedStorage) flush(e *cacheEntry) error {
+	if e.dirty {
+		for _, r := range e.ranges {
+			if _, err := cs.storage.WriteAt(e.data[r[0]:r[1]], e.piece, int64(r[0])); err != nil {
+				return err
+			}
+			cs.stats.BytesFlushed += int64(r[1] - r[0])
+		}
+		cs.stats.Flushes++
+		e.dirty = false
+	}
+	if e.complete {
+		e.complete = false
+		return cs.storage.MarkComplete(e.piece)
+	}
+	return nil
+}
+
+// flushAll writes the dirty entries to storage in offset order, only the
+// complete ones if completeOnly is set
+func (cs *CachedStorage) flushAll(completeOnly bool) error {
+	var dirty []*cacheEntry
+	for _, e := range cs.entries {
+		if e.dirty && (e.complete || !completeOnly) {
+			dirty = append(dirty, e)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].piece < dirty[j].piece })
+	for _, e := range dirty {
+		if err := cs.flush(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// evict removes the least recently used entries, other than keep, until the
+// cache fits its size. Clean entries go first, then complete pieces are
+// flushed, and pieces still downloading are flushed last.
+func (cs *CachedStorage) evict(keep *cacheEntry) error {
+	for cs.size > cs.opts.Size {
+		if e := cs.leastRecentlyUsed(keep, false); e != nil {
+			cs.remove(e)
+			continue
+		}
+		pending := false
+		for _, e := range cs.entries {
+			if e.dirty && e.complete {
+				pending = true
+				break
+			}
+		}
+		if pending {
+			if err := cs.flushAll(true); err != nil {
+				return err
+			}
+			continue
+		}
+		e := cs.leastRecentlyUsed(keep, true)
+		if e == nil {
+			// a single piece can be larger than the cache
+			return nil
+		}
+		if err := cs.flush(e); err != nil {
+			return err
+		}
+		cs.remove(e)
+	}
+	return nil
+}
+
+func (cs *CachedStorage) leastRecentlyUsed(keep *cacheEntry, dirty bool) *cacheEntry {
+	var lru *cacheEntry
+	for _, e := range cs.entries {
+		if e == keep || e.dirty != dirty {
+			continue
+		}
+		if lru == nil || e.lastUsed < lru.lastUsed {
+			lru = e
+		}
+	}
+	return lru
+}
+
+// addRange records that [start, end) holds piece data, merging it with the
+// ranges it overlaps or touches
+func (e *cacheEntry) addRange(start, end int) {
+	ranges := append(e.ranges, [2]int{start, end})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r[0] <= last[1] {
+			if r[1] > last[1] {
+				last[1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	e.ranges = merged
+}
+
+// covers reports whether the entry holds all of the given range
+func (e *cacheEntry) covers(off, n int) bool {
+	for _, r := range e.ranges {
+		if r[0] <= off && off+n <= r[1] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+)
+
+// recordingStorage records the writes that reach the storage it wraps
+type recordingStorage struct {
+	Storage
+	writes [][2]int
+}
+
+func (rs *recordingStorage) WriteAt(p []byte, piece int, off int64) (int, error) {
+	rs.writes = append(rs.writes, [2]int{piece, int(off)})
+	return rs.Storage.WriteAt(p, piece, off)
+}
+
+func newCachedStorage(t *testing.T, opts CacheOptions) (*CachedStorage, *recordingStorage) {
+	tr := newMultiFileTorrent(t)
+	memory, err := NewMemoryStorage(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backing := &recordingStorage{Storage: memory}
+	cache, err := NewCachedStorage(tr, backing, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache, backing
+}
+
+func TestCachedStorage(t *testing.T) {
+	// the cache fits only two of the three pieces
+	cache, _ := newCachedStorage(t, CacheOptions{Size: 32})
+	checkStorage(t, cache)
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.WriteAt([]byte{1}, 0, 0); err != ErrStorageClosed {
+		t.Fatalf("expected ErrStorageClosed, got %v", err)
+	}
+}
+
+func TestCachedStorageWriteBack(t *testing.T) {
+	cache, backing := newCachedStorage(t, CacheOptions{Size: 64, Policy: FlushWhenFull})
+	data := testStorageData()
+
+	// pieces written out of order, in blocks
+	for _, piece := range []int{2, 0, 1} {
+		start := piece * 16
+		end := start + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		for off := end - start; off > 0; off -= 4 {
+			begin := off - 4
+			if begin < 0 {
+				begin = 0
+			}
+			if _, err := cache.WriteAt(data[start+begin:start+off], piece, int64(begin)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		hash, err := cache.HashPiece(piece)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := sha1.Sum(data[start:end])
+		if !bytes.Equal(hash, expected[:]) {
+			t.Fatalf("unexpected hash for piece %d", piece)
+		}
+		if err := cache.MarkComplete(piece); err != nil {
+			t.Fatal(err)
+		}
+		if !cache.Completion(piece) {
+			t.Fatalf("piece %d not complete", piece)
+		}
+	}
+	if len(backing.writes) != 0 {
+		t.Fatalf("pieces written before the cache was flushed: %v", backing.writes)
+	}
+	if backing.Completion(0) {
+		t.Fatalf("piece marked complete in storage before being written")
+	}
+
+	if err := cache.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// one write per piece, in offset order
+	expected := [][2]int{{0, 0}, {1, 0}, {2, 0}}
+	if len(backing.writes) != len(expected) {
+		t.Fatalf("unexpected writes: %v", backing.writes)
+	}
+	for i, w := range expected {
+		if backing.writes[i] != w {
+			t.Fatalf("unexpected writes: %v", backing.writes)
+		}
+	}
+	for piece := 0; piece < 3; piece++ {
+		if !backing.Completion(piece) {
+			t.Fatalf("piece %d not complete in storage after flush", piece)
+		}
+	}
+
+	read := make([]byte, 16)
+	if _, err := backing.ReadAt(read, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data[16:32]) {
+		t.Fatalf("unexpected data in storage: %v", read)
+	}
+	stats := cache.Stats()
+	if stats.Flushes != 3 || stats.BytesFlushed != int64(len(data)) {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCachedStorageReads(t *testing.T) {
+	cache, backing := newCachedStorage(t, CacheOptions{Size: 16})
+	data := testStorageData()
+	if _, err := backing.WriteAt(data[:16], 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	backing.MarkComplete(0)
+
+	// the first block is read from storage along with the rest of the piece
+	block := make([]byte, 4)
+	for off := 0; off < 16; off += 4 {
+		if _, err := cache.ReadAt(block, 0, int64(off)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(block, data[off:off+4]) {
+			t.Fatalf("unexpected block at %d: %v", off, block)
+		}
+	}
+	stats := cache.Stats()
+	if stats.Misses != 1 || stats.Hits != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// pieces not complete are read from storage without being cached
+	if _, err := cache.ReadAt(block, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.ReadAt(block, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if stats := cache.Stats(); stats.Misses != 3 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
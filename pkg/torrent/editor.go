@@ -0,0 +1,227 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"io"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+)
+
+var ErrInfoKey = errors.New("the info dictionary can only be changed with SetInfo")
+
+// Editor changes the keys of a torrent file. Values are kept as found in the
+// file unless changed, so that editing the top level keys leaves the info
+// dictionary, and with it the infohash, untouched.
+type Editor struct {
+	dict map[string]bencode.RawMessage
+}
+
+func NewEditor(r io.Reader) (*Editor, error) {
+	buf, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &Editor{}
+	if err := unmarshalLenient(buf, &e.dict); err != nil {
+		return nil, err
+	}
+	if _, ok := e.dict["info"]; !ok {
+		return nil, ErrInvalidTorrentFormat
+	}
+	return e, nil
+}
+
+// InfoHash returns the infohash the torrent has with the changes made so far
+func (e *Editor) InfoHash() []byte {
+	res := sha1.Sum(e.dict["info"])
+	return res[:]
+}
+
+// Get decodes the value of a top level key into v, reporting whether it exists
+func (e *Editor) Get(key string, v interface{}) (bool, error) {
+	raw, ok := e.dict[key]
+	if !ok {
+		return false, nil
+	}
+	return true, unmarshalLenient(raw, v)
+}
+
+// Set sets a top level key. The info dictionary can't be replaced this way.
+func (e *Editor) Set(key string, v interface{}) error {
+	if key == "info" {
+		return ErrInfoKey
+	}
+	raw, err := bencode.Marshal(v)
+	if err != nil {
+		return err
+	}
+	e.dict[key] = raw
+	return nil
+}
+
+// Delete removes a top level key
+func (e *Editor) Delete(key string) error {
+	if key == "info" {
+		return ErrInfoKey
+	}
+	delete(e.dict, key)
+	return nil
+}
+
+// SetInfo sets a key of the info dictionary, or removes it when v is nil.
+// This changes the infohash, making it a different torrent.
+func (e *Editor) SetInfo(key string, v interface{}) error {
+	var info map[string]bencode.RawMessage
+	if err := unmarshalLenient(e.dict["info"], &info); err != nil {
+		return err
+	}
+
+	if v == nil {
+		delete(info, key)
+	} else {
+		raw, err := bencode.Marshal(v)
+		if err != nil {
+			return err
+		}
+		info[key] = raw
+	}
+
+	raw, err := bencode.Marshal(info)
+	if err != nil {
+		return err
+	}
+	e.dict["info"] = raw
+	return nil
+}
+
+// Trackers returns the announce URL followed by those of announce-list (BEP 12),
+// without duplicates
+func (e *Editor) Trackers() []string {
+	var res []string
+	seen := make(map[string]bool)
+	add := func(url string) {
+		if url != "" && !seen[url] {
+			seen[url] = true
+			res = append(res, url)
+		}
+	}
+
+	var announce string
+	e.Get("announce", &announce)
+	add(announce)
+
+	var tiers [][]string
+	e.Get("announce-list", &tiers)
+	for _, tier := range tiers {
+		for _, url := range tier {
+			add(url)
+		}
+	}
+	return res
+}
+
+// AddTracker adds a tracker in a tier of its own. It becomes the announce URL
+// if the torrent has none.
+func (e *Editor) AddTracker(url string) error {
+	var announce string
+	e.Get("announce", &announce)
+	if announce == "" {
+		return e.Set("announce", url)
+	}
+
+	var tiers [][]string
+	if _, err := e.Get("announce-list", &tiers); err != nil {
+		return err
+	}
+	if len(tiers) == 0 {
+		tiers = [][]string{{announce}}
+	}
+	for _, tier := range tiers {
+		for _, u := range tier {
+			if u == url {
+				return nil
+			}
+		}
+	}
+	return e.Set("announce-list", append(tiers, []string{url}))
+}
+
+// RemoveTracker removes a tracker from announce and announce-list. If it was the
+// announce URL, the next tracker left takes its place.
+func (e *Editor) RemoveTracker(url string) error {
+	var tiers [][]string
+	if _, err := e.Get("announce-list", &tiers); err != nil {
+		return err
+	}
+	var left [][]string
+	for _, tier := range tiers {
+		var kept []string
+		for _, u := range tier {
+			if u != url {
+				kept = append(kept, u)
+			}
+		}
+		if len(kept) > 0 {
+			left = append(left, kept)
+		}
+	}
+	if len(left) > 0 {
+		if err := e.Set("announce-list", left); err != nil {
+			return err
+		}
+	} else {
+		e.Delete("announce-list")
+	}
+
+	var announce string
+	e.Get("announce", &announce)
+	if announce != url {
+		return nil
+	}
+	if len(left) > 0 {
+		return e.Set("announce", left[0][0])
+	}
+	return e.Delete("announce")
+}
+
+// WebSeeds returns the url-list, which can either be a single URL or a list of them
+func (e *Editor) WebSeeds() []string {
+	var urlList interface{}
+	e.Get("url-list", &urlList)
+
+	switch urlList := urlList.(type) {
+	case string:
+		if urlList != "" {
+			return []string{urlList}
+		}
+	case []interface{}:
+		var res []string
+		for _, u := range urlList {
+			if us, ok := u.(string); ok && us != "" {
+				res = append(res, us)
+			}
+		}
+		return res
+	}
+	return nil
+}
+
+// SetWebSeeds replaces the url-list, removing it when empty
+func (e *Editor) SetWebSeeds(urls []string) error {
+	if len(urls) == 0 {
+		return e.Delete("url-list")
+	}
+	return e.Set("url-list", urls)
+}
+
+// WriteTo writes the torrent file with the changes made
+func (e *Editor) WriteTo(w io.Writer) (int64, error) {
+	raw, err := bencode.Marshal(e.dict)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(w, bytes.NewReader(raw))
+}
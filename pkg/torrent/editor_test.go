@@ -0,0 +1,80 @@
+package torrent
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEditorKeepsInfo(t *testing.T) {
+	// unsorted info keys would be sorted if the info dictionary was re-encoded
+	file := "d8:announce8:http://a4:infod4:name1:x6:lengthi1e12:piece lengthi1e6:pieces0:ee"
+	e, err := NewEditor(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := e.InfoHash()
+
+	if err := e.Set("comment", "hello"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.AddTracker("http://b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetWebSeeds([]string{"http://ws/"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Set("info", "x"); err != ErrInfoKey {
+		t.Fatalf("expected ErrInfoKey, got %v", err)
+	}
+
+	out := new(bytes.Buffer)
+	if _, err := e.WriteTo(out); err != nil {
+		t.Fatal(err)
+	}
+	edited, err := NewSingleTorrentFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	infohash, _ := edited.InfoHash()
+	if !bytes.Equal(infohash, before) {
+		t.Fatalf("infohash changed from %x to %x", before, infohash)
+	}
+	if !reflect.DeepEqual(edited.WebSeeds(), []string{"http://ws/"}) {
+		t.Fatalf("unexpected web seeds %v", edited.WebSeeds())
+	}
+	if !reflect.DeepEqual(e.Trackers(), []string{"http://a", "http://b"}) {
+		t.Fatalf("unexpected trackers %v", e.Trackers())
+	}
+
+	if err := e.SetInfo("private", 1); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(e.InfoHash(), before) {
+		t.Fatalf("expected the infohash to change with the info dictionary")
+	}
+}
+
+func TestEditorRemoveTracker(t *testing.T) {
+	e, err := NewEditor(strings.NewReader("d8:announce8:http://a13:announce-listll8:http://ael8:http://bee4:infod4:name1:xee"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.RemoveTracker("http://a"); err != nil {
+		t.Fatal(err)
+	}
+	var announce string
+	e.Get("announce", &announce)
+	if announce != "http://b" || !reflect.DeepEqual(e.Trackers(), []string{"http://b"}) {
+		t.Fatalf("unexpected trackers %q %v", announce, e.Trackers())
+	}
+
+	if err := e.RemoveTracker("http://b"); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Trackers()) != 0 {
+		t.Fatalf("expected no trackers, got %v", e.Trackers())
+	}
+}
@@ -0,0 +1,247 @@
+package torrent
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var ErrInvalidFilePath = errors.New("invalid file path in torrent")
+
+// FilePath joins the path components of a torrent file under dir. Components
+// that could point outside of dir are rejected, as the paths come from the
+// torrent file.
+func FilePath(dir string, components []string) (string, error) {
+	parts := make([]string, 0, len(components)+1)
+	parts = append(parts, dir)
+	for _, c := range components {
+		if c == "" || c == "." || c == ".." || strings.ContainsAny(c, "/\\\x00") {
+			return "", ErrInvalidFilePath
+		}
+		parts = append(parts, c)
+	}
+	return filepath.Join(parts...), nil
+}
+
+// FileStorage stores the torrent data in its files, under a directory. Files are
+// created the first time data is written to them.
+type FileStorage struct {
+	*completion
+	layout *pieceLayout
+	paths  []string
+
+	mu     sync.Mutex
+	open   map[int]*os.File
+	closed bool
+}
+
+// FilePaths returns the paths of the files of the torrent under dir
+func FilePaths(t Torrent, dir string) ([]string, error) {
+	files, err := t.Files()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(files))
+	for i, f := range files {
+		if paths[i], err = FilePath(dir, f.Path); err != nil {
+			return nil, err
+		}
+	}
+	return paths, nil
+}
+
+// createEmptyFiles creates the files of length zero, as they have no piece data
+// to trigger their creation. Skipped files have no path and are left out.
+func createEmptyFiles(files []File, paths []string) error {
+	for i, f := range files {
+		if f.Length > 0 || paths[i] == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(paths[i]), 0755); err != nil {
+			return err
+		}
+		empty, err := os.OpenFile(paths[i], os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		empty.Close()
+	}
+	return nil
+}
+
+func NewFileStorage(t Torrent, dir string) (Storage, error) {
+	paths, err := FilePaths(t, dir)
+	if err != nil {
+		return nil, err
+	}
+	return NewFileStorageFromPaths(t, paths)
+}
+
+// NewFileStorageFromPaths returns storage for the files of the torrent at the
+// given paths. Files with an empty path are skipped and never created.
+func NewFileStorageFromPaths(t Torrent, paths []string) (Storage, error) {
+	layout, err := newPieceLayout(t)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) != len(layout.files) {
+		return nil, ErrInvalidFilePath
+	}
+	if err := createEmptyFiles(layout.files, paths); err != nil {
+		return nil, err
+	}
+
+	return &FileStorage{
+		completion: newCompletion(layout.noOfPieces),
+		layout:     layout,
+		paths:      paths,
+		open:       make(map[int]*os.File),
+	}, nil
+}
+
+// FileStorageOpener returns an opener of file storage under dir
+func FileStorageOpener(dir string) StorageOpener {
+	return func(t Torrent) (Storage, error) {
+		return NewFileStorage(t, dir)
+	}
+}
+
+// file returns the open file with the given index, opening it if needed
+func (fs *FileStorage) file(idx int, create bool) (*os.File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	if fs.closed {
+		return nil, ErrStorageClosed
+	}
+	if f, ok := fs.open[idx]; ok {
+		return f, nil
+	}
+	if fs.paths[idx] == "" {
+		return nil, ErrFileSkipped
+	}
+
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+		if err := os.MkdirAll(filepath.Dir(fs.paths[idx]), 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(fs.paths[idx], flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fs.open[idx] = f
+	return f, nil
+}
+
+func (fs *FileStorage) ReadAt(p []byte, piece int, off int64) (int, error) {
+	start, err := fs.layout.check(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, seg := range SegmentsForRange(fs.layout.files, int(start), len(p)) {
+		f, err := fs.file(seg.File, false)
+		if err != nil {
+			return n, err
+		}
+		read, err := f.ReadAt(p[n:n+seg.Length], int64(seg.Offset))
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (fs *FileStorage) WriteAt(p []byte, piece int, off int64) (int, error) {
+	start, err := fs.layout.check(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, seg := range SegmentsForRange(fs.layout.files, int(start), len(p)) {
+		f, err := fs.file(seg.File, true)
+		if err != nil {
+			return n, err
+		}
+		written, err := f.WriteAt(p[n:n+seg.Length], int64(seg.Offset))
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (fs *FileStorage) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.closed = true
+
+	var firstErr error
+	for idx, f := range fs.open {
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(fs.open, idx)
+	}
+	return firstErr
+}
+
+// BlobStorage stores the whole torrent data in a single file, as if the files
+// of the torrent were concatenated
+type BlobStorage struct {
+	*completion
+	layout *pieceLayout
+	f      *os.File
+}
+
+func NewBlobStorage(t Torrent, path string) (Storage, error) {
+	layout, err := newPieceLayout(t)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// data not written yet reads as zeros
+	if err := f.Truncate(int64(layout.length)); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &BlobStorage{
+		completion: newCompletion(layout.noOfPieces),
+		layout:     layout,
+		f:          f,
+	}, nil
+}
+
+func (bs *BlobStorage) ReadAt(p []byte, piece int, off int64) (int, error) {
+	start, err := bs.layout.check(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n, err := bs.f.ReadAt(p, start)
+	if err == io.EOF && n == len(p) {
+		err = nil
+	}
+	return n, err
+}
+
+func (bs *BlobStorage) WriteAt(p []byte, piece int, off int64) (int, error) {
+	start, err := bs.layout.check(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return bs.f.WriteAt(p, start)
+}
+
+func (bs *BlobStorage) Close() error {
+	return bs.f.Close()
+}
@@ -0,0 +1,70 @@
+package torrent
+
+import "github.com/codecrafters-io/bittorrent-starter-go/pkg/util"
+
+// File is one of the files the torrent data is made of. Files are laid out
+// back to back in the order they appear in the torrent.
+type File struct {
+	// Path components relative to the download directory, starting with the torrent name
+	// for multi-file torrents
+	Path   []string
+	Length int
+	// Offset of the file in the concatenated torrent data
+	Offset int
+}
+
+// FileSegment is the part of a byte range of the torrent data that falls in a single file
+type FileSegment struct {
+	// File index in the files of the torrent
+	File int
+	// Offset within the file
+	Offset int
+	Length int
+}
+
+// SegmentsForRange splits the byte range [offset, offset+length) of the torrent data
+// into the file segments it spans.
+func SegmentsForRange(files []File, offset, length int) []FileSegment {
+	var res []FileSegment
+	end := offset + length
+	for i, f := range files {
+		fEnd := f.Offset + f.Length
+		if fEnd <= offset || f.Length == 0 {
+			continue
+		}
+		if f.Offset >= end {
+			break
+		}
+		start := offset
+		if f.Offset > start {
+			start = f.Offset
+		}
+		stop := end
+		if fEnd < stop {
+			stop = fEnd
+		}
+		res = append(res, FileSegment{
+			File:   i,
+			Offset: start - f.Offset,
+			Length: stop - start,
+		})
+	}
+	return res
+}
+
+// PieceSegments returns the file segments the piece with the given index spans
+func PieceSegments(t Torrent, idx int) ([]FileSegment, error) {
+	files, err := t.Files()
+	if err != nil {
+		return nil, err
+	}
+	tLen, err := t.Length()
+	if err != nil {
+		return nil, err
+	}
+	pieceLen, err := t.PieceLength()
+	if err != nil {
+		return nil, err
+	}
+	return SegmentsForRange(files, idx*pieceLen, util.GetLengthForIdx(tLen, pieceLen, idx)), nil
+}
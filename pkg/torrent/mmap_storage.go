@@ -0,0 +1,276 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// mmapWindowSize is the size of the regions large files are mapped in. It must
+// be a multiple of the page size.
+var mmapWindowSize int64 = 64 << 20
+
+// MmapStorage stores the torrent data in its files like FileStorage, but maps the
+// files in memory, so that blocks are copied straight to the page cache and
+// pieces are hashed without reading them back. Files are mapped in windows as
+// they are accessed, and unmapped when the storage is closed. Files that can't be
+// mapped, like on platforms without mmap, are accessed with pread/pwrite instead.
+type MmapStorage struct {
+	*completion
+	layout *pieceLayout
+	paths  []string
+
+	// held for reading while mapped memory is accessed, and for writing when
+	// unmapping it
+	mu     sync.RWMutex
+	closed bool
+
+	filesMu sync.Mutex
+	files   map[int]*mappedFile
+}
+
+// mappedFile is a file of the torrent with the windows mapped so far
+type mappedFile struct {
+	f      *os.File
+	length int64
+
+	mu      sync.Mutex
+	windows map[int64][]byte
+	// set once mapping fails, the file is then read and written with pread/pwrite
+	fallback bool
+}
+
+// NewMmapStorage returns storage for the files of the torrent at the given
+// paths, as returned by FilePaths. Files are created when first written to, and
+// files with an empty path are skipped.
+func NewMmapStorage(t Torrent, paths []string) (Storage, error) {
+	layout, err := newPieceLayout(t)
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) != len(layout.files) {
+		return nil, ErrInvalidFilePath
+	}
+	if err := createEmptyFiles(layout.files, paths); err != nil {
+		return nil, err
+	}
+	return &MmapStorage{
+		completion: newCompletion(layout.noOfPieces),
+		layout:     layout,
+		paths:      paths,
+		files:      make(map[int]*mappedFile),
+	}, nil
+}
+
+// file returns the file with the given index, opening it if needed
+func (ms *MmapStorage) file(idx int, create bool) (*mappedFile, error) {
+	ms.filesMu.Lock()
+	defer ms.filesMu.Unlock()
+	if mf, ok := ms.files[idx]; ok {
+		return mf, nil
+	}
+	if ms.paths[idx] == "" {
+		return nil, ErrFileSkipped
+	}
+
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+		if err := os.MkdirAll(filepath.Dir(ms.paths[idx]), 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(ms.paths[idx], flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	// files must have their full size to be mapped
+	length := int64(ms.layout.files[idx].Length)
+	if err := f.Truncate(length); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	mf := &mappedFile{f: f, length: length, windows: make(map[int64][]byte)}
+	ms.files[idx] = mf
+	return mf, nil
+}
+
+// window returns the mapped window holding the file offset, or nil if the file
+// can't be mapped
+func (mf *mappedFile) window(off int64) []byte {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	if mf.fallback {
+		return nil
+	}
+
+	start := off - off%mmapWindowSize
+	if w, ok := mf.windows[start]; ok {
+		return w
+	}
+	size := mf.length - start
+	if size > mmapWindowSize {
+		size = mmapWindowSize
+	}
+	w, err := mmap(mf.f, start, int(size))
+	if err != nil {
+		mf.fallback = true
+		return nil
+	}
+	mf.windows[start] = w
+	return w
+}
+
+// access calls fn with the mapped memory of the file range, split by window.
+// It returns false if the file can't be mapped.
+func (mf *mappedFile) access(off int64, n int, fn func(region []byte, done int)) bool {
+	done := 0
+	for done < n {
+		pos := off + int64(done)
+		w := mf.window(pos)
+		if w == nil {
+			return false
+		}
+		inWindow := int(pos % mmapWindowSize)
+		size := len(w) - inWindow
+		if size > n-done {
+			size = n - done
+		}
+		fn(w[inWindow:inWindow+size], done)
+		done += size
+	}
+	return true
+}
+
+func (mf *mappedFile) close() error {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+
+	var firstErr error
+	for start, w := range mf.windows {
+		if err := munmap(w); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(mf.windows, start)
+	}
+	if err := mf.f.Close(); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (ms *MmapStorage) ReadAt(p []byte, piece int, off int64) (int, error) {
+	start, err := ms.layout.check(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.closed {
+		return 0, ErrStorageClosed
+	}
+
+	n := 0
+	for _, seg := range SegmentsForRange(ms.layout.files, int(start), len(p)) {
+		mf, err := ms.file(seg.File, false)
+		if err != nil {
+			return n, err
+		}
+		dst := p[n : n+seg.Length]
+		mapped := mf.access(int64(seg.Offset), seg.Length, func(region []byte, done int) {
+			copy(dst[done:], region)
+		})
+		if !mapped {
+			if _, err := mf.f.ReadAt(dst, int64(seg.Offset)); err != nil && err != io.EOF {
+				return n, err
+			}
+		}
+		n += seg.Length
+	}
+	return n, nil
+}
+
+func (ms *MmapStorage) WriteAt(p []byte, piece int, off int64) (int, error) {
+	start, err := ms.layout.check(piece, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.closed {
+		return 0, ErrStorageClosed
+	}
+
+	n := 0
+	for _, seg := range SegmentsForRange(ms.layout.files, int(start), len(p)) {
+		mf, err := ms.file(seg.File, true)
+		if err != nil {
+			return n, err
+		}
+		src := p[n : n+seg.Length]
+		mapped := mf.access(int64(seg.Offset), seg.Length, func(region []byte, done int) {
+			copy(region, src[done:])
+		})
+		if !mapped {
+			if _, err := mf.f.WriteAt(src, int64(seg.Offset)); err != nil {
+				return n, err
+			}
+		}
+		n += seg.Length
+	}
+	return n, nil
+}
+
+// HashPiece returns the SHA-1 of the piece, computed over the mapped memory
+func (ms *MmapStorage) HashPiece(piece int) ([]byte, error) {
+	length := ms.layout.pieceLength(piece)
+	start, err := ms.layout.check(piece, 0, length)
+	if err != nil {
+		return nil, err
+	}
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	if ms.closed {
+		return nil, ErrStorageClosed
+	}
+
+	h := sha1.New()
+	for _, seg := range SegmentsForRange(ms.layout.files, int(start), length) {
+		mf, err := ms.file(seg.File, false)
+		if err != nil {
+			return nil, err
+		}
+		mapped := mf.access(int64(seg.Offset), seg.Length, func(region []byte, done int) {
+			h.Write(region)
+		})
+		if !mapped {
+			buf := make([]byte, seg.Length)
+			if _, err := mf.f.ReadAt(buf, int64(seg.Offset)); err != nil && err != io.EOF {
+				return nil, err
+			}
+			h.Write(buf)
+		}
+	}
+	return h.Sum(nil), nil
+}
+
+func (ms *MmapStorage) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.closed {
+		return nil
+	}
+	ms.closed = true
+
+	var firstErr error
+	for idx, mf := range ms.files {
+		if err := mf.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(ms.files, idx)
+	}
+	return firstErr
+}
@@ -0,0 +1,107 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/internal/testtorrent"
+)
+
+func TestMmapStorage(t *testing.T) {
+	dir := t.TempDir()
+	tr := newMultiFileTorrent(t)
+	paths, err := FilePaths(tr, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := NewMmapStorage(tr, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStorage(t, storage)
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.ReadAt(make([]byte, 1), 0, 0); err != ErrStorageClosed {
+		t.Fatalf("expected ErrStorageClosed, got %v", err)
+	}
+
+	data := testStorageData()
+	for i, content := range [][]byte{data[:10], {}, data[10:]} {
+		got, err := os.ReadFile(paths[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("unexpected content of %s: %v", paths[i], got)
+		}
+	}
+}
+
+func TestMmapStorageWindows(t *testing.T) {
+	// map a page at a time, so that pieces span windows
+	defer func(size int64) { mmapWindowSize = size }(mmapWindowSize)
+	page := os.Getpagesize()
+	mmapWindowSize = int64(page)
+
+	data := make([]byte, 3*page+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	pieceLen := page + page/2
+	encoded := testtorrent.Encode(t, testtorrent.Options{
+		Name:        "data.bin",
+		PieceLength: pieceLen,
+		Data:        data,
+	})
+	tr, err := NewSingleTorrentFile(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "data.bin")
+	storage, err := NewMmapStorage(tr, []string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashes, _ := tr.Pieces()
+	for i, hash := range hashes {
+		start := i * pieceLen
+		end := start + pieceLen
+		if end > len(data) {
+			end = len(data)
+		}
+		// pieces are written through NewPiece, which hashes them in place
+		p := NewPiece(end-start, storage, i)
+		if err := p.WriteBlock(0, data[start:end]); err != nil {
+			t.Fatal(err)
+		}
+		if !p.Verify(hash) {
+			t.Fatalf("piece %d failed verification", i)
+		}
+		if err := p.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read := make([]byte, pieceLen)
+	if _, err := storage.ReadAt(read, 1, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data[pieceLen:2*pieceLen]) {
+		t.Fatalf("unexpected data read for piece 1")
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("unexpected file content")
+	}
+}
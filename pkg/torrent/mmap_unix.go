@@ -0,0 +1,17 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package torrent
+
+import (
+	"os"
+	"syscall"
+)
+
+func mmap(f *os.File, off int64, length int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), off, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+func munmap(b []byte) error {
+	return syscall.Munmap(b)
+}
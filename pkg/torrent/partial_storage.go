@@ -0,0 +1,206 @@
+package torrent
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var ErrFileSkipped = errors.New("file is skipped")
+
+// PartialStorage wraps the storage of a torrent when some of its files are
+// skipped. Data of the wanted files goes to the wrapped storage, so the skipped
+// files are never created. Pieces shared between a skipped and a wanted file
+// still have to be downloaded whole to be verified, their data of skipped files
+// is kept in a part file instead.
+type PartialStorage struct {
+	Storage
+	layout *pieceLayout
+	skip   []bool
+	part   *partFile
+}
+
+// NewPartialStorage returns storage that skips the files with PrioritySkip,
+// keeping their data of boundary pieces in the part file at partPath. File paths
+// given to the wrapped storage for skipped files should be left empty, so that
+// they aren't created either.
+func NewPartialStorage(t Torrent, storage Storage, priorities []Priority, partPath string) (Storage, error) {
+	layout, err := newPieceLayout(t)
+	if err != nil {
+		return nil, err
+	}
+	if len(priorities) != len(layout.files) {
+		return nil, ErrInvalidFilePath
+	}
+	skip := make([]bool, len(priorities))
+	for i, p := range priorities {
+		skip[i] = p == PrioritySkip
+	}
+
+	// part file slots are given to the boundary pieces in order, so that the
+	// same slots are found again by a later download
+	slots := make(map[int]int)
+	for piece := 0; piece < layout.noOfPieces; piece++ {
+		segments := SegmentsForRange(layout.files, piece*layout.pieceLen, layout.pieceLength(piece))
+		skipped, wanted := false, false
+		for _, seg := range segments {
+			if skip[seg.File] {
+				skipped = true
+			} else {
+				wanted = true
+			}
+		}
+		if skipped && wanted {
+			slots[piece] = len(slots)
+		}
+	}
+
+	return &PartialStorage{
+		Storage: storage,
+		layout:  layout,
+		skip:    skip,
+		part:    &partFile{path: partPath, pieceLen: layout.pieceLen, slots: slots},
+	}, nil
+}
+
+// split calls fn for each run of the range of the piece that falls in either
+// skipped or wanted files, with the offset of the run within the piece
+func (ps *PartialStorage) split(piece int, off int64, n int, fn func(from, to int, pieceOff int64, skipped bool) error) error {
+	start, err := ps.layout.check(piece, off, n)
+	if err != nil {
+		return err
+	}
+	from, to := 0, 0
+	skipped := false
+	for _, seg := range SegmentsForRange(ps.layout.files, int(start), n) {
+		if to > from && ps.skip[seg.File] != skipped {
+			if err := fn(from, to, off+int64(from), skipped); err != nil {
+				return err
+			}
+			from = to
+		}
+		skipped = ps.skip[seg.File]
+		to += seg.Length
+	}
+	if to > from {
+		return fn(from, to, off+int64(from), skipped)
+	}
+	return nil
+}
+
+func (ps *PartialStorage) ReadAt(p []byte, piece int, off int64) (int, error) {
+	n := 0
+	err := ps.split(piece, off, len(p), func(from, to int, pieceOff int64, skipped bool) error {
+		var read int
+		var err error
+		if skipped {
+			read, err = ps.part.readAt(p[from:to], piece, pieceOff)
+		} else {
+			read, err = ps.Storage.ReadAt(p[from:to], piece, pieceOff)
+		}
+		n += read
+		return err
+	})
+	return n, err
+}
+
+func (ps *PartialStorage) WriteAt(p []byte, piece int, off int64) (int, error) {
+	n := 0
+	err := ps.split(piece, off, len(p), func(from, to int, pieceOff int64, skipped bool) error {
+		var written int
+		var err error
+		if skipped {
+			written, err = ps.part.writeAt(p[from:to], piece, pieceOff)
+		} else {
+			written, err = ps.Storage.WriteAt(p[from:to], piece, pieceOff)
+		}
+		n += written
+		return err
+	})
+	return n, err
+}
+
+func (ps *PartialStorage) Close() error {
+	err := ps.part.close()
+	if closeErr := ps.Storage.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// partFile keeps the data of boundary pieces that belongs to skipped files, one
+// slot of piece length per piece. It is created when first written to.
+type partFile struct {
+	path     string
+	pieceLen int
+	slots    map[int]int
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+func (pf *partFile) open(create bool) (*os.File, error) {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.f != nil {
+		return pf.f, nil
+	}
+	flag := os.O_RDWR
+	if create {
+		flag |= os.O_CREATE
+		if err := os.MkdirAll(filepath.Dir(pf.path), 0755); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(pf.path, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	pf.f = f
+	return f, nil
+}
+
+func (pf *partFile) offset(piece int, off int64) (int64, error) {
+	slot, ok := pf.slots[piece]
+	if !ok {
+		// only boundary pieces have data of skipped files to keep
+		return 0, ErrFileSkipped
+	}
+	return int64(slot)*int64(pf.pieceLen) + off, nil
+}
+
+func (pf *partFile) readAt(p []byte, piece int, off int64) (int, error) {
+	pos, err := pf.offset(piece, off)
+	if err != nil {
+		return 0, err
+	}
+	f, err := pf.open(false)
+	if err != nil {
+		return 0, err
+	}
+	return f.ReadAt(p, pos)
+}
+
+func (pf *partFile) writeAt(p []byte, piece int, off int64) (int, error) {
+	pos, err := pf.offset(piece, off)
+	if err != nil {
+		return 0, err
+	}
+	f, err := pf.open(true)
+	if err != nil {
+		return 0, err
+	}
+	return f.WriteAt(p, pos)
+}
+
+func (pf *partFile) close() error {
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	if pf.f == nil {
+		return nil
+	}
+	err := pf.f.Close()
+	pf.f = nil
+	return err
+}
@@ -3,21 +3,123 @@ package torrent
 import (
 	"encoding/binary"
 	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	// compact peer entries are the address followed by a 2 byte port
+	compactPeerLenIPV4 = net.IPv4len + 2
+	compactPeerLenIPV6 = net.IPv6len + 2
 )
 
 type Peer struct {
-	AddrIPV4 string
-	Port     uint16
+	// IP is either an IPv4 or an IPv6 address, nil for peers given by name
+	IP net.IP
+	// Host is the DNS name of peers a tracker gave by name, resolved when
+	// the peer is dialed
+	Host string
+	Port uint16
 
 	PeerID string
 }
 
+// Addr returns the address of the peer in host:port form, with IPv6
+// addresses enclosed in brackets
+func (p *Peer) Addr() string {
+	host := p.Host
+	if p.IP != nil || host == "" {
+		host = p.IP.String()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(p.Port)))
+}
+
+// ParsePeerAddr creates a peer from an address in host:port or [host]:port form
+func ParsePeerAddr(addr string) (*Peer, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid peer IP address: %s", host)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid peer port: %s", portStr)
+	}
+	return &Peer{
+		IP:   ip,
+		Port: uint16(port),
+	}, nil
+}
+
+// peerFromBytes parses a compact peer entry, 6 bytes for IPv4 peers
+// and 18 bytes for IPv6 peers (BEP 7)
 func peerFromBytes(b []byte) (*Peer, error) {
-	if len(b) != 6 {
-		return nil, fmt.Errorf("too few bytes provided to construct peer")
+	if len(b) != compactPeerLenIPV4 && len(b) != compactPeerLenIPV6 {
+		return nil, fmt.Errorf("invalid number of bytes provided to construct peer")
 	}
+	ipLen := len(b) - 2
+	ip := make(net.IP, ipLen)
+	copy(ip, b[:ipLen])
 	return &Peer{
-		AddrIPV4: fmt.Sprintf("%d.%d.%d.%d", b[0], b[1], b[2], b[3]),
-		Port:     binary.BigEndian.Uint16(b[4:6]),
+		IP:   ip,
+		Port: binary.BigEndian.Uint16(b[ipLen:]),
 	}, nil
 }
+
+// peersFromCompact parses a string of concatenated compact peer entries
+// of the given entry length
+func peersFromCompact(compact []byte, entryLen int) ([]*Peer, error) {
+	// check if peers string is a multiple of the entry length
+	if len(compact)%entryLen != 0 {
+		return nil, fmt.Errorf("invalid peers field")
+	}
+
+	peers := make([]*Peer, len(compact)/entryLen)
+	for i := range peers {
+		var err error
+		peers[i], err = peerFromBytes(compact[i*entryLen : (i+1)*entryLen])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return peers, nil
+}
+
+// peerDict is a peer entry of a non-compact tracker response
+type peerDict struct {
+	IP   string `bencode:"ip"`
+	Port int    `bencode:"port"`
+	// PeerID is optional, it is left out when no_peer_id is honored
+	PeerID string `bencode:"peer id"`
+}
+
+// peersFromDicts parses the peer dictionaries of a non-compact tracker response.
+// The ip key can hold an IPv4 address, an IPv6 address or a DNS name, which is
+// kept as the host of the peer instead of being resolved here.
+func peersFromDicts(list []peerDict) ([]*Peer, error) {
+	peers := make([]*Peer, 0, len(list))
+	for _, entry := range list {
+		host := entry.IP
+		if host == "" {
+			return nil, fmt.Errorf("invalid peer ip")
+		}
+		port := entry.Port
+		if port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("invalid peer port")
+		}
+
+		peer := &Peer{
+			IP:     net.ParseIP(host),
+			Port:   uint16(port),
+			PeerID: entry.PeerID,
+		}
+		if peer.IP == nil {
+			peer.Host = host
+		}
+		peers = append(peers, peer)
+	}
+	return peers, nil
+}
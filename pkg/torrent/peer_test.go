@@ -0,0 +1,54 @@
+package torrent
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPeersFromCompact(t *testing.T) {
+	v4 := []byte{165, 232, 41, 73, 0xc8, 0xd5}
+	peers, err := peersFromCompact(v4, compactPeerLenIPV4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Addr() != "165.232.41.73:51413" {
+		t.Fatalf("unexpected IPv4 peers: %v", peers)
+	}
+
+	v6 := append(net.ParseIP("2001:db8::1"), 0x1a, 0xe1)
+	peers, err = peersFromCompact(v6, compactPeerLenIPV6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 1 || peers[0].Addr() != "[2001:db8::1]:6881" {
+		t.Fatalf("unexpected IPv6 peers: %v", peers)
+	}
+
+	if _, err := peersFromCompact(v6[:17], compactPeerLenIPV6); err == nil {
+		t.Fatalf("expected error for truncated peers6 field")
+	}
+}
+
+func TestParsePeerAddr(t *testing.T) {
+	p, err := ParsePeerAddr("[2001:db8::1]:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.IP.Equal(net.ParseIP("2001:db8::1")) || p.Port != 6881 {
+		t.Fatalf("unexpected peer: %v", p)
+	}
+
+	p, err = ParsePeerAddr("127.0.0.1:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Addr() != "127.0.0.1:6881" {
+		t.Fatalf("unexpected peer address: %s", p.Addr())
+	}
+
+	for _, invalid := range []string{"2001:db8::1:6881", "localhost:6881", "127.0.0.1:70000"} {
+		if _, err := ParsePeerAddr(invalid); err == nil {
+			t.Fatalf("expected error for %s", invalid)
+		}
+	}
+}
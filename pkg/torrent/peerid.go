@@ -0,0 +1,142 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+const (
+	peerIDLen = 20
+	// Azureus-style prefix: client code SB, version 0.1.0.0
+	peerIDPrefix = "-SB0100-"
+	peerIDChars  = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	// characters used for the version numbers of Shadow-style peer ids
+	shadowVersionChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+)
+
+// LocalPeerID identifies this client to trackers and peers. It is generated once
+// per session and can be replaced with SetLocalPeerID.
+var LocalPeerID string = GeneratePeerID(peerIDPrefix)
+
+// GeneratePeerID creates a peer id starting with the given prefix, filling the
+// rest of the 20 bytes with random alphanumeric characters
+func GeneratePeerID(prefix string) string {
+	if len(prefix) >= peerIDLen {
+		return prefix[:peerIDLen]
+	}
+	random := make([]byte, peerIDLen-len(prefix))
+	rand.Read(random)
+	for i, b := range random {
+		random[i] = peerIDChars[int(b)%len(peerIDChars)]
+	}
+	return prefix + string(random)
+}
+
+// SetLocalPeerID overrides the local peer id. An id shorter than 20 bytes is
+// used as a prefix, with the rest filled randomly.
+func SetLocalPeerID(id string) error {
+	if id == "" || len(id) > peerIDLen {
+		return fmt.Errorf("peer id must be 1 to %d bytes long", peerIDLen)
+	}
+	LocalPeerID = GeneratePeerID(id)
+	return nil
+}
+
+// ClientInfo is the client software identified from a peer id
+type ClientInfo struct {
+	Name    string
+	Version string
+}
+
+func (ci *ClientInfo) String() string {
+	if ci.Version == "" {
+		return ci.Name
+	}
+	return ci.Name + " " + ci.Version
+}
+
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FW": "FrostWire",
+	"KT": "KTorrent",
+	"LT": "libtorrent (Rakshasa)",
+	"lt": "libtorrent (Rasterbar)",
+	"qB": "qBittorrent",
+	"SB": "SimpleBTclient",
+	"TR": "Transmission",
+	"TX": "Tixati",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// ParsePeerID identifies the client from its peer id, for the Azureus style
+// ("-TR2940-...") and the Shadow style ("S58B-----..."). The second value is
+// false when the peer id follows neither.
+func ParsePeerID(id string) (*ClientInfo, bool) {
+	if len(id) != peerIDLen {
+		return nil, false
+	}
+
+	// Azureus style: dash, two character client code, four version characters, dash
+	if id[0] == '-' && id[7] == '-' {
+		code := id[1:3]
+		name, ok := azureusClients[code]
+		if !ok {
+			name = "unknown (" + code + ")"
+		}
+		version, ok := parseVersion(id[3:7], "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+		if !ok {
+			return nil, false
+		}
+		return &ClientInfo{Name: name, Version: version}, true
+	}
+
+	// Shadow style: client character, up to five version characters
+	// padded with dashes, followed by three dashes
+	if name, ok := shadowClients[id[0]]; ok && id[6:9] == "---" {
+		version, ok := parseVersion(strings.TrimRight(id[1:6], "-"), shadowVersionChars)
+		if !ok {
+			return nil, false
+		}
+		return &ClientInfo{Name: name, Version: version}, true
+	}
+
+	return nil, false
+}
+
+// parseVersion turns each version character into a number, using its index in
+// chars, and joins them with dots. Trailing zeros are dropped.
+func parseVersion(v string, chars string) (string, bool) {
+	if v == "" {
+		return "", false
+	}
+	parts := make([]string, len(v))
+	for i := range v {
+		n := strings.IndexByte(chars, v[i])
+		if n < 0 {
+			return "", false
+		}
+		parts[i] = fmt.Sprint(n)
+	}
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, "."), true
+}
@@ -0,0 +1,65 @@
+package torrent
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratePeerID(t *testing.T) {
+	a, b := GeneratePeerID(peerIDPrefix), GeneratePeerID(peerIDPrefix)
+	if len(a) != peerIDLen || !strings.HasPrefix(a, peerIDPrefix) {
+		t.Fatalf("unexpected peer id: %q", a)
+	}
+	if a == b {
+		t.Fatalf("expected random peer ids, got %q twice", a)
+	}
+
+	info, ok := ParsePeerID(a)
+	if !ok || info.String() != "SimpleBTclient 0.1" {
+		t.Fatalf("unexpected client for own peer id: %v", info)
+	}
+}
+
+func TestSetLocalPeerID(t *testing.T) {
+	defer func(id string) { LocalPeerID = id }(LocalPeerID)
+
+	if err := SetLocalPeerID("-XX1234-"); err != nil {
+		t.Fatal(err)
+	}
+	if len(LocalPeerID) != peerIDLen || !strings.HasPrefix(LocalPeerID, "-XX1234-") {
+		t.Fatalf("unexpected peer id: %q", LocalPeerID)
+	}
+	if err := SetLocalPeerID(strings.Repeat("x", 21)); err == nil {
+		t.Fatalf("expected error for peer id longer than 20 bytes")
+	}
+}
+
+func TestParsePeerID(t *testing.T) {
+	cases := map[string]string{
+		"-TR2940-k8hj0wgej6ch": "Transmission 2.9.4",
+		"-qB4250-abcdefghijkl": "qBittorrent 4.2.5",
+		"-lt0D60-abcdefghijkl": "libtorrent (Rasterbar) 0.13.6",
+		"-ZZ1000-abcdefghijkl": "unknown (ZZ) 1.0",
+		"S58B-----abcdefghijk": "Shadow 5.8.11",
+		"T03I--00abcdefghijkl": "",
+		"T03I-----abcdefghijk": "BitTornado 0.3.18",
+	}
+	for id, expected := range cases {
+		info, ok := ParsePeerID(id)
+		if expected == "" {
+			if ok {
+				t.Fatalf("expected %q not to be parsed, got %v", id, info)
+			}
+			continue
+		}
+		if !ok || info.String() != expected {
+			t.Fatalf("expected %q for %q, got %v", expected, id, info)
+		}
+	}
+
+	for _, invalid := range []string{"00112233445566778899", "-TR2940", "M4-20-8--abcdefghijk"} {
+		if info, ok := ParsePeerID(invalid); ok {
+			t.Fatalf("expected %q not to be parsed, got %v", invalid, info)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"fmt"
-	"io"
 )
 
 type Piece interface {
@@ -16,15 +15,27 @@ type Piece interface {
 	Length() int
 }
 
+// BasicPiece gathers the blocks of a piece in memory, and writes the piece
+// to storage once it is verified
 type BasicPiece struct {
 	data    []byte
-	storage io.Writer
+	storage Storage
 	idx     int
 
 	written int
 }
 
-func NewPiece(length int, storage io.Writer, idx int) Piece {
+// NewPiece returns the piece with the given index. For storage that hashes pieces
+// in place, blocks are written to storage as they arrive.
+func NewPiece(length int, storage Storage, idx int) Piece {
+	if hasher, ok := storage.(PieceHasher); ok {
+		return &DirectPiece{
+			storage: storage,
+			hasher:  hasher,
+			idx:     idx,
+			length:  length,
+		}
+	}
 	return &BasicPiece{
 		data:    make([]byte, length),
 		storage: storage,
@@ -66,14 +77,58 @@ func (bp *BasicPiece) Verify(givenHash []byte) bool {
 
 func (bp *BasicPiece) Commit() error {
 
-	n, err := bp.storage.Write(bp.data)
+	n, err := bp.storage.WriteAt(bp.data, bp.idx, 0)
 	if err != nil {
 		return err
 	}
 
 	if n != len(bp.data) {
-		return fmt.Errorf("error writing piece data to file")
+		return fmt.Errorf("error writing piece data to storage")
 	}
 
+	return bp.storage.MarkComplete(bp.idx)
+}
+
+// DirectPiece writes its blocks straight to storage, which hashes the piece in
+// place when verifying it
+type DirectPiece struct {
+	storage Storage
+	hasher  PieceHasher
+	idx     int
+	length  int
+
+	written int
+}
+
+func (dp *DirectPiece) Index() int {
+	return dp.idx
+}
+
+func (dp *DirectPiece) Length() int {
+	return dp.length
+}
+
+func (dp *DirectPiece) IsComplete() bool {
+	return dp.length == dp.written
+}
+
+func (dp *DirectPiece) WriteBlock(begin int, data []byte) error {
+	if begin+len(data) > dp.length {
+		return fmt.Errorf("data written to piece exceeds size")
+	}
+	if _, err := dp.storage.WriteAt(data, dp.idx, int64(begin)); err != nil {
+		return err
+	}
+	dp.written += len(data)
 	return nil
 }
+
+func (dp *DirectPiece) Verify(givenHash []byte) bool {
+	computed, err := dp.hasher.HashPiece(dp.idx)
+	return err == nil && bytes.Equal(computed, givenHash)
+}
+
+// Commit marks the piece complete, its data is already in storage
+func (dp *DirectPiece) Commit() error {
+	return dp.storage.MarkComplete(dp.idx)
+}
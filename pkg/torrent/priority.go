@@ -0,0 +1,194 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/util"
+)
+
+// Priority decides whether and how early the data of a file is downloaded
+type Priority int
+
+// Priorities are ordered, the zero value is the normal priority
+const (
+	PrioritySkip Priority = iota - 2
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+var ErrNoFilesSelected = errors.New("no files selected for download")
+
+func (p Priority) String() string {
+	switch p {
+	case PrioritySkip:
+		return "skip"
+	case PriorityLow:
+		return "low"
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// FileSelection picks the files of a torrent to download and their priority.
+// Files are matched by their path within the torrent, without the torrent name,
+// or by their base name.
+type FileSelection struct {
+	// Only downloads the files matching one of the globs, along with the ones
+	// in Indexes
+	Only []string
+	// Indexes of the files to download, counting from 1
+	Indexes []int
+	// Exclude skips the files matching one of the globs
+	Exclude []string
+	// High and Low change the priority of the selected files matching them
+	High []string
+	Low  []string
+}
+
+// Priorities returns the priority of each of the files
+func (fs FileSelection) Priorities(files []File) ([]Priority, error) {
+	for _, patterns := range [][]string{fs.Only, fs.Exclude, fs.High, fs.Low} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid file pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	for _, idx := range fs.Indexes {
+		if idx < 1 || idx > len(files) {
+			return nil, fmt.Errorf("file index %d out of range", idx)
+		}
+	}
+
+	priorities := make([]Priority, len(files))
+	selective := len(fs.Only) > 0 || len(fs.Indexes) > 0
+	for i, f := range files {
+		p := PriorityNormal
+		if selective && !matchFile(f, fs.Only) && !containsIndex(fs.Indexes, i+1) {
+			p = PrioritySkip
+		}
+		if matchFile(f, fs.Exclude) {
+			p = PrioritySkip
+		}
+		if p != PrioritySkip {
+			if matchFile(f, fs.High) {
+				p = PriorityHigh
+			} else if matchFile(f, fs.Low) {
+				p = PriorityLow
+			}
+		}
+		priorities[i] = p
+	}
+
+	for _, p := range priorities {
+		if p != PrioritySkip {
+			return priorities, nil
+		}
+	}
+	return nil, ErrNoFilesSelected
+}
+
+func matchFile(f File, patterns []string) bool {
+	rel := f.Path
+	if len(rel) > 1 {
+		// the torrent name is left out
+		rel = rel[1:]
+	}
+	name := strings.Join(rel, "/")
+	base := rel[len(rel)-1]
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func containsIndex(list []int, idx int) bool {
+	for _, elem := range list {
+		if elem == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFileIndexes parses a list of file indexes and ranges of them, like
+// "1,3-5", for a torrent with the given number of files. Ranges are checked
+// against it before they are expanded.
+func ParseFileIndexes(s string, files int) ([]int, error) {
+	var res []int
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to := part, part
+		if dash := strings.Index(part, "-"); dash >= 0 {
+			from, to = part[:dash], part[dash+1:]
+		}
+		start, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("invalid file index %q", part)
+		}
+		end, err := strconv.Atoi(to)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid file index %q", part)
+		}
+		if start < 1 || end > files {
+			return nil, fmt.Errorf("file index %q out of the %d files of the torrent", part, files)
+		}
+		for i := start; i <= end; i++ {
+			res = append(res, i)
+		}
+	}
+	return res, nil
+}
+
+// PiecePriorities maps the priorities of the files to the pieces of the torrent.
+// A piece gets the highest priority of the files it holds data of, so pieces
+// shared between a skipped and a wanted file are downloaded.
+func PiecePriorities(t Torrent, filePriorities []Priority) ([]Priority, error) {
+	files, err := t.Files()
+	if err != nil {
+		return nil, err
+	}
+	if len(filePriorities) != len(files) {
+		return nil, fmt.Errorf("expected %d file priorities, got %d", len(files), len(filePriorities))
+	}
+	tLen, err := t.Length()
+	if err != nil {
+		return nil, err
+	}
+	pieceLen, err := t.PieceLength()
+	if err != nil {
+		return nil, err
+	}
+	pieces, err := t.Pieces()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]Priority, len(pieces))
+	for i := range res {
+		res[i] = PrioritySkip
+		segments := SegmentsForRange(files, i*pieceLen, util.GetLengthForIdx(tLen, pieceLen, i))
+		for _, seg := range segments {
+			if p := filePriorities[seg.File]; p > res[i] {
+				res[i] = p
+			}
+		}
+	}
+	return res, nil
+}
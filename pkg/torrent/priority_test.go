@@ -0,0 +1,75 @@
+package torrent
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFileSelectionPriorities(t *testing.T) {
+	files, err := newMultiFileTorrent(t).Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		selection FileSelection
+		expected  []Priority
+	}{
+		{FileSelection{}, []Priority{PriorityNormal, PriorityNormal, PriorityNormal}},
+		{FileSelection{Only: []string{"*.bin"}}, []Priority{PriorityNormal, PrioritySkip, PriorityNormal}},
+		{FileSelection{Only: []string{"sub/*"}, Exclude: []string{"empty"}}, []Priority{PrioritySkip, PrioritySkip, PriorityNormal}},
+		{FileSelection{Indexes: []int{1}}, []Priority{PriorityNormal, PrioritySkip, PrioritySkip}},
+		{FileSelection{Exclude: []string{"a.bin"}, High: []string{"c.bin"}, Low: []string{"*"}}, []Priority{PrioritySkip, PriorityLow, PriorityHigh}},
+	}
+	for _, test := range tests {
+		priorities, err := test.selection.Priorities(files)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(priorities, test.expected) {
+			t.Errorf("%+v: expected %v, got %v", test.selection, test.expected, priorities)
+		}
+	}
+
+	if _, err := (FileSelection{Exclude: []string{"*"}}).Priorities(files); err != ErrNoFilesSelected {
+		t.Errorf("expected ErrNoFilesSelected, got %v", err)
+	}
+	if _, err := (FileSelection{Indexes: []int{4}}).Priorities(files); err == nil {
+		t.Errorf("expected error for file index out of range")
+	}
+}
+
+func TestParseFileIndexes(t *testing.T) {
+	indexes, err := ParseFileIndexes("1,3-5, 8", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(indexes, []int{1, 3, 4, 5, 8}) {
+		t.Fatalf("unexpected indexes: %v", indexes)
+	}
+	// ranges out of the files are rejected without being expanded
+	for _, invalid := range []string{"a", "3-1", "1-", "0", "8-9", "1-1000000000000"} {
+		if _, err := ParseFileIndexes(invalid, 8); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestPiecePriorities(t *testing.T) {
+	tr := newMultiFileTorrent(t)
+	// piece 0 is shared between a.bin and c.bin
+	priorities, err := PiecePriorities(tr, []Priority{PrioritySkip, PrioritySkip, PriorityHigh})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(priorities, []Priority{PriorityHigh, PriorityHigh, PriorityHigh}) {
+		t.Fatalf("unexpected priorities: %v", priorities)
+	}
+	priorities, err = PiecePriorities(tr, []Priority{PriorityLow, PriorityNormal, PrioritySkip})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(priorities, []Priority{PriorityLow, PrioritySkip, PrioritySkip}) {
+		t.Fatalf("unexpected priorities: %v", priorities)
+	}
+}
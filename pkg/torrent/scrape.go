@@ -0,0 +1,115 @@
+package torrent
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+)
+
+var ErrScrapeNotSupported = errors.New("tracker does not support scrape")
+
+// ScrapeStats holds the swarm counters a tracker reports for a torrent
+type ScrapeStats struct {
+	// number of seeders
+	Complete int `bencode:"complete"`
+	// number of times the torrent was downloaded completely
+	Downloaded int `bencode:"downloaded"`
+	// number of leechers
+	Incomplete int `bencode:"incomplete"`
+}
+
+// scrapeResponseMsg is the bencoded dictionary sent by HTTP trackers on scrape,
+// with the files keyed by infohash
+type scrapeResponseMsg struct {
+	FailureReason *string                 `bencode:"failure reason"`
+	Files         map[string]*ScrapeStats `bencode:"files"`
+}
+
+// ScrapeURL derives the scrape URL from an announce URL, following the convention
+// of replacing "announce" in the last path component with "scrape".
+func ScrapeURL(announceURL string) (string, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme == "udp" {
+		// UDP trackers scrape through the same endpoint
+		return announceURL, nil
+	}
+
+	slash := strings.LastIndex(u.Path, "/")
+	last := u.Path[slash+1:]
+	if !strings.HasPrefix(last, "announce") {
+		return "", ErrScrapeNotSupported
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(last, "announce")
+	return u.String(), nil
+}
+
+// Scrape asks the tracker for the swarm counters of the torrent
+func (t *Tracker) Scrape() (*ScrapeStats, error) {
+	infohash, err := t.torrent.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+	res, err := Scrape(t.torrent.Announce(), [][]byte{infohash})
+	if err != nil {
+		return nil, err
+	}
+	stats, ok := res[string(infohash)]
+	if !ok {
+		return nil, fmt.Errorf("torrent missing from scrape response")
+	}
+	return stats, nil
+}
+
+// Scrape asks the tracker with the given announce URL for the swarm counters of
+// several torrents at once. The result is keyed by infohash, torrents unknown
+// to the tracker are left out.
+func Scrape(announceURL string, infohashes [][]byte) (map[string]*ScrapeStats, error) {
+	scrapeURL, err := ScrapeURL(announceURL)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(scrapeURL, "udp://") {
+		return scrapeUDP(scrapeURL, infohashes)
+	}
+	return scrapeHTTP(scrapeURL, infohashes)
+}
+
+func scrapeHTTP(scrapeURL string, infohashes [][]byte) (map[string]*ScrapeStats, error) {
+	params := url.Values{}
+	for _, ih := range infohashes {
+		params.Add("info_hash", string(ih))
+	}
+
+	sep := "?"
+	if strings.Contains(scrapeURL, "?") {
+		sep = "&"
+	}
+
+	response, err := trackerClient.Get(scrapeURL + sep + params.Encode())
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var msg scrapeResponseMsg
+	if err := newTrackerDecoder(response.Body).Decode(&msg); err != nil {
+		var typeErr *bencode.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, ErrInvalidTrackerResponseFormat
+		}
+		return nil, err
+	}
+	if msg.FailureReason != nil {
+		return nil, &TrackerFailureError{Reason: *msg.FailureReason}
+	}
+	if msg.Files == nil {
+		return nil, ErrInvalidTrackerResponseFormat
+	}
+	return msg.Files, nil
+}
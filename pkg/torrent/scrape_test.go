@@ -0,0 +1,117 @@
+package torrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestScrapeURL(t *testing.T) {
+	cases := map[string]string{
+		"http://example.com/announce":           "http://example.com/scrape",
+		"http://example.com/x/announce":         "http://example.com/x/scrape",
+		"http://example.com/announce.php":       "http://example.com/scrape.php",
+		"http://example.com/announce?x2%0644":   "http://example.com/scrape?x2%0644",
+		"udp://tracker.example.com:80/announce": "udp://tracker.example.com:80/announce",
+	}
+	for announce, expected := range cases {
+		got, err := ScrapeURL(announce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != expected {
+			t.Fatalf("expected %s for %s, got %s", expected, announce, got)
+		}
+	}
+
+	for _, unsupported := range []string{"http://example.com/a", "http://example.com/announce/x", "http://example.com/x%064announce"} {
+		if _, err := ScrapeURL(unsupported); err != ErrScrapeNotSupported {
+			t.Fatalf("expected scrape not supported for %s, got %v", unsupported, err)
+		}
+	}
+}
+
+func TestScrapeHTTP(t *testing.T) {
+	ih1 := bytes.Repeat([]byte{0x01}, 20)
+	ih2 := bytes.Repeat([]byte{0x02}, 20)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" || len(r.URL.Query()["info_hash"]) != 2 {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "d5:filesd20:%sd8:completei5e10:downloadedi50e10:incompletei10ee20:%sd8:completei0e10:downloadedi1e10:incompletei2eeee", ih1, ih2)
+	}))
+	defer srv.Close()
+
+	res, err := Scrape(srv.URL+"/announce", [][]byte{ih1, ih2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := res[string(ih1)]; s == nil || s.Complete != 5 || s.Downloaded != 50 || s.Incomplete != 10 {
+		t.Fatalf("unexpected stats for first torrent: %+v", s)
+	}
+	if s := res[string(ih2)]; s == nil || s.Complete != 0 || s.Downloaded != 1 || s.Incomplete != 2 {
+		t.Fatalf("unexpected stats for second torrent: %+v", s)
+	}
+}
+
+func TestScrapeUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	const connID uint64 = 0xdeadbeef
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			action := binary.BigEndian.Uint32(buf[8:12])
+			resp := make([]byte, 8)
+			binary.BigEndian.PutUint32(resp[0:4], action)
+			copy(resp[4:8], buf[12:16])
+			switch action {
+			case udpActionConn:
+				resp = append(resp, make([]byte, 8)...)
+				binary.BigEndian.PutUint64(resp[8:16], connID)
+			case udpActionScrape:
+				if binary.BigEndian.Uint64(buf[0:8]) != connID {
+					binary.BigEndian.PutUint32(resp[0:4], udpActionError)
+					resp = append(resp, "bad connection id"...)
+					break
+				}
+				// seeders, completed and leechers derived from the first byte of each hash
+				for i := 16; i+20 <= n; i += 20 {
+					entry := make([]byte, 12)
+					binary.BigEndian.PutUint32(entry[0:4], uint32(buf[i]))
+					binary.BigEndian.PutUint32(entry[4:8], uint32(buf[i])*10)
+					binary.BigEndian.PutUint32(entry[8:12], uint32(buf[i])*2)
+					resp = append(resp, entry...)
+				}
+			}
+			pc.WriteTo(resp, addr)
+		}
+	}()
+
+	ih1 := bytes.Repeat([]byte{0x03}, 20)
+	ih2 := bytes.Repeat([]byte{0x07}, 20)
+	res, err := Scrape("udp://"+pc.LocalAddr().String()+"/announce", [][]byte{ih1, ih2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := res[string(ih1)]; s == nil || s.Complete != 3 || s.Downloaded != 30 || s.Incomplete != 6 {
+		t.Fatalf("unexpected stats for first torrent: %+v", s)
+	}
+	if s := res[string(ih2)]; s == nil || s.Complete != 7 || s.Downloaded != 70 || s.Incomplete != 14 {
+		t.Fatalf("unexpected stats for second torrent: %+v", s)
+	}
+}
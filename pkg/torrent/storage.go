@@ -0,0 +1,209 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/util"
+)
+
+var ErrStorageClosed = errors.New("storage is closed")
+
+// Storage holds the data of a torrent. Data is addressed by piece index and an
+// offset within the piece, so that implementations can store it by piece as well
+// as by file. Implementations must be safe for concurrent use, as pieces are
+// downloaded in parallel.
+type Storage interface {
+	// ReadAt reads len(p) bytes of the piece starting at off
+	ReadAt(p []byte, piece int, off int64) (int, error)
+	// WriteAt writes p to the piece starting at off
+	WriteAt(p []byte, piece int, off int64) (int, error)
+	// MarkComplete records that the data of the piece was verified
+	MarkComplete(piece int) error
+	// Completion reports whether the piece was marked complete
+	Completion(piece int) bool
+	Close() error
+}
+
+// StorageOpener opens the storage of a torrent, so that backends can be
+// plugged in where storage is created for every download
+type StorageOpener func(t Torrent) (Storage, error)
+
+// VerifyStorage hashes the pieces found in storage, as left by an earlier
+// download, and marks the ones matching their hash complete. Pieces that can't
+// be read, like the ones of files not created yet, are left missing. It returns
+// the number of pieces complete.
+func VerifyStorage(t Torrent, s Storage) (int, error) {
+	layout, err := newPieceLayout(t)
+	if err != nil {
+		return 0, err
+	}
+	hashes, err := t.Pieces()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, layout.pieceLen)
+	complete := 0
+	for i, hash := range hashes {
+		if s.Completion(i) {
+			complete++
+			continue
+		}
+		p := buf[:layout.pieceLength(i)]
+		if _, err := s.ReadAt(p, i, 0); err != nil {
+			continue
+		}
+		if sum := sha1.Sum(p); !bytes.Equal(sum[:], hash) {
+			continue
+		}
+		if err := s.MarkComplete(i); err != nil {
+			return complete, err
+		}
+		complete++
+	}
+	return complete, nil
+}
+
+// pieceLayout maps the pieces of a torrent to its data
+type pieceLayout struct {
+	files      []File
+	length     int
+	pieceLen   int
+	noOfPieces int
+}
+
+func newPieceLayout(t Torrent) (*pieceLayout, error) {
+	files, err := t.Files()
+	if err != nil {
+		return nil, err
+	}
+	length, err := t.Length()
+	if err != nil {
+		return nil, err
+	}
+	pieceLen, err := t.PieceLength()
+	if err != nil {
+		return nil, err
+	}
+	pieces, err := t.Pieces()
+	if err != nil {
+		return nil, err
+	}
+	return &pieceLayout{
+		files:      files,
+		length:     length,
+		pieceLen:   pieceLen,
+		noOfPieces: len(pieces),
+	}, nil
+}
+
+func (pl *pieceLayout) pieceLength(piece int) int {
+	return util.GetLengthForIdx(pl.length, pl.pieceLen, piece)
+}
+
+// check returns the offset of the given range of a piece in the torrent data,
+// failing if the range is outside the piece
+func (pl *pieceLayout) check(piece int, off int64, n int) (int64, error) {
+	if piece < 0 || piece >= pl.noOfPieces {
+		return 0, fmt.Errorf("piece index %d out of range", piece)
+	}
+	if off < 0 || off+int64(n) > int64(pl.pieceLength(piece)) {
+		return 0, fmt.Errorf("range exceeds the size of piece %d", piece)
+	}
+	return int64(piece)*int64(pl.pieceLen) + off, nil
+}
+
+// completion keeps the pieces marked complete in memory
+type completion struct {
+	mu       sync.Mutex
+	complete Bitfield
+}
+
+func newCompletion(noOfPieces int) *completion {
+	return &completion{complete: NewBitfield(noOfPieces)}
+}
+
+func (c *completion) MarkComplete(piece int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.complete.Set(piece)
+	return nil
+}
+
+func (c *completion) Completion(piece int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.complete.Has(piece)
+}
+
+// MemoryStorage keeps the torrent data in memory, one buffer per piece
+type MemoryStorage struct {
+	*completion
+	layout *pieceLayout
+
+	mu     sync.Mutex
+	pieces [][]byte
+}
+
+func NewMemoryStorage(t Torrent) (Storage, error) {
+	layout, err := newPieceLayout(t)
+	if err != nil {
+		return nil, err
+	}
+	return &MemoryStorage{
+		completion: newCompletion(layout.noOfPieces),
+		layout:     layout,
+		pieces:     make([][]byte, layout.noOfPieces),
+	}, nil
+}
+
+func (ms *MemoryStorage) ReadAt(p []byte, piece int, off int64) (int, error) {
+	if _, err := ms.layout.check(piece, off, len(p)); err != nil {
+		return 0, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.pieces == nil {
+		return 0, ErrStorageClosed
+	}
+	// data never written reads as zeros
+	if ms.pieces[piece] == nil {
+		for i := range p {
+			p[i] = 0
+		}
+		return len(p), nil
+	}
+	return copy(p, ms.pieces[piece][off:]), nil
+}
+
+func (ms *MemoryStorage) WriteAt(p []byte, piece int, off int64) (int, error) {
+	if _, err := ms.layout.check(piece, off, len(p)); err != nil {
+		return 0, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.pieces == nil {
+		return 0, ErrStorageClosed
+	}
+	if ms.pieces[piece] == nil {
+		ms.pieces[piece] = make([]byte, ms.layout.pieceLength(piece))
+	}
+	return copy(ms.pieces[piece][off:], p), nil
+}
+
+func (ms *MemoryStorage) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.pieces = nil
+	return nil
+}
+
+// PieceHasher is implemented by storage that can hash the data of a piece in
+// place. Pieces are then written to such storage block by block, instead of
+// being gathered in memory first.
+type PieceHasher interface {
+	HashPiece(piece int) ([]byte, error)
+}
@@ -0,0 +1,249 @@
+package torrent
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/internal/testtorrent"
+)
+
+// newMultiFileTorrent returns a torrent with 35 bytes of data in 3 files,
+// split into pieces of 16 bytes
+func newMultiFileTorrent(t *testing.T) Torrent {
+	encoded := testtorrent.Encode(t, testtorrent.Options{
+		Files: []testtorrent.File{
+			{Path: []string{"a.bin"}, Length: 10},
+			{Path: []string{"sub", "empty"}, Length: 0},
+			{Path: []string{"sub", "c.bin"}, Length: 25},
+		},
+	})
+	tr, err := NewSingleTorrentFile(bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func testStorageData() []byte {
+	data := make([]byte, 35)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	return data
+}
+
+// checkStorage writes the test data to storage piece by piece, block by block,
+// and checks that it reads back the same
+func checkStorage(t *testing.T, storage Storage) {
+	data := testStorageData()
+	for piece := 0; piece < 3; piece++ {
+		start := piece * 16
+		end := start + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		// two blocks per piece, the second one first
+		mid := start + (end-start)/2
+		if _, err := storage.WriteAt(data[mid:end], piece, int64(mid-start)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := storage.WriteAt(data[start:mid], piece, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if storage.Completion(1) {
+		t.Fatalf("piece complete before being marked")
+	}
+	if err := storage.MarkComplete(1); err != nil {
+		t.Fatal(err)
+	}
+	if !storage.Completion(1) {
+		t.Fatalf("piece not complete after being marked")
+	}
+
+	read := make([]byte, 16)
+	if _, err := storage.ReadAt(read, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data[:16]) {
+		t.Fatalf("unexpected data read for piece 0: %v", read)
+	}
+	if _, err := storage.ReadAt(read[:3], 2, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read[:3], data[32:]) {
+		t.Fatalf("unexpected data read for piece 2: %v", read[:3])
+	}
+
+	// the last piece is shorter than the others
+	if _, err := storage.WriteAt(make([]byte, 4), 2, 0); err == nil {
+		t.Fatalf("expected error writing past the end of the piece")
+	}
+	if _, err := storage.ReadAt(read, 3, 0); err == nil {
+		t.Fatalf("expected error reading a piece out of range")
+	}
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storage, err := NewMemoryStorage(newMultiFileTorrent(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStorage(t, storage)
+	storage.Close()
+	if _, err := storage.WriteAt([]byte{1}, 0, 0); err != ErrStorageClosed {
+		t.Fatalf("expected ErrStorageClosed, got %v", err)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	storage, err := NewFileStorage(newMultiFileTorrent(t), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStorage(t, storage)
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data := testStorageData()
+	expected := map[string][]byte{
+		"dataset/a.bin":     data[:10],
+		"dataset/sub/empty": {},
+		"dataset/sub/c.bin": data[10:],
+	}
+	for path, content := range expected {
+		got, err := os.ReadFile(filepath.Join(dir, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, content) {
+			t.Fatalf("unexpected content of %s: %v", path, got)
+		}
+	}
+}
+
+func TestBlobStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data")
+	storage, err := NewBlobStorage(newMultiFileTorrent(t), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStorage(t, storage)
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, testStorageData()) {
+		t.Fatalf("unexpected blob content: %v", got)
+	}
+}
+
+func TestFilePath(t *testing.T) {
+	if p, err := FilePath("/dl", []string{"name", "sub", "f.txt"}); err != nil || p != filepath.Join("/dl", "name", "sub", "f.txt") {
+		t.Fatalf("unexpected path %q (%v)", p, err)
+	}
+	for _, components := range [][]string{
+		{"name", ".."},
+		{"name", "a/../../b"},
+		{"name", ""},
+		{"..", "x"},
+		{"name", "a\\b"},
+	} {
+		if _, err := FilePath("/dl", components); err != ErrInvalidFilePath {
+			t.Fatalf("expected %v to be rejected", components)
+		}
+	}
+}
+
+func TestPartialStorage(t *testing.T) {
+	dir := t.TempDir()
+	tr := newMultiFileTorrent(t)
+	paths, err := FilePaths(tr, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a.bin is skipped, but shares piece 0 with c.bin
+	priorities := []Priority{PrioritySkip, PrioritySkip, PriorityNormal}
+	paths[0], paths[1] = "", ""
+	files, err := NewFileStorageFromPaths(tr, paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partPath := filepath.Join(dir, ".dataset.parts")
+	storage, err := NewPartialStorage(tr, files, priorities, partPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkStorage(t, storage)
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, skipped := range []string{"dataset/a.bin", "dataset/sub/empty"} {
+		if _, err := os.Stat(filepath.Join(dir, skipped)); !os.IsNotExist(err) {
+			t.Errorf("skipped file %s was created", skipped)
+		}
+	}
+	data := testStorageData()
+	got, err := os.ReadFile(filepath.Join(dir, "dataset/sub/c.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data[10:]) {
+		t.Fatalf("unexpected content of c.bin: %v", got)
+	}
+	// the part of piece 0 in a.bin is kept in the part file
+	part, err := os.ReadFile(partPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(part, data[:10]) {
+		t.Fatalf("unexpected content of part file: %v", part)
+	}
+}
+
+func TestVerifyStorage(t *testing.T) {
+	data := testtorrent.Data(40)
+	tr, err := NewSingleTorrentFile(bytes.NewReader(testtorrent.Encode(t, testtorrent.Options{Data: data})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	// nothing is complete before the file is created
+	storage, err := NewFileStorage(tr, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := VerifyStorage(tr, storage); err != nil || n != 0 {
+		t.Fatalf("%d pieces complete without the file: %v", n, err)
+	}
+	storage.Close()
+
+	// the file left by an earlier download has a bad byte in piece 1
+	left := append([]byte{}, data...)
+	left[20] ^= 0xff
+	if err := os.WriteFile(filepath.Join(dir, "dataset"), left, 0644); err != nil {
+		t.Fatal(err)
+	}
+	storage, err = NewFileStorage(tr, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if n, err := VerifyStorage(tr, storage); err != nil || n != 2 {
+		t.Fatalf("%d pieces complete, want 2: %v", n, err)
+	}
+	if !storage.Completion(0) || storage.Completion(1) || !storage.Completion(2) {
+		t.Fatal("unexpected pieces marked complete")
+	}
+}
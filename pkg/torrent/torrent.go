@@ -2,6 +2,7 @@ package torrent
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha1"
 	"errors"
 	"io"
@@ -19,11 +20,21 @@ type Torrent interface {
 	PieceLength() (int, error)
 	// Returns a slice of byte slices, each one containing the piece hash
 	Pieces() ([][]byte, error)
+	// Returns the torrent name, used as file or directory name
+	Name() (string, error)
+	// Returns the files the torrent data is made of, in order
+	Files() ([]File, error)
+	// Returns the web seed URLs (BEP 19)
+	WebSeeds() []string
 }
 
 type SingleTorrentFile struct {
 	TrackerURL string
+	URLList    []string
 	Info       map[string]interface{}
+
+	// infoHash is the SHA-1 of the info dictionary exactly as found in the file
+	infoHash []byte
 }
 
 var ErrInvalidTorrentFormat = errors.New("invalid torrent file format")
@@ -44,34 +55,61 @@ func NewSingleTorrentFile(r io.Reader) (*SingleTorrentFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	decodedFile, err := bencode.DecodeBencode(string(buf))
-	if err != nil {
+	// values are kept raw, so that the info dictionary can be hashed as it is
+	var fileDict map[string]bencode.RawMessage
+	if err := unmarshalLenient(buf, &fileDict); err != nil {
+		var typeErr *bencode.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, ErrInvalidTorrentFormat
+		}
 		return nil, err
 	}
 
-	fileDict, ok := decodedFile.(map[string]interface{})
-	if !ok {
-		return nil, ErrInvalidTorrentFormat
+	torrent := &SingleTorrentFile{}
+
+	// 'url-list' can either be a single URL or a list of them
+	if rawURLList, ok := fileDict["url-list"]; ok {
+		var urlList interface{}
+		if err := unmarshalLenient(rawURLList, &urlList); err != nil {
+			return nil, err
+		}
+		switch urlList := urlList.(type) {
+		case string:
+			if urlList != "" {
+				torrent.URLList = []string{urlList}
+			}
+		case []interface{}:
+			for _, u := range urlList {
+				if us, ok := u.(string); ok && us != "" {
+					torrent.URLList = append(torrent.URLList, us)
+				}
+			}
+		}
 	}
 
-	torrent := &SingleTorrentFile{}
-	// checking if dictionary has 'announce' key
-	if _, ok := fileDict["announce"]; !ok {
+	// checking if dictionary has 'announce' key, torrents served
+	// only by web seeds can do without it
+	if _, ok := fileDict["announce"]; !ok && len(torrent.URLList) == 0 {
 		return nil, ErrInvalidTorrentFormat
 	}
-	if torrent.TrackerURL, ok = fileDict["announce"].(string); !ok {
-		return nil, ErrInvalidTorrentFormat
+	if announce, ok := fileDict["announce"]; ok {
+		if err := unmarshalLenient(announce, &torrent.TrackerURL); err != nil {
+			return nil, ErrInvalidTorrentFormat
+		}
 	}
 
 	// checking if dictionary has 'info' key
-	if _, ok := fileDict["info"]; !ok {
+	rawInfo, ok := fileDict["info"]
+	if !ok {
 		return nil, ErrInvalidTorrentFormat
 	}
-	if torrent.Info, ok = fileDict["info"].(map[string]interface{}); !ok {
+	if err := unmarshalLenient(rawInfo, &torrent.Info); err != nil {
 		return nil, ErrInvalidTorrentFormat
 	}
+	infoHash := sha1.Sum(rawInfo)
+	torrent.infoHash = infoHash[:]
 
-	requiredInfoKeys := []string{"length", "name", "piece length", "pieces"}
+	requiredInfoKeys := []string{"name", "piece length", "pieces"}
 
 	for _, key := range requiredInfoKeys {
 		if _, ok := torrent.Info[key]; !ok {
@@ -79,10 +117,39 @@ func NewSingleTorrentFile(r io.Reader) (*SingleTorrentFile, error) {
 		}
 	}
 
+	// single file torrents have 'length', multi file ones have 'files'
+	_, hasLength := torrent.Info["length"]
+	_, hasFiles := torrent.Info["files"]
+	if !hasLength && !hasFiles {
+		return nil, ErrMissingInfoKeys
+	}
+
 	return torrent, nil
 }
 
+// unmarshalLenient decodes torrent file data. Files made by other tools don't
+// always follow the canonical encoding, which is fine as the infohash is computed
+// over the original bytes anyway.
+func unmarshalLenient(data []byte, v interface{}) error {
+	d := bencode.NewDecoder(bytes.NewReader(data))
+	d.SetMode(bencode.Lenient)
+	d.SetMaxStringLength(len(data))
+	return d.Decode(v)
+}
+
 func (t *SingleTorrentFile) Length() (int, error) {
+	if _, ok := t.Info["length"]; !ok {
+		// multi file torrent, length is the sum of all files
+		files, err := t.Files()
+		if err != nil {
+			return 0, err
+		}
+		total := 0
+		for _, f := range files {
+			total += f.Length
+		}
+		return total, nil
+	}
 	if l, ok := t.Info["length"].(int); !ok {
 		return 0, ErrInvalidValueType
 	} else {
@@ -90,6 +157,62 @@ func (t *SingleTorrentFile) Length() (int, error) {
 	}
 }
 
+func (t *SingleTorrentFile) Files() ([]File, error) {
+	name, err := t.Name()
+	if err != nil {
+		return nil, err
+	}
+
+	if l, ok := t.Info["length"].(int); ok {
+		return []File{{Path: []string{name}, Length: l}}, nil
+	}
+
+	list, ok := t.Info["files"].([]interface{})
+	if !ok {
+		return nil, ErrInvalidValueType
+	}
+
+	files := make([]File, len(list))
+	offset := 0
+	for i, entry := range list {
+		fileDict, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, ErrInvalidValueType
+		}
+		l, ok := fileDict["length"].(int)
+		if !ok {
+			return nil, ErrInvalidValueType
+		}
+		pathList, ok := fileDict["path"].([]interface{})
+		if !ok || len(pathList) == 0 {
+			return nil, ErrInvalidValueType
+		}
+		path := []string{name}
+		for _, p := range pathList {
+			ps, ok := p.(string)
+			if !ok {
+				return nil, ErrInvalidValueType
+			}
+			path = append(path, ps)
+		}
+		files[i] = File{Path: path, Length: l, Offset: offset}
+		offset += l
+	}
+
+	return files, nil
+}
+
+func (t *SingleTorrentFile) WebSeeds() []string {
+	return t.URLList
+}
+
+// Private reports whether the torrent is private (BEP 27), in which case its
+// peers only come from its trackers
+func (t *SingleTorrentFile) Private() bool {
+	private, ok := t.Info["private"].(int)
+	return ok && private == 1
+}
+
 func (t *SingleTorrentFile) Name() (string, error) {
 	if name, ok := t.Info["name"].(string); !ok {
 		return "", ErrInvalidValueType
@@ -134,7 +257,13 @@ func (t *SingleTorrentFile) Piece(idx int) ([]byte, error) {
 	return res[idx], err
 }
 
+// InfoHash returns the SHA-1 of the info dictionary. For torrents loaded from a
+// file it is computed once over the original bytes, as re-encoding the decoded
+// dictionary doesn't always give them back.
 func (t *SingleTorrentFile) InfoHash() ([]byte, error) {
+	if t.infoHash != nil {
+		return t.infoHash, nil
+	}
 	encodedInfo, err := bencode.EncodeBencodeToString(t.Info)
 	if err != nil {
 		return nil, err
@@ -1 +1,60 @@
 package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"strings"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/internal/testtorrent"
+)
+
+func TestInfoHashUsesRawInfo(t *testing.T) {
+	// keys out of order and an unknown key, re-encoding would sort them
+	info := "d6:lengthi10e4:name5:a.txt12:piece lengthi16384e6:pieces20:" + strings.Repeat("x", 20) + "1:zi1e1:ai2ee"
+	file := "d8:announce20:http://tracker/annou4:info" + info + "e"
+
+	torrent, err := NewSingleTorrentFile(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	infohash, err := torrent.InfoHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := sha1.Sum([]byte(info))
+	if !bytes.Equal(infohash, expected[:]) {
+		t.Fatalf("expected infohash %x, got %x", expected, infohash)
+	}
+
+	if l, _ := torrent.Length(); l != 10 {
+		t.Fatalf("expected length 10, got %d", l)
+	}
+}
+
+func TestNewSingleTorrentFileInvalid(t *testing.T) {
+	for _, file := range []string{
+		"",
+		"i3e",
+		"d8:announce3:url4:infoi3ee",
+		"d8:announcei3e4:infod4:name1:aee",
+		"d4:infod4:name1:a12:piece lengthi1e6:pieces0:6:lengthi1eee",
+	} {
+		if _, err := NewSingleTorrentFile(strings.NewReader(file)); err == nil {
+			t.Fatalf("expected error for %q", file)
+		}
+	}
+}
+
+func TestPrivate(t *testing.T) {
+	for _, private := range []bool{false, true} {
+		encoded := testtorrent.Encode(t, testtorrent.Options{Length: 32, Private: private})
+		tr, err := NewSingleTorrentFile(bytes.NewReader(encoded))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tr.Private() != private {
+			t.Errorf("private torrent reported as %v", tr.Private())
+		}
+	}
+}
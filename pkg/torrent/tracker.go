@@ -1,12 +1,16 @@
 package torrent
 
 import (
+	"bytes"
+	"context"
 	"errors"
-	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
 )
@@ -17,7 +21,7 @@ type Tracker struct {
 	torrent Torrent
 }
 
-var LocalPeerID string = "00112233445566778899"
+var trackerClient = &http.Client{Timeout: 30 * time.Second}
 
 func NewTracker(torrent Torrent) *Tracker {
 	return &Tracker{
@@ -25,7 +29,49 @@ func NewTracker(torrent Torrent) *Tracker {
 	}
 }
 
+// AnnounceParams holds the per-announce values sent to the tracker
+type AnnounceParams struct {
+	// Event is empty for the regular announces
+	Event      string
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	// TrackerID is the tracker id received in a previous response
+	TrackerID string
+	// NumWant is the number of peers wanted, the tracker default is used when zero
+	NumWant int
+	// Key identifies the client across IP changes
+	Key  string
+	Port int
+	// Timeout bounds the request instead of the default timeout when set
+	Timeout time.Duration
+}
+
+const (
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+const defaultPort = 6881
+
+const (
+	// peers are the deepest values, in the list of a non-compact response
+	maxTrackerResponseDepth = 4
+	// enough for the compact form of about 170k peers
+	maxTrackerStringLength = 1 << 20
+)
+
+// AskForPeers performs a one-shot announce for a download that hasn't started yet
 func (t *Tracker) AskForPeers() (*TrackerResponse, error) {
+	l, err := t.torrent.Length()
+	if err != nil {
+		return nil, err
+	}
+	return t.Announce(&AnnounceParams{Left: int64(l)})
+}
+
+func (t *Tracker) Announce(ap *AnnounceParams) (*TrackerResponse, error) {
 	params := url.Values{}
 
 	infohash, err := t.torrent.InfoHash()
@@ -33,68 +79,183 @@ func (t *Tracker) AskForPeers() (*TrackerResponse, error) {
 		return nil, err
 	}
 
+	port := ap.Port
+	if port == 0 {
+		port = defaultPort
+	}
+
 	params.Add("info_hash", string(infohash))
-	params.Add("peer_id", LocalPeerID) // hardcoding this one
-	params.Add("port", "6881")         // won't be used
-	params.Add("uploaded", "0")
-	params.Add("downloaded", "0")
+	params.Add("peer_id", LocalPeerID)
+	params.Add("port", strconv.Itoa(port))
+	params.Add("uploaded", strconv.FormatInt(ap.Uploaded, 10))
+	params.Add("downloaded", strconv.FormatInt(ap.Downloaded, 10))
+	params.Add("left", strconv.FormatInt(ap.Left, 10))
+	params.Add("compact", "1")
 
-	l, err := t.torrent.Length()
-	if err != nil {
-		return nil, err
+	if ap.Event != "" {
+		params.Add("event", ap.Event)
+	}
+	if ap.TrackerID != "" {
+		params.Add("trackerid", ap.TrackerID)
+	}
+	if ap.NumWant > 0 {
+		params.Add("numwant", strconv.Itoa(ap.NumWant))
+	}
+	if ap.Key != "" {
+		params.Add("key", ap.Key)
 	}
-	params.Add("left", strconv.Itoa(l))
-	params.Add("compact", "1")
 
-	reqUrl := t.torrent.Announce() + "?" + params.Encode()
+	// let the tracker know we can be reached over IPv6 too (BEP 7)
+	if ip := localIPV6(); ip != nil {
+		params.Add("ipv6", ip.String())
+	}
 
-	response, err := http.Get(reqUrl)
-	if err != nil {
-		return nil, err
+	// announce URLs of private trackers may already carry a query
+	sep := "?"
+	if strings.Contains(t.torrent.Announce(), "?") {
+		sep = "&"
 	}
-	defer response.Body.Close()
+	reqUrl := t.torrent.Announce() + sep + params.Encode()
 
-	body, err := io.ReadAll(response.Body)
+	ctx := context.Background()
+	if ap.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, ap.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
 	if err != nil {
 		return nil, err
 	}
-	// fmt.Println("body is")
-	// fmt.Println(string(body))
-
-	decodedResp, err := bencode.DecodeBencode(string(body))
+	response, err := trackerClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	respDict, ok := decodedResp.(map[string]interface{})
-	if !ok {
-		return nil, ErrInvalidTrackerResponseFormat
+	defer response.Body.Close()
+
+	return parseTrackerResponse(response.Body)
+}
+
+// trackerResponseMsg is the bencoded dictionary sent by HTTP trackers
+type trackerResponseMsg struct {
+	FailureReason  *string       `bencode:"failure reason"`
+	WarningMessage string        `bencode:"warning message"`
+	Interval       int           `bencode:"interval"`
+	MinInterval    int           `bencode:"min interval"`
+	TrackerID      string        `bencode:"tracker id"`
+	Complete       int           `bencode:"complete"`
+	Incomplete     int           `bencode:"incomplete"`
+	ExternalIP     []byte        `bencode:"external ip"`
+	Peers          *trackerPeers `bencode:"peers"`
+	Peers6         []byte        `bencode:"peers6"`
+}
+
+// trackerPeers holds the peers key, which is either a compact string
+// or a list of dictionaries
+type trackerPeers struct {
+	peers []*Peer
+}
+
+func (tp *trackerPeers) UnmarshalBencode(data []byte) error {
+	// the value is decoded with the same quirks accepted as the response
+	d := newTrackerDecoder(bytes.NewReader(data))
+	var err error
+	if len(data) > 0 && data[0] == 'l' {
+		var dicts []peerDict
+		if err := d.Decode(&dicts); err != nil {
+			return err
+		}
+		tp.peers, err = peersFromDicts(dicts)
+		return err
 	}
 
-	// each peer holds 6 bytes in the response
-	peersProvidedStr, ok := respDict["peers"].(string)
-	if !ok {
-		return nil, ErrInvalidTrackerResponseFormat
+	var compact []byte
+	if err := d.Decode(&compact); err != nil {
+		return err
+	}
+	// each peer holds 6 bytes in the compact response
+	tp.peers, err = peersFromCompact(compact, compactPeerLenIPV4)
+	return err
+}
+
+// newTrackerDecoder returns a decoder for tracker responses read straight
+// from the network, with limits fit for them. Trackers don't always follow
+// the canonical encoding, like sorting the keys, so their quirks are accepted.
+func newTrackerDecoder(r io.Reader) *bencode.Decoder {
+	d := bencode.NewDecoder(r)
+	d.SetMode(bencode.Lenient)
+	d.SetMaxDepth(maxTrackerResponseDepth)
+	d.SetMaxStringLength(maxTrackerStringLength)
+	return d
+}
+
+func parseTrackerResponse(r io.Reader) (*TrackerResponse, error) {
+	var msg trackerResponseMsg
+	if err := newTrackerDecoder(r).Decode(&msg); err != nil {
+		var typeErr *bencode.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			return nil, ErrInvalidTrackerResponseFormat
+		}
+		return nil, err
+	}
+
+	// when present, no other keys are expected
+	if msg.FailureReason != nil {
+		return nil, &TrackerFailureError{Reason: *msg.FailureReason}
 	}
 
-	peersProvided := []byte(peersProvidedStr)
+	res := &TrackerResponse{
+		Interval:       msg.Interval,
+		MinInterval:    msg.MinInterval,
+		TrackerID:      msg.TrackerID,
+		WarningMessage: msg.WarningMessage,
+		Complete:       msg.Complete,
+		Incomplete:     msg.Incomplete,
+	}
 
-	// check if peers string is a multiple of 6
-	if len(peersProvided)%6 != 0 {
-		return nil, fmt.Errorf("invalid peers field")
+	// external ip is a 4 or 16 byte address (BEP 24)
+	if len(msg.ExternalIP) == net.IPv4len || len(msg.ExternalIP) == net.IPv6len {
+		res.ExternalIP = net.IP(msg.ExternalIP)
 	}
 
-	peers := make([]*Peer, len(peersProvided)/6)
+	if msg.Peers != nil {
+		res.Peers = msg.Peers.peers
+	} else if msg.Peers6 == nil {
+		// a response with peers6 only is valid
+		return nil, ErrInvalidTrackerResponseFormat
+	}
 
-	for i := range peers {
-		// create peer for every 6 bytes
-		peers[i], err = peerFromBytes(peersProvided[i*6 : (i+1)*6])
+	// IPv6 peers are returned separately, each one holding 18 bytes (BEP 7)
+	if msg.Peers6 != nil {
+		peers6, err := peersFromCompact(msg.Peers6, compactPeerLenIPV6)
 		if err != nil {
 			return nil, err
 		}
+		res.Peers = append(res.Peers, peers6...)
 	}
 
-	return &TrackerResponse{
-		Interval: respDict["interval"].(int),
-		Peers:    peers,
-	}, nil
+	return res, nil
+}
+
+// localIPV6 returns a global unicast IPv6 address of this host, if there is one
+func localIPV6() net.IP {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() == nil && ipNet.IP.IsGlobalUnicast() && !isPrivateIPV6(ipNet.IP) {
+			return ipNet.IP
+		}
+	}
+	return nil
+}
+
+// isPrivateIPV6 reports whether ip is a unique local address (fc00::/7)
+func isPrivateIPV6(ip net.IP) bool {
+	return len(ip) == net.IPv6len && ip[0]&0xfe == 0xfc
 }
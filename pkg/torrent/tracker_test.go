@@ -2,22 +2,54 @@ package torrent
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/tracker/server"
 )
 
 type mockTorrent struct {
+	announce string
 }
 
 func (m *mockTorrent) Length() (int, error) {
 	return 32768, nil
 }
 
+func (m *mockTorrent) PieceLength() (int, error) {
+	return 16384, nil
+}
+
+func (m *mockTorrent) Pieces() ([][]byte, error) {
+	return make([][]byte, 2), nil
+}
+
+func (m *mockTorrent) Name() (string, error) {
+	return "mock", nil
+}
+
+func (m *mockTorrent) Files() ([]File, error) {
+	return []File{{Path: []string{"mock"}, Length: 32768}}, nil
+}
+
+func (m *mockTorrent) WebSeeds() []string {
+	return nil
+}
+
 func (m *mockTorrent) InfoHash() ([]byte, error) {
 	return hex.DecodeString("d69f91e6b2ae4c542468d1073a71d4ea13879a7f")
 }
 
 func (m *mockTorrent) Announce() string {
+	if m.announce != "" {
+		return m.announce
+	}
 	return "http://bittorrent-test-tracker.codecrafters.io/announce"
 }
 
@@ -26,7 +58,22 @@ func newTestTorrent() Torrent {
 }
 
 func TestTrackerAskForPeers(t *testing.T) {
-	tracker := NewTracker(newTestTorrent())
+	srv := httptest.NewServer(server.New(server.Options{}))
+	defer srv.Close()
+
+	// another peer joins the swarm first
+	ih, _ := newTestTorrent().InfoHash()
+	params := url.Values{
+		"info_hash": {string(ih)},
+		"peer_id":   {"-XX0001-abcdefghijkl"},
+		"port":      {"51413"},
+		"left":      {"0"},
+	}
+	if _, err := http.Get(srv.URL + "/announce?" + params.Encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker := NewTracker(&mockTorrent{announce: srv.URL + "/announce"})
 	trackerResponse, err := tracker.AskForPeers()
 	if err != nil {
 		t.Fatal(err)
@@ -35,4 +82,107 @@ func TestTrackerAskForPeers(t *testing.T) {
 	for _, peer := range trackerResponse.Peers {
 		fmt.Println(peer)
 	}
+	if len(trackerResponse.Peers) != 1 || trackerResponse.Peers[0].Addr() != "127.0.0.1:51413" {
+		t.Fatalf("unexpected peers: %v", trackerResponse.Peers)
+	}
+	if trackerResponse.Complete != 1 || trackerResponse.Incomplete != 1 {
+		t.Fatalf("unexpected swarm counters: %+v", trackerResponse)
+	}
+}
+
+// askStaticTracker asks a tracker that always responds with the given body
+func askStaticTracker(t *testing.T, body string) (*TrackerResponse, error) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer srv.Close()
+
+	return NewTracker(&mockTorrent{announce: srv.URL + "/announce"}).AskForPeers()
+}
+
+func TestTrackerNonCompactResponse(t *testing.T) {
+	resp, err := askStaticTracker(t, "d8:completei3e10:incompletei1e8:intervali900e12:min intervali60e"+
+		"5:peersld2:ip9:127.0.0.17:peer id20:-XX0001-abcdefghijkl4:porti6881eed2:ip3:::14:porti51413eee"+
+		"10:tracker id3:abc15:warning message4:slowe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != 900 || resp.MinInterval != 60 || resp.Complete != 3 || resp.Incomplete != 1 {
+		t.Fatalf("unexpected counters in response: %+v", resp)
+	}
+	if resp.TrackerID != "abc" || resp.WarningMessage != "slow" {
+		t.Fatalf("unexpected tracker id or warning in response: %+v", resp)
+	}
+	if len(resp.Peers) != 2 {
+		t.Fatalf("expected 2 peers, got %d", len(resp.Peers))
+	}
+	if resp.Peers[0].Addr() != "127.0.0.1:6881" || resp.Peers[0].PeerID != "-XX0001-abcdefghijkl" {
+		t.Fatalf("unexpected first peer: %+v", resp.Peers[0])
+	}
+	if resp.Peers[1].Addr() != "[::1]:51413" {
+		t.Fatalf("unexpected second peer: %+v", resp.Peers[1])
+	}
+}
+
+func TestTrackerUnsortedPeerDict(t *testing.T) {
+	// the keys of the peer dictionary are not sorted
+	resp, err := askStaticTracker(t, "d8:intervali60e5:peersld4:porti6881e2:ip9:127.0.0.1eee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].Addr() != "127.0.0.1:6881" {
+		t.Fatalf("unexpected peers: %v", resp.Peers)
+	}
+}
+
+func TestTrackerPeerHostName(t *testing.T) {
+	// peers given by name are resolved when dialed, not while decoding
+	resp, err := askStaticTracker(t, "d8:intervali60e5:peersld2:ip12:peer.invalid4:porti6881eeee")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Peers) != 1 {
+		t.Fatalf("expected 1 peer, got %d", len(resp.Peers))
+	}
+	if p := resp.Peers[0]; p.IP != nil || p.Host != "peer.invalid" || p.Addr() != "peer.invalid:6881" {
+		t.Fatalf("unexpected peer: %+v", p)
+	}
+}
+
+func TestTrackerCompactResponse(t *testing.T) {
+	peers6 := string(append(net.ParseIP("2001:db8::1"), 0x1a, 0xe1))
+	resp, err := askStaticTracker(t, "d11:external ip4:\x7f\x00\x00\x01"+
+		"5:peers6:\x7f\x00\x00\x02\x1a\xe1"+fmt.Sprintf("6:peers6%d:%se", len(peers6), peers6))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// interval is optional
+	if resp.Interval != 0 {
+		t.Fatalf("unexpected interval: %d", resp.Interval)
+	}
+	if !resp.ExternalIP.Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("unexpected external ip: %v", resp.ExternalIP)
+	}
+	if len(resp.Peers) != 2 || resp.Peers[0].Addr() != "127.0.0.2:6881" || resp.Peers[1].Addr() != "[2001:db8::1]:6881" {
+		t.Fatalf("unexpected peers: %v", resp.Peers)
+	}
+}
+
+func TestTrackerFailureReason(t *testing.T) {
+	_, err := askStaticTracker(t, "d14:failure reason17:torrent not founde")
+	var failure *TrackerFailureError
+	if !errors.As(err, &failure) {
+		t.Fatalf("expected tracker failure error, got %v", err)
+	}
+	if failure.Reason != "torrent not found" {
+		t.Fatalf("unexpected failure reason: %s", failure.Reason)
+	}
+}
+
+func TestTrackerInvalidResponse(t *testing.T) {
+	for _, body := range []string{"d8:intervali900e5:peersi3ee", "d8:interval3:abc5:peers0:e", "d8:intervali900ee"} {
+		if _, err := askStaticTracker(t, body); err != ErrInvalidTrackerResponseFormat {
+			t.Fatalf("expected invalid format error for %q, got %v", body, err)
+		}
+	}
 }
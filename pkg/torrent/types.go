@@ -1,6 +1,26 @@
 package torrent
 
+import "net"
+
 type TrackerResponse struct {
-	Interval int
-	Peers    []*Peer
+	Interval    int
+	MinInterval int
+	// TrackerID should be sent back in the next announces
+	TrackerID      string
+	WarningMessage string
+	// number of seeders and leechers
+	Complete   int
+	Incomplete int
+	// ExternalIP is our address as seen by the tracker (BEP 24)
+	ExternalIP net.IP
+	Peers      []*Peer
+}
+
+// TrackerFailureError is returned when the tracker responds with a failure reason
+type TrackerFailureError struct {
+	Reason string
+}
+
+func (e *TrackerFailureError) Error() string {
+	return "tracker failure: " + e.Reason
 }
@@ -0,0 +1,141 @@
+package torrent
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolID   uint64 = 0x41727101980
+	udpActionConn   uint32 = 0
+	udpActionScrape uint32 = 2
+	udpActionError  uint32 = 3
+
+	// the protocol allows about 74 infohashes per scrape packet
+	udpMaxScrapeHashes = 74
+
+	udpTimeout = 5 * time.Second
+	udpRetries = 2
+)
+
+var errUDPTimeout = errors.New("udp tracker did not respond")
+
+type udpTrackerConn struct {
+	conn   net.Conn
+	connID uint64
+}
+
+func dialUDPTracker(trackerURL string) (*udpTrackerConn, error) {
+	u, err := url.Parse(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", u.Host)
+	if err != nil {
+		return nil, fmt.Errorf("dialing udp tracker: %v", err)
+	}
+
+	tc := &udpTrackerConn{conn: conn}
+
+	req := make([]byte, 16)
+	binary.BigEndian.PutUint64(req[0:8], udpProtocolID)
+	binary.BigEndian.PutUint32(req[8:12], udpActionConn)
+	resp, err := tc.roundTrip(req, udpActionConn, 16)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tc.connID = binary.BigEndian.Uint64(resp[8:16])
+	return tc, nil
+}
+
+// roundTrip sends the request with a fresh transaction id and waits for the
+// matching response, retransmitting with an increasing timeout
+func (tc *udpTrackerConn) roundTrip(req []byte, action uint32, minLen int) ([]byte, error) {
+	tid := make([]byte, 4)
+	rand.Read(tid)
+	copy(req[12:16], tid)
+
+	buf := make([]byte, 2048)
+	for attempt := 0; attempt <= udpRetries; attempt++ {
+		if _, err := tc.conn.Write(req); err != nil {
+			return nil, err
+		}
+		tc.conn.SetReadDeadline(time.Now().Add(udpTimeout << uint(attempt)))
+
+		for {
+			n, err := tc.conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if n < 8 || string(buf[4:8]) != string(tid) {
+				// stale or unrelated packet
+				continue
+			}
+			respAction := binary.BigEndian.Uint32(buf[0:4])
+			if respAction == udpActionError {
+				return nil, &TrackerFailureError{Reason: string(buf[8:n])}
+			}
+			if respAction != action || n < minLen {
+				return nil, ErrInvalidTrackerResponseFormat
+			}
+			res := make([]byte, n)
+			copy(res, buf[:n])
+			return res, nil
+		}
+	}
+	return nil, errUDPTimeout
+}
+
+func (tc *udpTrackerConn) Close() error {
+	return tc.conn.Close()
+}
+
+func scrapeUDP(trackerURL string, infohashes [][]byte) (map[string]*ScrapeStats, error) {
+	tc, err := dialUDPTracker(trackerURL)
+	if err != nil {
+		return nil, err
+	}
+	defer tc.Close()
+
+	res := make(map[string]*ScrapeStats, len(infohashes))
+	for start := 0; start < len(infohashes); start += udpMaxScrapeHashes {
+		end := start + udpMaxScrapeHashes
+		if end > len(infohashes) {
+			end = len(infohashes)
+		}
+		batch := infohashes[start:end]
+
+		req := make([]byte, 16, 16+20*len(batch))
+		binary.BigEndian.PutUint64(req[0:8], tc.connID)
+		binary.BigEndian.PutUint32(req[8:12], udpActionScrape)
+		for _, ih := range batch {
+			req = append(req, ih...)
+		}
+
+		resp, err := tc.roundTrip(req, udpActionScrape, 8+12*len(batch))
+		if err != nil {
+			return nil, err
+		}
+
+		// the counters are returned in the order the infohashes were sent
+		for i, ih := range batch {
+			entry := resp[8+12*i : 8+12*(i+1)]
+			res[string(ih)] = &ScrapeStats{
+				Complete:   int(binary.BigEndian.Uint32(entry[0:4])),
+				Downloaded: int(binary.BigEndian.Uint32(entry[4:8])),
+				Incomplete: int(binary.BigEndian.Uint32(entry[8:12])),
+			}
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,379 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+)
+
+const (
+	defaultInterval = 30 * time.Minute
+	defaultNumWant  = 50
+	maxNumWant      = 200
+)
+
+var errInvalidInfoHash = errors.New("invalid info_hash")
+var errInvalidPeerID = errors.New("invalid peer_id")
+var errInvalidPort = errors.New("invalid port")
+var errNotAllowed = errors.New("torrent not allowed on this tracker")
+
+// Options configures the tracker server
+type Options struct {
+	// Interval sent to the clients between announces
+	Interval time.Duration
+	// MinInterval sent to the clients, zero leaves it out
+	MinInterval time.Duration
+	// PeerTTL is how long a peer is kept without announcing, twice the interval by default
+	PeerTTL time.Duration
+	// Allowlist of infohashes served, any torrent is served when empty
+	Allowlist [][]byte
+}
+
+// Server is an HTTP tracker handling announce and scrape requests,
+// keeping the swarms in memory. Swarms are dropped once their last peer
+// leaves or expires.
+type Server struct {
+	mu     sync.Mutex
+	swarms map[string]*swarm
+
+	interval    time.Duration
+	minInterval time.Duration
+	peerTTL     time.Duration
+	allowed     map[string]bool
+
+	stop chan struct{}
+	// now is replaced in tests to control peer expiry
+	now func() time.Time
+}
+
+type swarm struct {
+	peers map[string]*peerEntry
+	// number of completed events received
+	downloaded int
+}
+
+type peerEntry struct {
+	id       string
+	ip4      net.IP
+	ip6      net.IP
+	port     uint16
+	left     int64
+	lastSeen time.Time
+}
+
+func New(opts Options) *Server {
+	s := &Server{
+		swarms:      make(map[string]*swarm),
+		interval:    opts.Interval,
+		minInterval: opts.MinInterval,
+		peerTTL:     opts.PeerTTL,
+		stop:        make(chan struct{}),
+		now:         time.Now,
+	}
+	if s.interval <= 0 {
+		s.interval = defaultInterval
+	}
+	if s.peerTTL <= 0 {
+		s.peerTTL = 2 * s.interval
+	}
+	if len(opts.Allowlist) > 0 {
+		s.allowed = make(map[string]bool, len(opts.Allowlist))
+		for _, ih := range opts.Allowlist {
+			s.allowed[string(ih)] = true
+		}
+	}
+	go s.pruneLoop()
+	return s
+}
+
+// Close stops pruning the swarms
+func (s *Server) Close() error {
+	close(s.stop)
+	return nil
+}
+
+// ServeHTTP routes /announce and /scrape requests, any prefix before them is accepted
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp map[string]interface{}
+	var err error
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		resp, err = s.announce(r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		resp, err = s.scrape(r)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	// errors are reported to the client in the failure reason key
+	if err != nil {
+		resp = map[string]interface{}{"failure reason": err.Error()}
+	}
+
+	encoded, err := bencode.EncodeBencodeToString(resp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(encoded))
+}
+
+func (s *Server) announce(r *http.Request) (map[string]interface{}, error) {
+	q := r.URL.Query()
+
+	infohash := q.Get("info_hash")
+	if len(infohash) != 20 {
+		return nil, errInvalidInfoHash
+	}
+	if s.allowed != nil && !s.allowed[infohash] {
+		return nil, errNotAllowed
+	}
+	peerID := q.Get("peer_id")
+	if len(peerID) != 20 {
+		return nil, errInvalidPeerID
+	}
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return nil, errInvalidPort
+	}
+	left, _ := strconv.ParseInt(q.Get("left"), 10, 64)
+
+	numWant := defaultNumWant
+	if n, err := strconv.Atoi(q.Get("numwant")); err == nil && n >= 0 {
+		numWant = n
+	}
+	if numWant > maxNumWant {
+		numWant = maxNumWant
+	}
+
+	remoteIP := requestIP(r)
+	entry := &peerEntry{
+		id:   peerID,
+		port: uint16(port),
+		left: left,
+	}
+	// the ip parameter takes precedence over the address of the request,
+	// and ipv6 announces an additional address (BEP 7)
+	for _, ip := range []net.IP{remoteIP, net.ParseIP(q.Get("ip")), net.ParseIP(q.Get("ipv6"))} {
+		if ip == nil {
+			continue
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			entry.ip4 = ip4
+		} else {
+			entry.ip6 = ip
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	event := q.Get("event")
+	sw, ok := s.swarms[infohash]
+	if !ok {
+		sw = &swarm{peers: make(map[string]*peerEntry)}
+		// a peer leaving a torrent we don't track doesn't add it
+		if event != "stopped" {
+			s.swarms[infohash] = sw
+		}
+	}
+	sw.expire(now.Add(-s.peerTTL))
+
+	switch event {
+	case "stopped":
+		delete(sw.peers, peerID)
+	case "completed":
+		sw.downloaded++
+		fallthrough
+	default:
+		entry.lastSeen = now
+		sw.peers[peerID] = entry
+	}
+	if len(sw.peers) == 0 {
+		delete(s.swarms, infohash)
+	}
+
+	complete, incomplete := sw.counts()
+	resp := map[string]interface{}{
+		"interval":   int(s.interval / time.Second),
+		"complete":   complete,
+		"incomplete": incomplete,
+	}
+	if s.minInterval > 0 {
+		resp["min interval"] = int(s.minInterval / time.Second)
+	}
+	// our view of the client address (BEP 24)
+	if ip4 := remoteIP.To4(); ip4 != nil {
+		resp["external ip"] = string(ip4)
+	} else if remoteIP != nil {
+		resp["external ip"] = string(remoteIP.To16())
+	}
+
+	others := sw.others(peerID, numWant)
+	if q.Get("compact") == "1" {
+		var peers, peers6 []byte
+		for _, p := range others {
+			if p.ip4 != nil {
+				peers = append(peers, compactPeer(p.ip4, p.port)...)
+			}
+			if p.ip6 != nil {
+				peers6 = append(peers6, compactPeer(p.ip6, p.port)...)
+			}
+		}
+		resp["peers"] = string(peers)
+		if len(peers6) > 0 {
+			resp["peers6"] = string(peers6)
+		}
+	} else {
+		noPeerID := q.Get("no_peer_id") == "1"
+		peers := make([]interface{}, 0, len(others))
+		for _, p := range others {
+			for _, ip := range []net.IP{p.ip4, p.ip6} {
+				if ip == nil {
+					continue
+				}
+				peerDict := map[string]interface{}{
+					"ip":   ip.String(),
+					"port": int(p.port),
+				}
+				if !noPeerID {
+					peerDict["peer id"] = p.id
+				}
+				peers = append(peers, peerDict)
+			}
+		}
+		resp["peers"] = peers
+	}
+
+	return resp, nil
+}
+
+func (s *Server) scrape(r *http.Request) (map[string]interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	infohashes := r.URL.Query()["info_hash"]
+	if len(infohashes) == 0 {
+		// scraping without infohashes returns all torrents
+		for ih := range s.swarms {
+			infohashes = append(infohashes, ih)
+		}
+	}
+
+	threshold := s.now().Add(-s.peerTTL)
+	files := make(map[string]interface{})
+	for _, ih := range infohashes {
+		if len(ih) != 20 {
+			return nil, errInvalidInfoHash
+		}
+		if s.allowed != nil && !s.allowed[ih] {
+			continue
+		}
+		sw, ok := s.swarms[ih]
+		if !ok {
+			continue
+		}
+		sw.expire(threshold)
+		if len(sw.peers) == 0 {
+			delete(s.swarms, ih)
+			continue
+		}
+		complete, incomplete := sw.counts()
+		files[ih] = map[string]interface{}{
+			"complete":   complete,
+			"downloaded": sw.downloaded,
+			"incomplete": incomplete,
+		}
+	}
+
+	return map[string]interface{}{"files": files}, nil
+}
+
+// pruneLoop drops the expired peers, and the swarms left empty, of the
+// torrents no one announces or scrapes anymore
+func (s *Server) pruneLoop() {
+	ticker := time.NewTicker(s.peerTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			s.prune()
+		}
+	}
+}
+
+func (s *Server) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	threshold := s.now().Add(-s.peerTTL)
+	for ih, sw := range s.swarms {
+		sw.expire(threshold)
+		if len(sw.peers) == 0 {
+			delete(s.swarms, ih)
+		}
+	}
+}
+
+// expire removes the peers that haven't announced since the given time
+func (sw *swarm) expire(threshold time.Time) {
+	for id, p := range sw.peers {
+		if p.lastSeen.Before(threshold) {
+			delete(sw.peers, id)
+		}
+	}
+}
+
+// counts returns the number of seeders and leechers
+func (sw *swarm) counts() (int, int) {
+	complete, incomplete := 0, 0
+	for _, p := range sw.peers {
+		if p.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	return complete, incomplete
+}
+
+// others returns up to n peers of the swarm, leaving out the one asking
+func (sw *swarm) others(peerID string, n int) []*peerEntry {
+	res := make([]*peerEntry, 0, n)
+	for id, p := range sw.peers {
+		if len(res) == n {
+			break
+		}
+		if id != peerID {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func requestIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func compactPeer(ip net.IP, port uint16) []byte {
+	res := make([]byte, len(ip)+2)
+	copy(res, ip)
+	binary.BigEndian.PutUint16(res[len(ip):], port)
+	return res
+}
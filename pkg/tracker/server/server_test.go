@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/bencode"
+)
+
+var testInfoHash = string(bytes.Repeat([]byte{0xab}, 20))
+
+func peerID(c byte) string {
+	return string(bytes.Repeat([]byte{c}, 20))
+}
+
+func get(t *testing.T, srv *httptest.Server, path string, params url.Values) map[string]interface{} {
+	resp, err := http.Get(srv.URL + path + "?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := bencode.DecodeBencode(string(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded.(map[string]interface{})
+}
+
+func announceParams(id string, port string, left string) url.Values {
+	return url.Values{
+		"info_hash": {testInfoHash},
+		"peer_id":   {id},
+		"port":      {port},
+		"left":      {left},
+		"compact":   {"1"},
+	}
+}
+
+func TestAnnounceCompact(t *testing.T) {
+	srv := httptest.NewServer(New(Options{Interval: time.Minute}))
+	defer srv.Close()
+
+	seeder := announceParams(peerID('s'), "6881", "0")
+	seeder.Set("ipv6", "2001:db8::1")
+	get(t, srv, "/announce", seeder)
+
+	resp := get(t, srv, "/announce", announceParams(peerID('l'), "6882", "100"))
+	if resp["interval"] != 60 || resp["complete"] != 1 || resp["incomplete"] != 1 {
+		t.Fatalf("unexpected response: %v", resp)
+	}
+	if resp["peers"] != "\x7f\x00\x00\x01\x1a\xe1" {
+		t.Fatalf("unexpected peers: %q", resp["peers"])
+	}
+	if peers6, _ := resp["peers6"].(string); len(peers6) != 18 {
+		t.Fatalf("unexpected peers6: %q", peers6)
+	}
+	if resp["external ip"] != "\x7f\x00\x00\x01" {
+		t.Fatalf("unexpected external ip: %q", resp["external ip"])
+	}
+}
+
+func TestAnnounceNonCompact(t *testing.T) {
+	srv := httptest.NewServer(New(Options{}))
+	defer srv.Close()
+
+	get(t, srv, "/announce", announceParams(peerID('s'), "6881", "0"))
+
+	params := announceParams(peerID('l'), "6882", "100")
+	params.Del("compact")
+	resp := get(t, srv, "/announce", params)
+
+	peers, ok := resp["peers"].([]interface{})
+	if !ok || len(peers) != 1 {
+		t.Fatalf("unexpected peers: %v", resp["peers"])
+	}
+	p := peers[0].(map[string]interface{})
+	if p["ip"] != "127.0.0.1" || p["port"] != 6881 || p["peer id"] != peerID('s') {
+		t.Fatalf("unexpected peer: %v", p)
+	}
+
+	params.Set("no_peer_id", "1")
+	resp = get(t, srv, "/announce", params)
+	if _, ok := resp["peers"].([]interface{})[0].(map[string]interface{})["peer id"]; ok {
+		t.Fatalf("peer id sent despite no_peer_id")
+	}
+}
+
+func TestAnnounceStoppedAndExpiry(t *testing.T) {
+	s := New(Options{Interval: time.Minute})
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	get(t, srv, "/announce", announceParams(peerID('a'), "6881", "0"))
+	get(t, srv, "/announce", announceParams(peerID('b'), "6882", "0"))
+
+	stopped := announceParams(peerID('b'), "6882", "0")
+	stopped.Set("event", "stopped")
+	get(t, srv, "/announce", stopped)
+
+	resp := get(t, srv, "/announce", announceParams(peerID('c'), "6883", "10"))
+	if resp["complete"] != 1 || len(resp["peers"].(string)) != 6 {
+		t.Fatalf("stopped peer still in swarm: %v", resp)
+	}
+
+	// peers not announcing within the ttl are dropped
+	now = now.Add(90 * time.Second)
+	get(t, srv, "/announce", announceParams(peerID('c'), "6883", "10"))
+	now = now.Add(90 * time.Second)
+	resp = get(t, srv, "/announce", announceParams(peerID('c'), "6883", "10"))
+	if resp["complete"] != 0 || resp["incomplete"] != 1 || resp["peers"] != "" {
+		t.Fatalf("expired peer still in swarm: %v", resp)
+	}
+}
+
+func TestEmptySwarmsDropped(t *testing.T) {
+	s := New(Options{Interval: time.Minute})
+	defer s.Close()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	swarms := func() int {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.swarms)
+	}
+
+	// stopping a torrent the tracker doesn't know doesn't add it
+	stopped := announceParams(peerID('a'), "6881", "0")
+	stopped.Set("event", "stopped")
+	get(t, srv, "/announce", stopped)
+	if n := swarms(); n != 0 {
+		t.Fatalf("expected no swarms after a stopped announce, got %d", n)
+	}
+
+	// the swarm goes away with its last peer
+	get(t, srv, "/announce", announceParams(peerID('a'), "6881", "0"))
+	if n := swarms(); n != 1 {
+		t.Fatalf("expected 1 swarm, got %d", n)
+	}
+	get(t, srv, "/announce", stopped)
+	if n := swarms(); n != 0 {
+		t.Fatalf("expected the empty swarm dropped, got %d swarms", n)
+	}
+
+	// and when its peers expire, even if no one announces again
+	get(t, srv, "/announce", announceParams(peerID('b'), "6882", "0"))
+	now = now.Add(3 * time.Minute)
+	s.prune()
+	if n := swarms(); n != 0 {
+		t.Fatalf("expected the expired swarm pruned, got %d swarms", n)
+	}
+}
+
+func TestAllowlist(t *testing.T) {
+	srv := httptest.NewServer(New(Options{Allowlist: [][]byte{bytes.Repeat([]byte{0x01}, 20)}}))
+	defer srv.Close()
+
+	resp := get(t, srv, "/announce", announceParams(peerID('a'), "6881", "0"))
+	if resp["failure reason"] != errNotAllowed.Error() {
+		t.Fatalf("expected failure for torrent not allowed, got %v", resp)
+	}
+
+	resp = get(t, srv, "/announce", url.Values{"info_hash": {"short"}})
+	if resp["failure reason"] != errInvalidInfoHash.Error() {
+		t.Fatalf("expected failure for invalid infohash, got %v", resp)
+	}
+}
+
+func TestScrape(t *testing.T) {
+	srv := httptest.NewServer(New(Options{}))
+	defer srv.Close()
+
+	completed := announceParams(peerID('a'), "6881", "0")
+	completed.Set("event", "completed")
+	get(t, srv, "/announce", completed)
+	get(t, srv, "/announce", announceParams(peerID('b'), "6882", "50"))
+
+	resp := get(t, srv, "/scrape", url.Values{"info_hash": {testInfoHash, peerID('z')}})
+	files := resp["files"].(map[string]interface{})
+	if len(files) != 1 {
+		t.Fatalf("expected only known torrents in scrape, got %v", files)
+	}
+	stats := files[testInfoHash].(map[string]interface{})
+	if stats["complete"] != 1 || stats["incomplete"] != 1 || stats["downloaded"] != 1 {
+		t.Fatalf("unexpected scrape stats: %v", stats)
+	}
+
+	// all torrents are returned when no infohash is given
+	resp = get(t, srv, "/scrape", url.Values{})
+	if len(resp["files"].(map[string]interface{})) != 1 {
+		t.Fatalf("unexpected full scrape: %v", resp)
+	}
+}
@@ -0,0 +1,198 @@
+package webseed
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/ratelimit"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+const (
+	minBackoff     = 5 * time.Second
+	maxBackoff     = 10 * time.Minute
+	requestTimeout = 60 * time.Second
+)
+
+var ErrPieceHashMismatch = errors.New("actual and expected piece hash mismatch")
+
+// WebSeed downloads pieces from an HTTP mirror listed in the url-list of the
+// torrent (BEP 19). A piece is fetched with one Range request per file it spans.
+type WebSeed struct {
+	mu sync.Mutex
+
+	url     string
+	torrent torrent.Torrent
+	client  *http.Client
+	limits  ratelimit.Chain
+
+	failures int
+	retryAt  time.Time
+}
+
+func NewWebSeed(url string, t torrent.Torrent) *WebSeed {
+	return &WebSeed{
+		url:     url,
+		torrent: t,
+		client:  &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// SetLimits sets the rate limiters the data fetched draws from
+func (ws *WebSeed) SetLimits(limits ratelimit.Chain) {
+	ws.mu.Lock()
+	ws.limits = limits
+	ws.mu.Unlock()
+}
+
+func (ws *WebSeed) URL() string {
+	return ws.url
+}
+
+// Backoff returns how long to wait before using the web seed again. It is zero
+// unless the recent requests to the mirror failed.
+func (ws *WebSeed) Backoff() time.Duration {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if d := time.Until(ws.retryAt); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// DownloadPiece fetches the piece with the given index, verifies it against
+// its hash and writes it to storage, the same way PeerConn.AskForPiece does.
+func (ws *WebSeed) DownloadPiece(idx int, storage torrent.Storage) error {
+	err := ws.downloadPiece(idx, storage)
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if err != nil {
+		// every consecutive failure doubles the time the mirror is left alone
+		backoff := minBackoff << uint(ws.failures)
+		if backoff > maxBackoff || backoff <= 0 {
+			backoff = maxBackoff
+		}
+		ws.failures++
+		ws.retryAt = time.Now().Add(backoff)
+		return err
+	}
+	ws.failures = 0
+	ws.retryAt = time.Time{}
+	return nil
+}
+
+func (ws *WebSeed) downloadPiece(idx int, storage torrent.Storage) error {
+	hashes, err := ws.torrent.Pieces()
+	if err != nil {
+		return err
+	}
+	if idx < 0 || idx >= len(hashes) {
+		return fmt.Errorf("piece index %d out of range", idx)
+	}
+	files, err := ws.torrent.Files()
+	if err != nil {
+		return err
+	}
+	segments, err := torrent.PieceSegments(ws.torrent, idx)
+	if err != nil {
+		return err
+	}
+
+	pieceLen := 0
+	for _, seg := range segments {
+		pieceLen += seg.Length
+	}
+	p := torrent.NewPiece(pieceLen, storage, idx)
+
+	begin := 0
+	for _, seg := range segments {
+		data, err := ws.fetchRange(ws.fileURL(files, seg.File), seg.Offset, seg.Length)
+		if err != nil {
+			return err
+		}
+		if err := p.WriteBlock(begin, data); err != nil {
+			return err
+		}
+		begin += seg.Length
+	}
+
+	if !p.IsComplete() {
+		return fmt.Errorf("incomplete piece received from web seed")
+	}
+	if !p.Verify(hashes[idx]) {
+		return ErrPieceHashMismatch
+	}
+	return p.Commit()
+}
+
+// fileURL maps a file of the torrent to its URL on the mirror. For single file
+// torrents, the URL points to the file itself unless it ends with a slash.
+func (ws *WebSeed) fileURL(files []torrent.File, idx int) string {
+	multiFile := len(files) > 1 || len(files[0].Path) > 1
+	if !multiFile && !strings.HasSuffix(ws.url, "/") {
+		return ws.url
+	}
+
+	base := ws.url
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	escaped := make([]string, len(files[idx].Path))
+	for i, p := range files[idx].Path {
+		escaped[i] = url.PathEscape(p)
+	}
+	return base + strings.Join(escaped, "/")
+}
+
+func (ws *WebSeed) fetchRange(fileURL string, offset, length int) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// the mirror ignored the range, skip to the requested offset
+		if _, err := io.CopyN(io.Discard, resp.Body, int64(offset)); err != nil {
+			return nil, fmt.Errorf("skipping to range offset: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("web seed responded with status %s", resp.Status)
+	}
+
+	ws.mu.Lock()
+	body := &limitedReader{r: resp.Body, limits: ws.limits}
+	ws.mu.Unlock()
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(body, data); err != nil {
+		return nil, fmt.Errorf("reading web seed response: %v", err)
+	}
+	return data, nil
+}
+
+// limitedReader draws the bytes read from the rate limiters
+type limitedReader struct {
+	r      io.Reader
+	limits ratelimit.Chain
+}
+
+func (lr *limitedReader) Read(p []byte) (int, error) {
+	n, err := lr.r.Read(p)
+	lr.limits.WaitN(n)
+	return n, err
+}
@@ -0,0 +1,175 @@
+package webseed
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/internal/testtorrent"
+	"github.com/codecrafters-io/bittorrent-starter-go/pkg/torrent"
+)
+
+const testPieceLength = testtorrent.PieceLength
+
+func newTestTorrent(t *testing.T, opts testtorrent.Options) torrent.Torrent {
+	tr, err := torrent.NewSingleTorrentFile(bytes.NewReader(testtorrent.Encode(t, opts)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tr
+}
+
+func newStorage(t *testing.T, tr torrent.Torrent) torrent.Storage {
+	storage, err := torrent.NewMemoryStorage(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+// readData returns the torrent data held in storage
+func readData(t *testing.T, storage torrent.Storage, length int) []byte {
+	data := make([]byte, length)
+	for i := 0; i < length; i += testPieceLength {
+		end := i + testPieceLength
+		if end > length {
+			end = length
+		}
+		if _, err := storage.ReadAt(data[i:end], i/testPieceLength, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return data
+}
+
+// serveFiles serves the given contents by path, with Range support
+func serveFiles(files map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+func TestDownloadPieceSingleFile(t *testing.T) {
+	data := testtorrent.Data(40)
+	srv := serveFiles(map[string][]byte{"/mirror/sample.bin": data})
+	defer srv.Close()
+
+	tr := newTestTorrent(t, testtorrent.Options{
+		Name:    "sample.bin",
+		URLList: srv.URL + "/mirror/",
+		Data:    data,
+	})
+
+	ws := NewWebSeed(tr.WebSeeds()[0], tr)
+	storage := newStorage(t, tr)
+	// last piece is shorter than the piece length
+	for idx := 0; idx < 3; idx++ {
+		if err := ws.DownloadPiece(idx, storage); err != nil {
+			t.Fatal(err)
+		}
+		if !storage.Completion(idx) {
+			t.Fatalf("piece %d not marked complete", idx)
+		}
+	}
+	if !bytes.Equal(readData(t, storage, len(data)), data) {
+		t.Fatalf("unexpected torrent data")
+	}
+}
+
+func TestDownloadPieceMultiFile(t *testing.T) {
+	data := testtorrent.Data(40)
+	// piece 0 spans both a.bin and the start of b.bin, piece 1 spans b.bin and c.bin
+	srv := serveFiles(map[string][]byte{
+		"/mirror/dataset/a.bin":         data[:10],
+		"/mirror/dataset/sub dir/b.bin": data[10:20],
+		"/mirror/dataset/sub dir/c.bin": data[20:40],
+	})
+	defer srv.Close()
+
+	tr := newTestTorrent(t, testtorrent.Options{
+		URLList: srv.URL + "/mirror",
+		Files: []testtorrent.File{
+			{Path: []string{"a.bin"}, Length: 10},
+			{Path: []string{"sub dir", "b.bin"}, Length: 10},
+			{Path: []string{"sub dir", "c.bin"}, Length: 20},
+		},
+		Data: data,
+	})
+
+	ws := NewWebSeed(tr.WebSeeds()[0], tr)
+	storage := newStorage(t, tr)
+	for idx := 0; idx < 3; idx++ {
+		if err := ws.DownloadPiece(idx, storage); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(readData(t, storage, len(data)), data) {
+		t.Fatalf("unexpected torrent data")
+	}
+}
+
+func TestDownloadPieceHashMismatch(t *testing.T) {
+	data := testtorrent.Data(32)
+	corrupted := append([]byte{}, data...)
+	corrupted[3] ^= 0xff
+	srv := serveFiles(map[string][]byte{"/sample.bin": corrupted})
+	defer srv.Close()
+
+	tr := newTestTorrent(t, testtorrent.Options{
+		Name:    "sample.bin",
+		URLList: srv.URL + "/sample.bin",
+		Data:    data,
+	})
+
+	ws := NewWebSeed(tr.WebSeeds()[0], tr)
+	storage := newStorage(t, tr)
+	if err := ws.DownloadPiece(0, storage); err != ErrPieceHashMismatch {
+		t.Fatalf("expected hash mismatch, got %v", err)
+	}
+	if storage.Completion(0) || bytes.Equal(readData(t, storage, len(data))[:testPieceLength], corrupted[:testPieceLength]) {
+		t.Fatalf("corrupted piece was written")
+	}
+	if err := ws.DownloadPiece(1, storage); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBrokenMirrorBackoff(t *testing.T) {
+	data := testtorrent.Data(32)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	tr := newTestTorrent(t, testtorrent.Options{
+		Name:    "sample.bin",
+		URLList: srv.URL + "/sample.bin",
+		Data:    data,
+	})
+
+	ws := NewWebSeed(tr.WebSeeds()[0], tr)
+	storage := newStorage(t, tr)
+	if ws.Backoff() != 0 {
+		t.Fatalf("expected no backoff before any request")
+	}
+	if err := ws.DownloadPiece(0, storage); err == nil {
+		t.Fatalf("expected error from broken mirror")
+	}
+	first := ws.Backoff()
+	if first <= 0 {
+		t.Fatalf("expected backoff after failure")
+	}
+	if err := ws.DownloadPiece(0, storage); err == nil {
+		t.Fatalf("expected error from broken mirror")
+	}
+	if ws.Backoff() <= first {
+		t.Fatalf("expected backoff to grow after consecutive failures")
+	}
+}